@@ -0,0 +1,485 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: agent.proto
+
+package agentpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	AgentService_AllocateSlot_FullMethodName = "/inconnect.agent.v1.AgentService/AllocateSlot"
+	AgentService_ReserveSlot_FullMethodName  = "/inconnect.agent.v1.AgentService/ReserveSlot"
+	AgentService_ListSlots_FullMethodName    = "/inconnect.agent.v1.AgentService/ListSlots"
+	AgentService_Stats_FullMethodName        = "/inconnect.agent.v1.AgentService/Stats"
+	AgentService_Reload_FullMethodName       = "/inconnect.agent.v1.AgentService/Reload"
+	AgentService_Restart_FullMethodName      = "/inconnect.agent.v1.AgentService/Restart"
+	AgentService_Reset_FullMethodName        = "/inconnect.agent.v1.AgentService/Reset"
+	AgentService_WatchEvents_FullMethodName  = "/inconnect.agent.v1.AgentService/WatchEvents"
+)
+
+// AgentServiceClient is the client API for AgentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AgentServiceClient interface {
+	AllocateSlot(ctx context.Context, in *AllocateSlotRequest, opts ...grpc.CallOption) (*AllocateSlotResponse, error)
+	ReserveSlot(ctx context.Context, in *ReserveSlotRequest, opts ...grpc.CallOption) (*ReserveSlotResponse, error)
+	ListSlots(ctx context.Context, in *ListSlotsRequest, opts ...grpc.CallOption) (*ListSlotsResponse, error)
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	// Reload, Restart and Reset queue a job and stream its progress until it
+	// finishes.
+	Reload(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (AgentService_ReloadClient, error)
+	Restart(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (AgentService_RestartClient, error)
+	Reset(ctx context.Context, in *ResetRequest, opts ...grpc.CallOption) (AgentService_ResetClient, error)
+	// WatchEvents streams agent activity (allocations, reservations, jobs,
+	// shard reloads) as it happens.
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (AgentService_WatchEventsClient, error)
+}
+
+type agentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAgentServiceClient(cc grpc.ClientConnInterface) AgentServiceClient {
+	return &agentServiceClient{cc}
+}
+
+func (c *agentServiceClient) AllocateSlot(ctx context.Context, in *AllocateSlotRequest, opts ...grpc.CallOption) (*AllocateSlotResponse, error) {
+	out := new(AllocateSlotResponse)
+	err := c.cc.Invoke(ctx, AgentService_AllocateSlot_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) ReserveSlot(ctx context.Context, in *ReserveSlotRequest, opts ...grpc.CallOption) (*ReserveSlotResponse, error) {
+	out := new(ReserveSlotResponse)
+	err := c.cc.Invoke(ctx, AgentService_ReserveSlot_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) ListSlots(ctx context.Context, in *ListSlotsRequest, opts ...grpc.CallOption) (*ListSlotsResponse, error) {
+	out := new(ListSlotsResponse)
+	err := c.cc.Invoke(ctx, AgentService_ListSlots_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, AgentService_Stats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentServiceClient) Reload(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (AgentService_ReloadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[0], AgentService_Reload_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentServiceReloadClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type AgentService_ReloadClient interface {
+	Recv() (*JobUpdate, error)
+	grpc.ClientStream
+}
+
+type agentServiceReloadClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentServiceReloadClient) Recv() (*JobUpdate, error) {
+	m := new(JobUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentServiceClient) Restart(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (AgentService_RestartClient, error) {
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[1], AgentService_Restart_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentServiceRestartClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type AgentService_RestartClient interface {
+	Recv() (*JobUpdate, error)
+	grpc.ClientStream
+}
+
+type agentServiceRestartClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentServiceRestartClient) Recv() (*JobUpdate, error) {
+	m := new(JobUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentServiceClient) Reset(ctx context.Context, in *ResetRequest, opts ...grpc.CallOption) (AgentService_ResetClient, error) {
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[2], AgentService_Reset_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentServiceResetClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type AgentService_ResetClient interface {
+	Recv() (*JobUpdate, error)
+	grpc.ClientStream
+}
+
+type agentServiceResetClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentServiceResetClient) Recv() (*JobUpdate, error) {
+	m := new(JobUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentServiceClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (AgentService_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &AgentService_ServiceDesc.Streams[3], AgentService_WatchEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentServiceWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type AgentService_WatchEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type agentServiceWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentServiceWatchEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AgentServiceServer is the server API for AgentService service.
+// All implementations must embed UnimplementedAgentServiceServer
+// for forward compatibility
+type AgentServiceServer interface {
+	AllocateSlot(context.Context, *AllocateSlotRequest) (*AllocateSlotResponse, error)
+	ReserveSlot(context.Context, *ReserveSlotRequest) (*ReserveSlotResponse, error)
+	ListSlots(context.Context, *ListSlotsRequest) (*ListSlotsResponse, error)
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	// Reload, Restart and Reset queue a job and stream its progress until it
+	// finishes.
+	Reload(*JobRequest, AgentService_ReloadServer) error
+	Restart(*JobRequest, AgentService_RestartServer) error
+	Reset(*ResetRequest, AgentService_ResetServer) error
+	// WatchEvents streams agent activity (allocations, reservations, jobs,
+	// shard reloads) as it happens.
+	WatchEvents(*WatchEventsRequest, AgentService_WatchEventsServer) error
+	mustEmbedUnimplementedAgentServiceServer()
+}
+
+// UnimplementedAgentServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedAgentServiceServer struct {
+}
+
+func (UnimplementedAgentServiceServer) AllocateSlot(context.Context, *AllocateSlotRequest) (*AllocateSlotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AllocateSlot not implemented")
+}
+func (UnimplementedAgentServiceServer) ReserveSlot(context.Context, *ReserveSlotRequest) (*ReserveSlotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReserveSlot not implemented")
+}
+func (UnimplementedAgentServiceServer) ListSlots(context.Context, *ListSlotsRequest) (*ListSlotsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSlots not implemented")
+}
+func (UnimplementedAgentServiceServer) Stats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedAgentServiceServer) Reload(*JobRequest, AgentService_ReloadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedAgentServiceServer) Restart(*JobRequest, AgentService_RestartServer) error {
+	return status.Errorf(codes.Unimplemented, "method Restart not implemented")
+}
+func (UnimplementedAgentServiceServer) Reset(*ResetRequest, AgentService_ResetServer) error {
+	return status.Errorf(codes.Unimplemented, "method Reset not implemented")
+}
+func (UnimplementedAgentServiceServer) WatchEvents(*WatchEventsRequest, AgentService_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedAgentServiceServer) mustEmbedUnimplementedAgentServiceServer() {}
+
+// UnsafeAgentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AgentServiceServer will
+// result in compilation errors.
+type UnsafeAgentServiceServer interface {
+	mustEmbedUnimplementedAgentServiceServer()
+}
+
+func RegisterAgentServiceServer(s grpc.ServiceRegistrar, srv AgentServiceServer) {
+	s.RegisterService(&AgentService_ServiceDesc, srv)
+}
+
+func _AgentService_AllocateSlot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateSlotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).AllocateSlot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_AllocateSlot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).AllocateSlot(ctx, req.(*AllocateSlotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_ReserveSlot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReserveSlotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).ReserveSlot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_ReserveSlot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).ReserveSlot(ctx, req.(*ReserveSlotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_ListSlots_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSlotsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).ListSlots(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_ListSlots_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).ListSlots(ctx, req.(*ListSlotsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServiceServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AgentService_Stats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServiceServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AgentService_Reload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(JobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServiceServer).Reload(m, &agentServiceReloadServer{stream})
+}
+
+type AgentService_ReloadServer interface {
+	Send(*JobUpdate) error
+	grpc.ServerStream
+}
+
+type agentServiceReloadServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentServiceReloadServer) Send(m *JobUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _AgentService_Restart_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(JobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServiceServer).Restart(m, &agentServiceRestartServer{stream})
+}
+
+type AgentService_RestartServer interface {
+	Send(*JobUpdate) error
+	grpc.ServerStream
+}
+
+type agentServiceRestartServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentServiceRestartServer) Send(m *JobUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _AgentService_Reset_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ResetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServiceServer).Reset(m, &agentServiceResetServer{stream})
+}
+
+type AgentService_ResetServer interface {
+	Send(*JobUpdate) error
+	grpc.ServerStream
+}
+
+type agentServiceResetServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentServiceResetServer) Send(m *JobUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _AgentService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServiceServer).WatchEvents(m, &agentServiceWatchEventsServer{stream})
+}
+
+type AgentService_WatchEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type agentServiceWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentServiceWatchEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// AgentService_ServiceDesc is the grpc.ServiceDesc for AgentService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AgentService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "inconnect.agent.v1.AgentService",
+	HandlerType: (*AgentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AllocateSlot",
+			Handler:    _AgentService_AllocateSlot_Handler,
+		},
+		{
+			MethodName: "ReserveSlot",
+			Handler:    _AgentService_ReserveSlot_Handler,
+		},
+		{
+			MethodName: "ListSlots",
+			Handler:    _AgentService_ListSlots_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _AgentService_Stats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Reload",
+			Handler:       _AgentService_Reload_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Restart",
+			Handler:       _AgentService_Restart_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Reset",
+			Handler:       _AgentService_Reset_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _AgentService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "agent.proto",
+}
@@ -0,0 +1,5 @@
+// Package agentpb holds the protobuf definitions and generated gRPC stubs
+// for the agent control API.
+package agentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agent.proto
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIError is the body of every /v1 error response.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// Connection holds what a client needs to connect to a slot. Method is set
+// for Shadowsocks only; URI is the share link clients import.
+type Connection struct {
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Method   string `json:"method,omitempty"`
+	Password string `json:"password"`
+	URI      string `json:"uri,omitempty"`
+}
+
+type SlotResource struct {
+	ID        int       `json:"id"`
+	ShardID   int       `json:"shardId"`
+	Status    string    `json:"status"`
+	UserID    string    `json:"userId,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// AvailableAt is set for slots in cooldown.
+	AvailableAt *time.Time     `json:"availableAt,omitempty"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
+	Connection  *Connection    `json:"connection,omitempty"`
+}
+
+type SlotList struct {
+	Slots  []SlotResource `json:"slots"`
+	Limit  int            `json:"limit"`
+	Offset int            `json:"offset"`
+}
+
+type AllocateSlotRequest struct {
+	UserID string `json:"userId"`
+	// Metadata is a free-form JSON object kept with the slot until it is
+	// released.
+	Metadata map[string]any `json:"metadata,omitempty"`
+	// ClientKey is the base64 key the client keeps instead of a generated
+	// one, of the length the method requires. The shard is reloaded.
+	ClientKey string `json:"clientKey,omitempty"`
+}
+
+type AllocateSlotResponse struct {
+	Slot      SlotResource `json:"slot"`
+	FreeSlots int          `json:"freeSlots"`
+}
+
+type ShardList struct {
+	Shards []ShardStatus `json:"shards"`
+	Totals SlotCounts    `json:"totals"`
+}
+
+type CreateJobRequest struct {
+	Type    string `json:"type"`
+	ShardID int    `json:"shardId,omitempty"`
+}
+
+type JobList struct {
+	Jobs []Job `json:"jobs"`
+}
+
+type SyncRequest struct {
+	// DryRun reports the drift without changing anything.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+type AssignmentList struct {
+	Assignments []Assignment `json:"assignments"`
+}
+
+// apiParam documents a path or query parameter.
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+}
+
+// apiRoute is one /v1 operation. The same table drives request dispatch and
+// the generated OpenAPI document.
+type apiRoute struct {
+	Method     string
+	Path       string
+	Permission string
+	Summary    string
+	Params     []apiParam
+	Request    any
+	Response   any
+	Status     int
+	Errors     []int
+	handle     func(w http.ResponseWriter, r *http.Request, id string)
+}
+
+// List endpoints return defaultPageLimit entries unless limit asks for
+// another number, at most maxPageLimit.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+func pageLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return defaultPageLimit
+	case limit > maxPageLimit:
+		return maxPageLimit
+	default:
+		return limit
+	}
+}
+
+var slotListParams = []apiParam{
+	{Name: "status", In: "query", Type: "string", Description: "free, used, reserved or cooldown"},
+	{Name: "shardId", In: "query", Type: "integer", Description: "Only slots of this shard"},
+	{Name: "userId", In: "query", Type: "string", Description: "Only slots held by this user"},
+	{Name: "metadata", In: "query", Type: "object", Description: "Only slots whose metadata has these values, e.g. metadata[plan]=pro"},
+	{Name: "limit", In: "query", Type: "integer", Description: "Page size (default 100, max 1000)"},
+	{Name: "offset", In: "query", Type: "integer", Description: "Slots to skip"},
+}
+
+var assignmentParams = []apiParam{
+	{Name: "at", In: "query", Type: "string", Description: "Only holders whose credentials worked at this RFC3339 time (until rotation)"},
+	{Name: "since", In: "query", Type: "string", Description: "Only assignments active at or after this RFC3339 time"},
+	{Name: "until", In: "query", Type: "string", Description: "Only assignments that started at or before this RFC3339 time"},
+	{Name: "limit", In: "query", Type: "integer", Description: "Page size (default 100, max 1000)"},
+}
+
+var assignmentListParams = append([]apiParam{
+	{Name: "slotId", In: "query", Type: "integer", Description: "Only this slot"},
+	{Name: "shardId", In: "query", Type: "integer", Description: "Only slots of this shard"},
+	{Name: "port", In: "query", Type: "integer", Description: "Only slots of the shard listening on this port"},
+	{Name: "userId", In: "query", Type: "string", Description: "Only this user"},
+}, assignmentParams...)
+
+func (a *Agent) v1Routes() []apiRoute {
+	idParam := func(desc string) []apiParam {
+		return []apiParam{{Name: "id", In: "path", Type: "string", Description: desc}}
+	}
+	return []apiRoute{
+		{Method: http.MethodGet, Path: "/v1/slots", Permission: "stats", Summary: "List slots",
+			Params: slotListParams, Response: SlotList{}, Status: http.StatusOK,
+			Errors: []int{http.StatusBadRequest}, handle: a.v1ListSlots},
+		{Method: http.MethodPost, Path: "/v1/slots", Permission: "adduser", Summary: "Allocate a slot",
+			Request: AllocateSlotRequest{}, Response: AllocateSlotResponse{}, Status: http.StatusCreated,
+			Errors: []int{http.StatusBadRequest, http.StatusConflict}, handle: a.v1AllocateSlot},
+		{Method: http.MethodGet, Path: "/v1/slots/{id}", Permission: "stats", Summary: "Get a slot",
+			Params: append(idParam("Slot ID"), apiParam{Name: "include", In: "query", Type: "string",
+				Description: "connection: add the connection of a used slot (requires the adduser permission)"}),
+			Response: SlotResource{}, Status: http.StatusOK,
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}, handle: a.v1GetSlot},
+		{Method: http.MethodDelete, Path: "/v1/slots/{id}", Permission: "deleteuser", Summary: "Release a slot (mark reserved until the next reload)",
+			Params: idParam("Slot ID"), Response: SlotResource{}, Status: http.StatusOK,
+			Errors: []int{http.StatusNotFound, http.StatusConflict}, handle: a.v1ReleaseSlot},
+		{Method: http.MethodGet, Path: "/v1/slots/{id}/history", Permission: "audit", Summary: "Users who held a slot",
+			Params: append(idParam("Slot ID"), assignmentParams...), Response: AssignmentList{}, Status: http.StatusOK,
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound}, handle: a.v1ListAssignments},
+		{Method: http.MethodGet, Path: "/v1/assignments", Permission: "audit", Summary: "Search slot assignment history",
+			Params: assignmentListParams, Response: AssignmentList{}, Status: http.StatusOK,
+			Errors: []int{http.StatusBadRequest}, handle: a.v1ListAssignments},
+		{Method: http.MethodGet, Path: "/v1/shards", Permission: "stats", Summary: "List shards with slot counts",
+			Response: ShardList{}, Status: http.StatusOK, handle: a.v1ListShards},
+		{Method: http.MethodGet, Path: "/v1/shards/{id}", Permission: "stats", Summary: "Get a shard",
+			Params: idParam("Shard ID"), Response: ShardStatus{}, Status: http.StatusOK,
+			Errors: []int{http.StatusNotFound}, handle: a.v1GetShard},
+		{Method: http.MethodGet, Path: "/v1/jobs", Permission: "stats", Summary: "List recent jobs",
+			Response: JobList{}, Status: http.StatusOK, handle: a.v1ListJobs},
+		{Method: http.MethodPost, Path: "/v1/jobs", Summary: "Start a reload, restart, reset or rotate job (requires the permission named by type)",
+			Request: CreateJobRequest{}, Response: Job{}, Status: http.StatusAccepted,
+			Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests}, handle: a.v1CreateJob},
+		{Method: http.MethodGet, Path: "/v1/jobs/{id}", Permission: "stats", Summary: "Get a job",
+			Params: idParam("Job ID"), Response: Job{}, Status: http.StatusOK,
+			Errors: []int{http.StatusNotFound}, handle: a.v1GetJob},
+		{Method: http.MethodGet, Path: "/v1/sync", Permission: "stats", Summary: "Report of the last desired-state sync",
+			Response: SyncReport{}, Status: http.StatusOK,
+			Errors: []int{http.StatusNotFound}, handle: a.v1GetSync},
+		{Method: http.MethodPost, Path: "/v1/sync", Permission: "sync", Summary: "Sync with the desired state now",
+			Request: SyncRequest{}, Response: SyncReport{}, Status: http.StatusOK,
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusBadGateway}, handle: a.v1RunSync},
+	}
+}
+
+// v1Handler dispatches /v1 requests using the route table.
+func (a *Agent) v1Handler() http.Handler {
+	routes := a.v1Routes()
+	spec, _ := json.MarshalIndent(buildOpenAPI(routes), "", "  ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/openapi.json" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(spec)
+			return
+		}
+		pathMatched := false
+		for _, route := range routes {
+			id, ok := matchPath(route.Path, r.URL.Path)
+			if !ok {
+				continue
+			}
+			pathMatched = true
+			if route.Method != r.Method {
+				continue
+			}
+			if !a.checkAccess(w, r, route.Permission, writeAPIError) {
+				return
+			}
+			if route.Permission != "" && !a.checkRate(w, r, route.Permission, writeAPIError) {
+				return
+			}
+			route.handle(w, r, id)
+			return
+		}
+		if pathMatched {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, "not_found")
+	})
+}
+
+// matchPath matches a request path against a pattern with at most one {id}
+// segment and returns that segment.
+func matchPath(pattern, path string) (string, bool) {
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return "", false
+	}
+	var id string
+	for i := range want {
+		if want[i] == "{id}" {
+			if got[i] == "" {
+				return "", false
+			}
+			id = got[i]
+			continue
+		}
+		if want[i] != got[i] {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+func (a *Agent) v1ListSlots(w http.ResponseWriter, r *http.Request, _ string) {
+	q := r.URL.Query()
+	filter := SlotFilter{
+		Status: q.Get("status"),
+		UserID: q.Get("userId"),
+	}
+	for name, dst := range map[string]*int{"shardId": &filter.ShardID, "limit": &filter.Limit, "offset": &filter.Offset} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeAPIError(w, http.StatusBadRequest, "invalid_"+name)
+				return
+			}
+			*dst = n
+		}
+	}
+	filter.Limit = pageLimit(filter.Limit)
+	metadata, err := metadataFilter(q)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Metadata = metadata
+	switch filter.Status {
+	case "", slotStatusFree, slotStatusUsed, slotStatusReserved, slotStatusCooldown:
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_status")
+		return
+	}
+
+	slots, err := a.store.ListSlots(r.Context(), filter)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	resp := SlotList{Slots: make([]SlotResource, 0, len(slots)), Limit: filter.Limit, Offset: filter.Offset}
+	for _, slot := range slots {
+		resp.Slots = append(resp.Slots, a.slotResource(slot, false))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *Agent) v1AllocateSlot(w http.ResponseWriter, r *http.Request, _ string) {
+	var req AllocateSlotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	alloc, err := a.AllocateSlot(r.Context(), a.callerFromRequest(r), req.UserID, req.Metadata, req.ClientKey)
+	if err != nil {
+		if errors.Is(err, errInvalidMetadata) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_metadata")
+			return
+		}
+		if errors.Is(err, errInvalidClientKey) {
+			writeAPIError(w, http.StatusBadRequest, errInvalidClientKey.Error())
+			return
+		}
+		if errors.Is(err, errNoFreePorts) {
+			writeAPIError(w, http.StatusConflict, "no_free_ports")
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	slot := a.slotResource(alloc.Slot, true)
+	w.Header().Set("Location", "/v1/slots/"+strconv.Itoa(slot.ID))
+	writeJSON(w, http.StatusCreated, AllocateSlotResponse{Slot: slot, FreeSlots: alloc.FreeSlots})
+}
+
+func (a *Agent) v1GetSlot(w http.ResponseWriter, r *http.Request, id string) {
+	slotID, err := strconv.Atoi(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "slot_not_found")
+		return
+	}
+	// the connection carries the slot's password, which stats access alone
+	// does not reveal
+	var withConnection bool
+	switch r.URL.Query().Get("include") {
+	case "":
+	case "connection":
+		if !a.permitted(r, "adduser") {
+			writeAPIError(w, http.StatusForbidden, errForbidden.Error())
+			return
+		}
+		withConnection = true
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_include")
+		return
+	}
+	slot, err := a.store.GetSlot(r.Context(), slotID)
+	if err != nil {
+		writeSlotError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.slotResource(*slot, withConnection))
+}
+
+// v1ListAssignments serves both /v1/assignments and /v1/slots/{id}/history,
+// where id fixes the slot.
+func (a *Agent) v1ListAssignments(w http.ResponseWriter, r *http.Request, id string) {
+	q := r.URL.Query()
+	filter := AssignmentFilter{UserID: q.Get("userId")}
+	if id != "" {
+		slotID, err := strconv.Atoi(id)
+		if err != nil || slotID <= 0 {
+			writeAPIError(w, http.StatusNotFound, "slot_not_found")
+			return
+		}
+		filter.SlotID = slotID
+	}
+	var port int
+	for name, dst := range map[string]*int{"slotId": &filter.SlotID, "shardId": &filter.ShardID, "port": &port, "limit": &filter.Limit} {
+		if v := q.Get(name); v != "" && (id == "" || name == "limit") {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeAPIError(w, http.StatusBadRequest, "invalid_"+name)
+				return
+			}
+			*dst = n
+		}
+	}
+	for name, dst := range map[string]*time.Time{"at": &filter.At, "since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_"+name)
+				return
+			}
+			*dst = t
+		}
+	}
+	if port > 0 {
+		filter.ShardID = -1
+		for _, shard := range a.allShards() {
+			if shard.Port == port {
+				filter.ShardID = shard.ID
+			}
+		}
+		if filter.ShardID < 0 {
+			writeJSON(w, http.StatusOK, AssignmentList{Assignments: []Assignment{}})
+			return
+		}
+	}
+
+	assignments, err := a.store.Assignments(r.Context(), filter)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if assignments == nil {
+		assignments = []Assignment{}
+	}
+	writeJSON(w, http.StatusOK, AssignmentList{Assignments: assignments})
+}
+
+func (a *Agent) v1ReleaseSlot(w http.ResponseWriter, r *http.Request, id string) {
+	slotID, err := strconv.Atoi(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "slot_not_found")
+		return
+	}
+	if err := a.ReserveSlots(r.Context(), a.callerFromRequest(r), []int{slotID}); err != nil {
+		writeSlotError(w, err)
+		return
+	}
+	slot, err := a.store.GetSlot(r.Context(), slotID)
+	if err != nil {
+		writeSlotError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.slotResource(*slot, false))
+}
+
+func (a *Agent) v1ListShards(w http.ResponseWriter, r *http.Request, _ string) {
+	shards, totals, err := a.ShardStats(r.Context())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "stats_error")
+		return
+	}
+	writeJSON(w, http.StatusOK, ShardList{Shards: shards, Totals: totals})
+}
+
+func (a *Agent) v1GetShard(w http.ResponseWriter, r *http.Request, id string) {
+	shardID, _ := strconv.Atoi(id)
+	shards, _, err := a.ShardStats(r.Context())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "stats_error")
+		return
+	}
+	for _, shard := range shards {
+		if shard.ID == shardID {
+			writeJSON(w, http.StatusOK, shard)
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, "unknown_shard")
+}
+
+func (a *Agent) v1ListJobs(w http.ResponseWriter, r *http.Request, _ string) {
+	writeJSON(w, http.StatusOK, JobList{Jobs: a.jobs.List()})
+}
+
+func (a *Agent) v1CreateJob(w http.ResponseWriter, r *http.Request, _ string) {
+	var req CreateJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	switch req.Type {
+	case jobReload, jobRestart, jobReset, jobRotate:
+	default:
+		writeAPIError(w, http.StatusBadRequest, errUnknownJob.Error())
+		return
+	}
+	// v1Handler has authenticated the request; the job type decides the
+	// permission and the rate limit.
+	if !a.permitted(r, req.Type) {
+		writeAPIError(w, http.StatusForbidden, errForbidden.Error())
+		return
+	}
+	if !a.checkRate(w, r, req.Type, writeAPIError) {
+		return
+	}
+	var target []int
+	if req.ShardID > 0 {
+		target = []int{req.ShardID}
+	}
+	job, err := a.SubmitJob(a.callerFromRequest(r), req.Type, target)
+	switch {
+	case err == nil, errors.Is(err, errJobQueued):
+		w.Header().Set("Location", "/v1/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	case errors.Is(err, errTooManyJobs):
+		writeRetryAfter(w, writeAPIError, err.Error(), jobRetryAfter)
+	case errors.Is(err, errUnknownShard):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "internal_error")
+	}
+}
+
+func (a *Agent) v1GetJob(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := a.jobs.Get(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (a *Agent) v1GetSync(w http.ResponseWriter, r *http.Request, _ string) {
+	if a.cfg.SyncSource == "" {
+		writeAPIError(w, http.StatusNotFound, errSyncDisabled.Error())
+		return
+	}
+	report := a.lastSync.Load()
+	if report == nil {
+		writeAPIError(w, http.StatusNotFound, "sync_not_run")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (a *Agent) v1RunSync(w http.ResponseWriter, r *http.Request, _ string) {
+	var req SyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	report, err := a.Sync(r.Context(), a.callerFromRequest(r), req.DryRun || a.cfg.SyncDryRun)
+	switch {
+	case errors.Is(err, errSyncDisabled):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errSyncSource):
+		writeJSON(w, http.StatusBadGateway, ErrorResponse{Error: APIError{Code: errSyncSource.Error(), Message: err.Error()}})
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "internal_error")
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// slotResource converts a stored slot. Connection details are only included
+// for a used slot when withConnection is set.
+func (a *Agent) slotResource(slot Slot, withConnection bool) SlotResource {
+	res := SlotResource{
+		ID:        slot.ID,
+		ShardID:   slot.ShardID,
+		Status:    slot.Status,
+		UserID:    slot.UserID.String,
+		UpdatedAt: slot.UpdatedAt,
+		Metadata:  slot.Metadata,
+	}
+	if slot.Status == slotStatusCooldown {
+		availableAt := slot.AvailableAt
+		res.AvailableAt = &availableAt
+	}
+	if withConnection && slot.Status == slotStatusUsed {
+		shard, _ := a.shardByID(slot.ShardID)
+		res.Connection = a.connection(shard, slot)
+	}
+	return res
+}
+
+func writeSlotError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errSlotNotFound):
+		writeAPIError(w, http.StatusNotFound, "slot_not_found")
+	case errors.Is(err, errSlotReserved):
+		writeAPIError(w, http.StatusConflict, "already_reserved")
+	case errors.Is(err, errSlotFree), errors.Is(err, errSlotNotInUse):
+		writeAPIError(w, http.StatusConflict, "slot_not_in_use")
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "internal_error")
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, ErrorResponse{Error: APIError{Code: code, Message: http.StatusText(status)}})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actors used for operations the agent starts on its own.
+const (
+	actorScheduler = "system:scheduler"
+	actorCLI       = "system:cli"
+	// actorControlPlane runs the commands received in heartbeat responses.
+	actorControlPlane = "system:control-plane"
+	// actorSync reconciles the slots against the desired state.
+	actorSync = "system:sync"
+)
+
+// AuditEntry is one state-changing operation.
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Operation  string    `json:"operation"`
+	Slots      []int     `json:"slots,omitempty"`
+	Shards     []int     `json:"shards,omitempty"`
+	Result     string    `json:"result"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// AuditFilter narrows Query results; zero values match everything.
+type AuditFilter struct {
+	Operation string
+	Actor     string
+	SlotID    int
+	ShardID   int
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// AuditLog is an append-only record of state changes kept in the agent
+// database and optionally mirrored to a JSONL file.
+type AuditLog struct {
+	db   *DB
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewAuditLog(db *DB) *AuditLog {
+	return &AuditLog{db: db}
+}
+
+func (l *AuditLog) Init(ctx context.Context, filePath string) error {
+	if filePath == "" {
+		return nil
+	}
+	if err := ensureParentDir(filePath); err != nil {
+		return fmt.Errorf("ensure audit file dir: %w", err)
+	}
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("open audit file: %w", err)
+	}
+	l.file = f
+	return nil
+}
+
+func (l *AuditLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Record stores entry. Failures are logged rather than returned so that an
+// audit problem never blocks the operation being audited.
+func (l *AuditLog) Record(ctx context.Context, entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	err := l.db.QueryRowContext(ctx, `
+INSERT INTO audit (created_at, actor, remote_addr, operation, slots, shards, result, detail)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING id`,
+		entry.Time.Format(time.RFC3339Nano),
+		entry.Actor,
+		entry.RemoteAddr,
+		entry.Operation,
+		joinIDs(entry.Slots),
+		joinIDs(entry.Shards),
+		entry.Result,
+		entry.Detail,
+	).Scan(&entry.ID)
+	if err != nil {
+		log.Printf("audit %s by %s not stored: %v", entry.Operation, entry.Actor, err)
+	}
+
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit marshal failed: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("audit file write failed: %v", err)
+	}
+}
+
+func (l *AuditLog) Query(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	if f.Operation != "" {
+		where = append(where, "operation = ?")
+		args = append(args, f.Operation)
+	}
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.SlotID > 0 {
+		where = append(where, "(',' || slots || ',') LIKE ?")
+		args = append(args, fmt.Sprintf("%%,%d,%%", f.SlotID))
+	}
+	if f.ShardID > 0 {
+		where = append(where, "(',' || shards || ',') LIKE ?")
+		args = append(args, fmt.Sprintf("%%,%d,%%", f.ShardID))
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.UTC().Format(time.RFC3339Nano))
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at <= ?")
+		args = append(args, f.Until.UTC().Format(time.RFC3339Nano))
+	}
+	query := `SELECT id, created_at, actor, remote_addr, operation, slots, shards, result, detail FROM audit`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, f.Limit)
+
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select audit: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var created, slots, shards string
+		if err := rows.Scan(&e.ID, &created, &e.Actor, &e.RemoteAddr, &e.Operation, &slots, &shards, &e.Result, &e.Detail); err != nil {
+			return nil, fmt.Errorf("scan audit: %w", err)
+		}
+		e.Time, _ = time.Parse(time.RFC3339Nano, created)
+		e.Slots = splitIDs(slots)
+		e.Shards = splitIDs(shards)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate audit: %w", err)
+	}
+	return entries, nil
+}
+
+func joinIDs(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(raw string) []int {
+	if raw == "" {
+		return nil
+	}
+	var ids []int
+	for _, part := range strings.Split(raw, ",") {
+		if id, err := strconv.Atoi(part); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// auditResult turns an operation error into the stored result string.
+func auditResult(err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return "ok"
+}
+
+// formatProcessed renders per-shard rotation counts returned by Reload.
+func formatProcessed(processed map[int]int) string {
+	if len(processed) == 0 {
+		return ""
+	}
+	ids := make([]int, 0, len(processed))
+	for id := range processed {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("shard%d=%d", id, processed[id])
+	}
+	return "rotated " + strings.Join(parts, ",")
+}
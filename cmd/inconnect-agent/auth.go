@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	headerAuthToken = "X-Auth-Token"
+	headerTimestamp = "X-Timestamp"
+	headerNonce     = "X-Nonce"
+	headerSignature = "X-Signature"
+	maxSignedBody   = 1 << 20
+	permissionAll   = "*"
+)
+
+// apiPermissions lists the permission names that can be granted to client
+// certificates; each matches the endpoint it guards.
+var apiPermissions = map[string]bool{
+	"adduser":    true,
+	"deleteuser": true,
+	"reload":     true,
+	"restart":    true,
+	"reset":      true,
+	"rotate":     true,
+	"stats":      true,
+	"audit":      true,
+	"backup":     true,
+	"sync":       true,
+}
+
+var (
+	errUnauthorized     = errors.New("unauthorized")
+	errForbidden        = errors.New("forbidden")
+	errInvalidSignature = errors.New("invalid_signature")
+	errStaleTimestamp   = errors.New("stale_timestamp")
+	errReplayedNonce    = errors.New("replayed_nonce")
+	errBodyTooLarge     = errors.New("body_too_large")
+	errHMACNeedsTLS     = errors.New("hmac_requires_tls")
+)
+
+// checkAccess authenticates the request and verifies it may use permission,
+// writing the error response and returning false otherwise.
+func (a *Agent) checkAccess(w http.ResponseWriter, r *http.Request, permission string, writeErr errorWriter) bool {
+	if err := a.authenticate(r); err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, errBodyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeErr(w, status, err.Error())
+		return false
+	}
+	if !a.permitted(r, permission) {
+		writeErr(w, http.StatusForbidden, errForbidden.Error())
+		return false
+	}
+	return true
+}
+
+// authenticate checks the request against the configured credentials. A
+// request is accepted if it comes with a verified client certificate (mTLS),
+// a valid HMAC signature (when hmacSecret is set) or the static X-Auth-Token
+// (when authToken is set). With nothing configured every request is accepted.
+func (a *Agent) authenticate(r *http.Request) error {
+	if _, ok := clientCertName(r.TLS); ok {
+		return nil
+	}
+	if a.cfg.AuthToken == "" && a.cfg.HMACSecret == "" {
+		return nil
+	}
+	if a.cfg.HMACSecret != "" && r.Header.Get(headerSignature) != "" {
+		return a.verifySignature(r)
+	}
+	if a.cfg.AuthToken != "" {
+		got := r.Header.Get(headerAuthToken)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(a.cfg.AuthToken)) == 1 {
+			return nil
+		}
+	}
+	return errUnauthorized
+}
+
+// callerIdentity names the credential an authenticated request used, for the
+// audit log.
+func (a *Agent) callerIdentity(r *http.Request) string {
+	if cn, ok := clientCertName(r.TLS); ok {
+		return "cert:" + cn
+	}
+	if a.cfg.HMACSecret != "" && r.Header.Get(headerSignature) != "" {
+		return "hmac"
+	}
+	if a.cfg.AuthToken != "" && r.Header.Get(headerAuthToken) != "" {
+		return "token"
+	}
+	return "anonymous"
+}
+
+// permitted applies tlsClientPermissions to requests authenticated by a
+// client certificate. Other requests are not restricted per endpoint, and an
+// empty permission only requires authentication.
+func (a *Agent) permitted(r *http.Request, permission string) bool {
+	cn, ok := clientCertName(r.TLS)
+	if !ok || permission == "" || len(a.cfg.TLSClientPermissions) == 0 {
+		return true
+	}
+	for _, p := range a.cfg.TLSClientPermissions[cn] {
+		if p == permissionAll || p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature validates X-Timestamp, X-Nonce and X-Signature headers. The
+// signature is hex(HMAC-SHA256(secret, method\npath\ntimestamp\nnonce\nbody)),
+// where path includes the query string. The body is buffered and restored so
+// handlers can still decode it; bodies over maxSignedBody are rejected rather
+// than verified in part.
+func (a *Agent) verifySignature(r *http.Request) error {
+	tsRaw := r.Header.Get(headerTimestamp)
+	nonce := r.Header.Get(headerNonce)
+	if tsRaw == "" || nonce == "" {
+		return errUnauthorized
+	}
+	ts, err := strconv.ParseInt(tsRaw, 10, 64)
+	if err != nil {
+		return errUnauthorized
+	}
+	skew := time.Duration(a.cfg.HMACMaxSkew) * time.Second
+	issued := time.Unix(ts, 0)
+	if d := time.Since(issued); d > skew || d < -skew {
+		return errStaleTimestamp
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			return errUnauthorized
+		}
+		if len(body) > maxSignedBody {
+			return errBodyTooLarge
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := signRequest(a.cfg.HMACSecret, r.Method, signedPath(r.URL), tsRaw, nonce, body)
+	got, err := hex.DecodeString(r.Header.Get(headerSignature))
+	if err != nil || !hmac.Equal(got, expected) {
+		return errInvalidSignature
+	}
+	if !a.nonces.Add(nonce, issued.Add(skew)) {
+		return errReplayedNonce
+	}
+	return nil
+}
+
+// signedPath is the path a signature covers: the URL path and, when present,
+// the query string.
+func signedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+func signRequest(secret, method, path, timestamp, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, timestamp, nonce)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// nonceCache remembers nonces until their timestamps fall outside the allowed
+// skew window, after which the timestamp check rejects replays on its own.
+type nonceCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	lastGC  time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{entries: make(map[string]time.Time)}
+}
+
+// Add records nonce until expires and reports false if it was already seen.
+func (c *nonceCache) Add(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastGC) > time.Minute {
+		for k, exp := range c.entries {
+			if now.After(exp) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastGC = now
+	}
+	if exp, ok := c.entries[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.entries[nonce] = expires
+	return true
+}
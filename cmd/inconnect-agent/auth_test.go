@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHMACSecret = "secret"
+
+func newSigningAgent() *Agent {
+	return &Agent{
+		cfg:    Config{HMACSecret: testHMACSecret, HMACMaxSkew: 300},
+		nonces: newNonceCache(),
+	}
+}
+
+// signedRequest builds a request signed with secret over the given path
+// (which may differ from target to simulate tampering) and body.
+func signedRequest(secret, method, target, signedTarget, body string, ts time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	tsRaw := strconv.FormatInt(ts.Unix(), 10)
+	r.Header.Set(headerTimestamp, tsRaw)
+	r.Header.Set(headerNonce, nonce)
+	r.Header.Set(headerSignature, hex.EncodeToString(signRequest(secret, method, signedTarget, tsRaw, nonce, []byte(body))))
+	return r
+}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    error
+	}{
+		{
+			name: "valid",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodPost, "/adduser", "/adduser", `{"user_id":"u1"}`, now, "n1")
+			},
+		},
+		{
+			name: "valid with query",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodGet, "/v1/slots?status=used", "/v1/slots?status=used", "", now, "n1")
+			},
+		},
+		{
+			name: "within skew",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now.Add(-299*time.Second), "n1")
+			},
+		},
+		{
+			name: "missing timestamp",
+			request: func() *http.Request {
+				r := signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1")
+				r.Header.Del(headerTimestamp)
+				return r
+			},
+			want: errUnauthorized,
+		},
+		{
+			name: "missing nonce",
+			request: func() *http.Request {
+				r := signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1")
+				r.Header.Del(headerNonce)
+				return r
+			},
+			want: errUnauthorized,
+		},
+		{
+			name: "malformed timestamp",
+			request: func() *http.Request {
+				r := signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1")
+				r.Header.Set(headerTimestamp, "yesterday")
+				return r
+			},
+			want: errUnauthorized,
+		},
+		{
+			name: "stale timestamp",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now.Add(-301*time.Second), "n1")
+			},
+			want: errStaleTimestamp,
+		},
+		{
+			name: "future timestamp",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now.Add(301*time.Second), "n1")
+			},
+			want: errStaleTimestamp,
+		},
+		{
+			name: "wrong secret",
+			request: func() *http.Request {
+				return signedRequest("other", http.MethodGet, "/stats", "/stats", "", now, "n1")
+			},
+			want: errInvalidSignature,
+		},
+		{
+			name: "unsigned query",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodGet, "/v1/slots?status=used", "/v1/slots", "", now, "n1")
+			},
+			want: errInvalidSignature,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest(testHMACSecret, http.MethodPost, "/adduser", "/adduser", `{"user_id":"u1"}`, now, "n1")
+				r.Body = io.NopCloser(strings.NewReader(`{"user_id":"u2"}`))
+				return r
+			},
+			want: errInvalidSignature,
+		},
+		{
+			name: "tampered method",
+			request: func() *http.Request {
+				r := signedRequest(testHMACSecret, http.MethodPost, "/reset", "/reset", "", now, "n1")
+				r.Method = http.MethodGet
+				return r
+			},
+			want: errInvalidSignature,
+		},
+		{
+			name: "signature not hex",
+			request: func() *http.Request {
+				r := signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1")
+				r.Header.Set(headerSignature, "zz")
+				return r
+			},
+			want: errInvalidSignature,
+		},
+		{
+			name: "body too large",
+			request: func() *http.Request {
+				return signedRequest(testHMACSecret, http.MethodPost, "/adduser", "/adduser", strings.Repeat("x", maxSignedBody+1), now, "n1")
+			},
+			want: errBodyTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSigningAgent()
+			if err := a.verifySignature(tt.request()); !errors.Is(err, tt.want) {
+				t.Fatalf("verifySignature() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRestoresBody(t *testing.T) {
+	a := newSigningAgent()
+	body := `{"user_id":"u1"}`
+	r := signedRequest(testHMACSecret, http.MethodPost, "/adduser", "/adduser", body, time.Now(), "n1")
+	if err := a.verifySignature(r); err != nil {
+		t.Fatalf("verifySignature() = %v", err)
+	}
+	got, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Fatalf("body after verification = %q, want %q", got, body)
+	}
+}
+
+func TestVerifySignatureNonceReplay(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		first  *http.Request
+		second *http.Request
+		want   error
+	}{
+		{
+			name:   "same request replayed",
+			first:  signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1"),
+			second: signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1"),
+			want:   errReplayedNonce,
+		},
+		{
+			name:   "nonce reused for another request",
+			first:  signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1"),
+			second: signedRequest(testHMACSecret, http.MethodPost, "/reload", "/reload", "", now.Add(-time.Second), "n1"),
+			want:   errReplayedNonce,
+		},
+		{
+			name:   "fresh nonce",
+			first:  signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1"),
+			second: signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n2"),
+		},
+		{
+			name:   "rejected signature does not use up the nonce",
+			first:  signedRequest("other", http.MethodGet, "/stats", "/stats", "", now, "n1"),
+			second: signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1"),
+		},
+		{
+			name:   "stale request does not use up the nonce",
+			first:  signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now.Add(-time.Hour), "n1"),
+			second: signedRequest(testHMACSecret, http.MethodGet, "/stats", "/stats", "", now, "n1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSigningAgent()
+			_ = a.verifySignature(tt.first)
+			if err := a.verifySignature(tt.second); !errors.Is(err, tt.want) {
+				t.Fatalf("second verifySignature() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonceCacheAdd(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		seen  map[string]time.Time
+		nonce string
+		want  bool
+	}{
+		{name: "new nonce", nonce: "n1", want: true},
+		{name: "seen nonce", seen: map[string]time.Time{"n1": now.Add(time.Minute)}, nonce: "n1"},
+		{name: "other nonce seen", seen: map[string]time.Time{"n2": now.Add(time.Minute)}, nonce: "n1", want: true},
+		{name: "seen nonce expired", seen: map[string]time.Time{"n1": now.Add(-time.Second)}, nonce: "n1", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newNonceCache()
+			c.lastGC = now // keep the seeded entries through the sweep
+			for nonce, exp := range tt.seen {
+				c.entries[nonce] = exp
+			}
+			if got := c.Add(tt.nonce, now.Add(time.Minute)); got != tt.want {
+				t.Fatalf("Add(%q) = %v, want %v", tt.nonce, got, tt.want)
+			}
+		})
+	}
+}
+
+// withClientCert marks r as coming over mTLS with a verified certificate
+// issued to cn.
+func withClientCert(r *http.Request, cn string) *http.Request {
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}},
+	}
+	return r
+}
+
+func TestPermitted(t *testing.T) {
+	perms := map[string][]string{
+		"billing": {"adduser", "deleteuser"},
+		"ops":     {permissionAll},
+		"nobody":  {},
+	}
+	tests := []struct {
+		name       string
+		cn         string
+		perms      map[string][]string
+		permission string
+		want       bool
+	}{
+		{name: "no certificate", permission: "reset", perms: perms, want: true},
+		{name: "no permissions configured", cn: "billing", permission: "reset", want: true},
+		{name: "granted", cn: "billing", permission: "adduser", perms: perms, want: true},
+		{name: "not granted", cn: "billing", permission: "reset", perms: perms},
+		{name: "wildcard", cn: "ops", permission: "reset", perms: perms, want: true},
+		{name: "empty grant", cn: "nobody", permission: "stats", perms: perms},
+		{name: "unknown certificate", cn: "stranger", permission: "stats", perms: perms},
+		{name: "authentication only", cn: "stranger", perms: perms, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{cfg: Config{TLSClientPermissions: tt.perms}}
+			r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			if tt.cn != "" {
+				r = withClientCert(r, tt.cn)
+			}
+			if got := a.permitted(r, tt.permission); got != tt.want {
+				t.Fatalf("permitted(%q) = %v, want %v", tt.permission, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRoutePermissions sends each endpoint a request from a certificate
+// granted every permission except the one the endpoint requires, so a route
+// mapped to the wrong permission would get past the check.
+func TestRoutePermissions(t *testing.T) {
+	tests := []struct {
+		method     string
+		target     string
+		body       string
+		permission string
+	}{
+		{http.MethodPost, "/adduser", "", "adduser"},
+		{http.MethodPost, "/deleteuser", "", "deleteuser"},
+		{http.MethodPost, "/reload", "", "reload"},
+		{http.MethodPost, "/restart", "", "restart"},
+		{http.MethodPost, "/reset", "", "reset"},
+		{http.MethodPost, "/backup", "", "backup"},
+		{http.MethodGet, "/stats", "", "stats"},
+		{http.MethodGet, "/audit", "", "audit"},
+		{http.MethodGet, "/events", "", "stats"},
+		{http.MethodGet, "/metrics", "", "stats"},
+		{http.MethodGet, "/v1/slots", "", "stats"},
+		{http.MethodPost, "/v1/slots", "", "adduser"},
+		{http.MethodGet, "/v1/slots/1", "", "stats"},
+		{http.MethodGet, "/v1/slots/1?include=connection", "", "adduser"},
+		{http.MethodDelete, "/v1/slots/1", "", "deleteuser"},
+		{http.MethodGet, "/v1/slots/1/history", "", "audit"},
+		{http.MethodGet, "/v1/assignments", "", "audit"},
+		{http.MethodGet, "/v1/shards", "", "stats"},
+		{http.MethodGet, "/v1/shards/1", "", "stats"},
+		{http.MethodGet, "/v1/jobs", "", "stats"},
+		{http.MethodGet, "/v1/jobs/1", "", "stats"},
+		{http.MethodPost, "/v1/jobs", `{"type":"reload"}`, "reload"},
+		{http.MethodPost, "/v1/jobs", `{"type":"restart"}`, "restart"},
+		{http.MethodPost, "/v1/jobs", `{"type":"reset"}`, "reset"},
+		{http.MethodPost, "/v1/jobs", `{"type":"rotate"}`, "rotate"},
+		{http.MethodGet, "/v1/sync", "", "stats"},
+		{http.MethodPost, "/v1/sync", "", "sync"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target+" "+tt.body, func(t *testing.T) {
+			var granted []string
+			for p := range apiPermissions {
+				if p != tt.permission {
+					granted = append(granted, p)
+				}
+			}
+			a := &Agent{cfg: Config{TLSClientPermissions: map[string][]string{"client": granted}}}
+			r := withClientCert(httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)), "client")
+			w := httptest.NewRecorder()
+			a.Router().ServeHTTP(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d without %q", w.Code, http.StatusForbidden, tt.permission)
+			}
+		})
+	}
+}
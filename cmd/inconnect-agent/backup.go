@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix     = "ports-"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// BackupInfo describes a backup file.
+type BackupInfo struct {
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (c Config) backupDir() string {
+	if c.BackupDir != "" {
+		return c.BackupDir
+	}
+	return filepath.Join(filepath.Dir(c.DBPath), "backups")
+}
+
+// Backup writes a consistent copy of the database to the backup directory
+// and records it in the audit log.
+func (a *Agent) Backup(ctx context.Context, caller Caller, reason string) (BackupInfo, error) {
+	info, err := a.backup(ctx, reason)
+	entry := caller.audit("backup")
+	entry.Detail = filepath.Base(info.File)
+	entry.Result = auditResult(err)
+	a.audit.Record(context.Background(), entry)
+	return info, err
+}
+
+// backup runs VACUUM INTO, which reads the database in a single transaction
+// and so is safe while the agent keeps serving requests. The copy is written
+// under a temporary name and renamed, so a backup file is always complete.
+// Old backups beyond BackupKeep are removed afterwards. A PostgreSQL
+// database is not backed up by the agent.
+func (a *Agent) backup(ctx context.Context, reason string) (BackupInfo, error) {
+	if !a.store.db.isSQLite() {
+		return BackupInfo{}, errBackupUnsupported
+	}
+	dir := a.cfg.backupDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return BackupInfo{}, fmt.Errorf("create backup dir: %w", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	name := backupPrefix + now.Format(backupTimeFormat)
+	if reason != "" {
+		name += "-" + reason
+	}
+	path := filepath.Join(dir, name+".db")
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	if _, err := a.store.db.ExecContext(ctx, `VACUUM INTO ?`, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return BackupInfo{}, fmt.Errorf("vacuum into %s: %w", tmp, err)
+	}
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		_ = os.Remove(tmp)
+		return BackupInfo{}, fmt.Errorf("chmod backup: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return BackupInfo{}, fmt.Errorf("rename backup: %w", err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("stat backup: %w", err)
+	}
+	log.Printf("database backed up to %s (%d bytes)", path, st.Size())
+	if err := pruneBackups(dir, a.cfg.BackupKeep); err != nil {
+		log.Printf("prune backups: %v", err)
+	}
+	return BackupInfo{File: path, Size: st.Size(), CreatedAt: now}, nil
+}
+
+// listBackups returns the backups in dir, newest first.
+func listBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || filepath.Ext(name) != ".db" {
+			continue
+		}
+		stamp, _, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), ".db"), "-")
+		created, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		st, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{File: filepath.Join(dir, name), Size: st.Size(), CreatedAt: created})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].CreatedAt.Equal(backups[j].CreatedAt) {
+			return backups[i].CreatedAt.After(backups[j].CreatedAt)
+		}
+		return backups[i].File > backups[j].File
+	})
+	return backups, nil
+}
+
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(b.File); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartBackups takes a backup every interval.
+func (a *Agent) StartBackups(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.schedulerTriggered("backup", nil)
+				if _, err := a.Backup(ctx, Caller{Identity: actorScheduler}, ""); err != nil {
+					log.Printf("scheduled backup failed: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (a *Agent) handleBackup(w http.ResponseWriter, r *http.Request) {
+	info, err := a.Backup(r.Context(), a.callerFromRequest(r), "")
+	if errors.Is(err, errBackupUnsupported) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("backup failed: %v", err)
+		writeError(w, http.StatusInternalServerError, "backup_failed")
+		return
+	}
+	backups, _ := listBackups(a.cfg.backupDir())
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":  "ok",
+		"backup":  info,
+		"backups": backups,
+	})
+}
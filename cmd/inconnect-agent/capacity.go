@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// checkCapacity publishes capacity.low once when the free slots of the pool
+// or of a shard drop to the configured threshold, and re-arms after they
+// recover.
+func (a *Agent) checkCapacity(statsByShard map[int]SlotCounts, totals SlotCounts) {
+	a.capacityMu.Lock()
+	defer a.capacityMu.Unlock()
+
+	if threshold := a.cfg.LowCapacityThreshold; threshold > 0 {
+		a.updateCapacityLocked(0, totals.Free, threshold)
+	}
+	if threshold := a.cfg.ShardLowCapacity; threshold > 0 {
+		for _, shard := range a.allShards() {
+			a.updateCapacityLocked(shard.ID, statsByShard[shard.ID].Free, threshold)
+		}
+	}
+}
+
+func (a *Agent) updateCapacityLocked(shardID, free, threshold int) {
+	low := free <= threshold
+	if a.lowCapacity[shardID] == low {
+		return
+	}
+	a.lowCapacity[shardID] = low
+	if !low {
+		return
+	}
+	if shardID == 0 {
+		log.Printf("free slots down to %d (threshold %d)", free, threshold)
+	} else {
+		log.Printf("free slots in shard %d down to %d (threshold %d)", shardID, free, threshold)
+	}
+	a.events.Publish(Event{
+		Type:    eventCapacityLow,
+		ShardID: shardID,
+		Detail:  fmt.Sprintf("free=%d threshold=%d", free, threshold),
+	})
+}
+
+// capacityLow reports whether shardID (0 for the pool) is at or below its
+// low watermark.
+func (a *Agent) capacityLow(shardID int) bool {
+	a.capacityMu.Lock()
+	defer a.capacityMu.Unlock()
+	return a.lowCapacity[shardID]
+}
+
+// expandPool adds a copy of the last shard with the next ID, the next free
+// port by ShardPortStep, the same slot count and a fresh server PSK, then
+// brings up its container. It reports true when free slots are available
+// afterwards.
+func (a *Agent) expandPool(ctx context.Context, caller Caller) (bool, error) {
+	a.opLock.Lock()
+	defer a.opLock.Unlock()
+
+	_, totals, err := a.store.SlotStats(ctx)
+	if err != nil {
+		return false, err
+	}
+	if totals.Free > 0 {
+		// another request expanded the pool or a reload freed slots meanwhile
+		return true, nil
+	}
+	current := a.allShards()
+	if len(current) >= a.cfg.MaxShards {
+		log.Printf("pool exhausted and max-shards (%d) reached", a.cfg.MaxShards)
+		return false, nil
+	}
+
+	last := current[len(current)-1]
+	id := 1
+	for _, sh := range current {
+		if sh.ID >= id {
+			id = sh.ID + 1
+		}
+	}
+	next := a.cfg.expandedShard(last, id, 0, last.SlotCount)
+	if shardConflict(current, next) {
+		return false, fmt.Errorf("api port %d of shard %d is already in use", next.APIPort, next.ID)
+	}
+	next.Port = last.Port + a.cfg.ShardPortStep
+	for shardConflict(current, next) || next.Port == next.APIPort {
+		next.Port += a.cfg.ShardPortStep
+	}
+	if next.Port > 65535 {
+		return false, fmt.Errorf("no free port for shard %d", next.ID)
+	}
+
+	entry := caller.audit("expand")
+	entry.Shards = []int{next.ID}
+	entry.Detail = fmt.Sprintf("port=%d slots=%d", next.Port, next.SlotCount)
+
+	shards := append(append([]ShardDefinition(nil), current...), next)
+	if err := a.store.AddShard(ctx, shards); err != nil {
+		entry.Result = auditResult(err)
+		a.audit.Record(context.Background(), entry)
+		return false, err
+	}
+	a.shardSet.Store(newShardSet(shards))
+	a.expansions.Add(1)
+	log.Printf("pool exhausted, added shard %d on port %d with %d slots", next.ID, next.Port, next.SlotCount)
+
+	_, err = a.reloadWithLock(ctx, false, []int{next.ID}, false)
+	entry.Result = auditResult(err)
+	a.audit.Record(context.Background(), entry)
+	a.events.Publish(Event{Type: eventShardAdded, ShardID: next.ID, Detail: entry.Detail})
+	if err != nil {
+		return false, fmt.Errorf("start shard %d: %w", next.ID, err)
+	}
+	return true, nil
+}
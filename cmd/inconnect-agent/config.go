@@ -4,38 +4,75 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
 
 // Config captures all runtime configuration for the agent.
 type Config struct {
-	DBPath                  string   `yaml:"dbPath"`
-	MinPort                 int      `yaml:"minPort"`
-	MaxPort                 int      `yaml:"maxPort"`
-	ConfigDir               string   `yaml:"configDir"`
-	ConfigFile              string   `yaml:"configFile"`
-	GeneratedFile           string   `yaml:"generatedFile"`
-	ListenAddr              string   `yaml:"listen"`
-	PublicIP                string   `yaml:"publicIP"`
-	AuthToken               string   `yaml:"authToken"`
-	ContainerName           string   `yaml:"containerName"`
-	DockerImage             string   `yaml:"dockerImage"`
-	DockerBinary            string   `yaml:"dockerBinary"`
-	Method                  string   `yaml:"method"`
-	APIPort                 int      `yaml:"apiPort"`
-	ShardCount              int      `yaml:"shardCount"`
-	ShardSize               int      `yaml:"shardSize"`
-	ShardPortStep           int      `yaml:"shardPortStep"`
-	ShardRaw                string   `yaml:"shards"`
-	ShardPrefix             string   `yaml:"shardPrefix"`
-	RestartSeconds          int      `yaml:"restartInterval"`
-	RestartReservedPerShard int      `yaml:"restartWhenReserved"`
-	RestartAtUTC            []string `yaml:"restartAt"`
-	AllocStrategy           string   `yaml:"allocationStrategy"`
-	ResetOnly               bool     `yaml:"reset"`
+	DBPath                  string                    `yaml:"dbPath"`
+	DatabaseURL             string                    `yaml:"databaseURL"`
+	SharedReloadSeconds     int                       `yaml:"sharedReloadInterval"`
+	MinPort                 int                       `yaml:"minPort"`
+	MaxPort                 int                       `yaml:"maxPort"`
+	ConfigDir               string                    `yaml:"configDir"`
+	ConfigFile              string                    `yaml:"configFile"`
+	GeneratedFile           string                    `yaml:"generatedFile"`
+	ListenAddr              string                    `yaml:"listen"`
+	GRPCListen              string                    `yaml:"grpcListen"`
+	PublicIP                string                    `yaml:"publicIP"`
+	AuthToken               string                    `yaml:"authToken"`
+	HMACSecret              string                    `yaml:"hmacSecret"`
+	HMACMaxSkew             int                       `yaml:"hmacMaxSkew"`
+	TLSCert                 string                    `yaml:"tlsCert"`
+	TLSKey                  string                    `yaml:"tlsKey"`
+	TLSSelfSigned           bool                      `yaml:"tlsSelfSigned"`
+	TLSClientCA             string                    `yaml:"tlsClientCA"`
+	TLSClientPermissions    map[string][]string       `yaml:"tlsClientPermissions"`
+	AuditFile               string                    `yaml:"auditFile"`
+	RateLimits              map[string]EndpointLimits `yaml:"rateLimits"`
+	MaxPendingJobs          int                       `yaml:"maxPendingJobs"`
+	Webhooks                []WebhookConfig           `yaml:"webhooks"`
+	LowCapacityThreshold    int                       `yaml:"lowCapacityThreshold"`
+	ShardLowCapacity        int                       `yaml:"shardLowCapacityThreshold"`
+	AutoExpand              bool                      `yaml:"autoExpand"`
+	MaxShards               int                       `yaml:"maxShards"`
+	ClientEmailTemplate     string                    `yaml:"clientEmailTemplate"`
+	BackupDir               string                    `yaml:"backupDir"`
+	BackupIntervalHours     int                       `yaml:"backupInterval"`
+	BackupKeep              int                       `yaml:"backupKeep"`
+	SecretKeyFile           string                    `yaml:"secretKeyFile"`
+	ControlPlaneURL         string                    `yaml:"controlPlaneURL"`
+	ControlPlaneToken       string                    `yaml:"controlPlaneToken"`
+	NodeID                  string                    `yaml:"nodeId"`
+	NodeRegion              string                    `yaml:"region"`
+	NodeLabels              map[string]string         `yaml:"labels"`
+	HeartbeatSeconds        int                       `yaml:"heartbeatInterval"`
+	SyncSource              string                    `yaml:"syncSource"`
+	SyncToken               string                    `yaml:"syncToken"`
+	SyncSeconds             int                       `yaml:"syncInterval"`
+	SyncMaxRemovals         int                       `yaml:"syncMaxRemovals"`
+	SyncDryRun              bool                      `yaml:"syncDryRun"`
+	ContainerName           string                    `yaml:"containerName"`
+	DockerImage             string                    `yaml:"dockerImage"`
+	DockerBinary            string                    `yaml:"dockerBinary"`
+	Method                  string                    `yaml:"method"`
+	XrayOverlay             string                    `yaml:"xrayOverlay"`
+	Egress                  []EgressConfig            `yaml:"egress"`
+	APIPort                 int                       `yaml:"apiPort"`
+	ShardCount              int                       `yaml:"shardCount"`
+	ShardSize               int                       `yaml:"shardSize"`
+	ShardPortStep           int                       `yaml:"shardPortStep"`
+	Shards                  shardSpecs                `yaml:"shards"`
+	ShardPrefix             string                    `yaml:"shardPrefix"`
+	RestartSeconds          int                       `yaml:"restartInterval"`
+	RestartReservedPerShard int                       `yaml:"restartWhenReserved"`
+	ReservedCooldownHours   int                       `yaml:"reservedCooldownHours"`
+	RestartAtUTC            []string                  `yaml:"restartAt"`
+	AllocStrategy           string                    `yaml:"allocationStrategy"`
+	ResetOnly               bool                      `yaml:"reset"`
 }
 
 func defaultConfig() Config {
@@ -49,6 +86,14 @@ func defaultConfig() Config {
 		ListenAddr:              "127.0.0.1:8080",
 		PublicIP:                "",
 		AuthToken:               "",
+		HMACSecret:              "",
+		HMACMaxSkew:             300,
+		AuditFile:               "",
+		MaxPendingJobs:          4,
+		BackupKeep:              14,
+		HeartbeatSeconds:        30,
+		SyncSeconds:             300,
+		SharedReloadSeconds:     10,
 		ContainerName:           "xray-ss2022",
 		DockerImage:             "teddysun/xray:latest",
 		DockerBinary:            "docker",
@@ -68,26 +113,58 @@ func defaultConfig() Config {
 
 func (c *Config) registerFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.DBPath, "db-path", c.DBPath, "Path to SQLite database file")
+	fs.StringVar(&c.DatabaseURL, "database-url", c.DatabaseURL, "PostgreSQL URL (postgres://...) shared by several agents; replaces db-path (default: $"+databaseURLEnv+")")
+	fs.IntVar(&c.SharedReloadSeconds, "shared-reload-interval", c.SharedReloadSeconds, "Seconds between checks for shards another agent of a shared database changed")
 	fs.IntVar(&c.MinPort, "min-port", c.MinPort, "First managed port (inclusive)")
 	fs.IntVar(&c.MaxPort, "max-port", c.MaxPort, "Last managed port (inclusive)")
 	fs.StringVar(&c.ConfigDir, "config-dir", c.ConfigDir, "Directory that stores Xray configs")
 	fs.StringVar(&c.ConfigFile, "config-file", c.ConfigFile, "Final Xray config filename")
 	fs.StringVar(&c.GeneratedFile, "generated-file", c.GeneratedFile, "Temporary config filename before swap")
 	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "HTTP listen address")
+	fs.StringVar(&c.GRPCListen, "grpc-listen", c.GRPCListen, "gRPC listen address (empty disables gRPC)")
 	fs.StringVar(&c.PublicIP, "public-ip", c.PublicIP, "Public IP exposed in /adduser responses")
 	fs.StringVar(&c.AuthToken, "auth-token", c.AuthToken, "Optional X-Auth-Token required for requests")
+	fs.StringVar(&c.HMACSecret, "hmac-secret", c.HMACSecret, "Shared secret for HMAC-signed requests (X-Timestamp/X-Nonce/X-Signature)")
+	fs.IntVar(&c.HMACMaxSkew, "hmac-max-skew", c.HMACMaxSkew, "Allowed clock skew in seconds for signed requests")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate for the HTTP API (PEM)")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key for the HTTP API (PEM)")
+	fs.BoolVar(&c.TLSSelfSigned, "tls-self-signed", c.TLSSelfSigned, "Generate a self-signed certificate if tls-cert/tls-key do not exist")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "CA bundle for verifying client certificates (enables mTLS)")
+	fs.StringVar(&c.AuditFile, "audit-file", c.AuditFile, "Optional JSONL file that mirrors the audit log")
+	fs.IntVar(&c.MaxPendingJobs, "max-pending-jobs", c.MaxPendingJobs, "Maximum queued async reload/restart/reset jobs (0 = unlimited)")
+	fs.IntVar(&c.LowCapacityThreshold, "low-capacity-threshold", c.LowCapacityThreshold, "Emit capacity.low when free slots drop to this number (0 = disabled)")
+	fs.IntVar(&c.ShardLowCapacity, "shard-low-capacity-threshold", c.ShardLowCapacity, "Emit capacity.low when free slots of a shard drop to this number (0 = disabled)")
+	fs.BoolVar(&c.AutoExpand, "auto-expand", c.AutoExpand, "Add a shard when no free slots are left")
+	fs.IntVar(&c.MaxShards, "max-shards", c.MaxShards, "Maximum number of shards auto-expansion may reach")
+	fs.StringVar(&c.ClientEmailTemplate, "client-email-template", c.ClientEmailTemplate, "Go template for the Xray client email of used slots (.SlotID, .ShardID, .UserID, .Meta \"key\")")
+	fs.StringVar(&c.BackupDir, "backup-dir", c.BackupDir, "Directory for database backups (default: backups next to the database)")
+	fs.IntVar(&c.BackupIntervalHours, "backup-interval", c.BackupIntervalHours, "Hours between automatic backups (0 disables)")
+	fs.IntVar(&c.BackupKeep, "backup-keep", c.BackupKeep, "Number of backups to keep (0 keeps all)")
+	fs.StringVar(&c.SecretKeyFile, "secret-key-file", c.SecretKeyFile, "File with keys encrypting stored passwords and PSKs (default: $"+secretKeyEnv+")")
+	fs.StringVar(&c.ControlPlaneURL, "control-plane-url", c.ControlPlaneURL, "Control plane the agent registers with and sends heartbeats to")
+	fs.StringVar(&c.ControlPlaneToken, "control-plane-token", c.ControlPlaneToken, "X-Auth-Token sent to the control plane")
+	fs.StringVar(&c.NodeID, "node-id", c.NodeID, "Node ID reported to the control plane (default: hostname)")
+	fs.StringVar(&c.NodeRegion, "region", c.NodeRegion, "Region reported to the control plane")
+	fs.IntVar(&c.HeartbeatSeconds, "heartbeat-interval", c.HeartbeatSeconds, "Seconds between heartbeats to the control plane")
+	fs.StringVar(&c.SyncSource, "sync-source", c.SyncSource, "URL or file with the desired users to reconcile the slots against")
+	fs.StringVar(&c.SyncToken, "sync-token", c.SyncToken, "Bearer token sent to an http(s) sync-source")
+	fs.IntVar(&c.SyncSeconds, "sync-interval", c.SyncSeconds, "Seconds between syncs")
+	fs.IntVar(&c.SyncMaxRemovals, "sync-max-removals", c.SyncMaxRemovals, "Release nothing when a sync would release more slots than this (0 = no limit)")
+	fs.BoolVar(&c.SyncDryRun, "sync-dry-run", c.SyncDryRun, "Only report drift from the desired state, change nothing")
 	fs.StringVar(&c.ContainerName, "container-name", c.ContainerName, "Docker container name (legacy single-shard)")
 	fs.StringVar(&c.DockerImage, "docker-image", c.DockerImage, "Docker image to use for Xray runs")
 	fs.StringVar(&c.DockerBinary, "docker-binary", c.DockerBinary, "Docker binary path")
-	fs.StringVar(&c.Method, "method", c.Method, "Shadowsocks 2022 cipher method")
+	fs.StringVar(&c.Method, "method", c.Method, "Shadowsocks 2022 cipher method (2022-blake3-aes-128-gcm, 2022-blake3-aes-256-gcm or 2022-blake3-chacha20-poly1305)")
+	fs.StringVar(&c.XrayOverlay, "xray-overlay", c.XrayOverlay, "JSON file deep-merged into every generated Xray config")
 	fs.IntVar(&c.APIPort, "api-port", c.APIPort, "Xray API inbound port")
 	fs.IntVar(&c.ShardCount, "shard-count", c.ShardCount, "Number of Xray shards (containers)")
 	fs.IntVar(&c.ShardSize, "shard-size", c.ShardSize, "Slots per shard (defaults to total slot count)")
 	fs.IntVar(&c.ShardPortStep, "shard-port-step", c.ShardPortStep, "Port increment between shards")
-	fs.StringVar(&c.ShardRaw, "shards", c.ShardRaw, "Custom shard definitions port:slots,... (overrides shard-count)")
+	fs.Var(&c.Shards, "shards", "Custom shard definitions port:slots[;method=..;network=tcp|udp|both;listen=IP;image=..;egress=name],... (overrides shard-count)")
 	fs.StringVar(&c.ShardPrefix, "shard-prefix", c.ShardPrefix, "Prefix for shard container names")
 	fs.IntVar(&c.RestartSeconds, "restart-interval", c.RestartSeconds, "Automatic restart interval in seconds (0 disables)")
 	fs.IntVar(&c.RestartReservedPerShard, "restart-when-reserved", c.RestartReservedPerShard, "Trigger restart for a shard once reserved slots reach this number (0 disables)")
+	fs.IntVar(&c.ReservedCooldownHours, "reserved-cooldown-hours", c.ReservedCooldownHours, "Hours a released slot stays unallocatable after /deleteuser (0 disables)")
 	fs.Func("restart-at", "Comma-separated UTC times (HH:MM) for full restarts", func(v string) error {
 		if strings.TrimSpace(v) == "" {
 			c.RestartAtUTC = nil
@@ -117,6 +194,17 @@ func (c Config) validate() error {
 	if !validAlloc[c.AllocStrategy] {
 		return fmt.Errorf("invalid allocation-strategy %q", c.AllocStrategy)
 	}
+	if !validMethod(c.Method) {
+		return fmt.Errorf("unsupported method %q", c.Method)
+	}
+	if c.XrayOverlay != "" {
+		if _, err := loadOverlay(c.XrayOverlay); err != nil {
+			return fmt.Errorf("xray-overlay: %w", err)
+		}
+	}
+	if err := c.validateEgress(); err != nil {
+		return err
+	}
 	if c.MinPort <= 0 || c.MaxPort <= 0 {
 		return errors.New("ports must be positive")
 	}
@@ -126,6 +214,96 @@ func (c Config) validate() error {
 	if c.ListenAddr == "" {
 		return errors.New("listen address is required")
 	}
+	if c.HMACSecret != "" && c.HMACMaxSkew <= 0 {
+		return errors.New("hmac-max-skew must be positive")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if c.GRPCListen != "" && c.HMACSecret != "" && c.AuthToken == "" && !c.tlsEnabled() {
+		return errors.New("grpc-listen with hmac-secret requires TLS: plaintext gRPC does not accept HMAC signatures")
+	}
+	if c.TLSClientCA != "" && !c.tlsEnabled() {
+		return errors.New("tls-client-ca requires tls-cert/tls-key or tls-self-signed")
+	}
+	for cn, perms := range c.TLSClientPermissions {
+		for _, p := range perms {
+			if p != permissionAll && !apiPermissions[p] {
+				return fmt.Errorf("unknown permission %q for client %q", p, cn)
+			}
+		}
+	}
+	for endpoint, limits := range c.RateLimits {
+		if !apiPermissions[endpoint] {
+			return fmt.Errorf("rate limit for unknown endpoint %q", endpoint)
+		}
+		if err := limits.PerToken.validate(); err != nil {
+			return fmt.Errorf("rate limit %s perToken: %w", endpoint, err)
+		}
+		if err := limits.PerIP.validate(); err != nil {
+			return fmt.Errorf("rate limit %s perIP: %w", endpoint, err)
+		}
+	}
+	if c.MaxPendingJobs < 0 {
+		return errors.New("max-pending-jobs must not be negative")
+	}
+	for i, hook := range c.Webhooks {
+		if err := hook.validate(); err != nil {
+			return fmt.Errorf("webhook %d: %w", i+1, err)
+		}
+	}
+	if c.LowCapacityThreshold < 0 || c.ShardLowCapacity < 0 {
+		return errors.New("low capacity thresholds must not be negative")
+	}
+	if c.ReservedCooldownHours < 0 {
+		return errors.New("reserved-cooldown-hours must not be negative")
+	}
+	if c.BackupIntervalHours < 0 || c.BackupKeep < 0 {
+		return errors.New("backup-interval and backup-keep must not be negative")
+	}
+	if url := c.databaseURL(); url != "" {
+		if !strings.HasPrefix(url, "postgres://") && !strings.HasPrefix(url, "postgresql://") {
+			return errors.New("database-url must be a postgres:// URL")
+		}
+		if c.BackupIntervalHours > 0 {
+			return errors.New("backup-interval needs the SQLite database; back up PostgreSQL with pg_dump")
+		}
+		if c.SharedReloadSeconds <= 0 {
+			return errors.New("shared-reload-interval must be positive")
+		}
+	}
+	if c.ControlPlaneURL != "" {
+		u, err := url.Parse(c.ControlPlaneURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid control-plane-url %q", c.ControlPlaneURL)
+		}
+		// the heartbeat replies carry reset and restart commands, which must
+		// not be open to whoever sits on the path to the controller
+		if u.Scheme != "https" {
+			return fmt.Errorf("control-plane-url %q must use https", c.ControlPlaneURL)
+		}
+		if !validNodeID(c.NodeID) {
+			return fmt.Errorf("invalid node-id %q", c.NodeID)
+		}
+		if c.HeartbeatSeconds <= 0 {
+			return errors.New("heartbeat-interval must be positive")
+		}
+	}
+	if c.SyncSource != "" && c.SyncSeconds <= 0 {
+		return errors.New("sync-interval must be positive")
+	}
+	if c.SyncMaxRemovals < 0 {
+		return errors.New("sync-max-removals must not be negative")
+	}
+	if c.AutoExpand && c.MaxShards <= 0 {
+		return errors.New("auto-expand requires max-shards")
+	}
+	if c.AutoExpand && c.ShardPortStep <= 0 {
+		return errors.New("auto-expand requires a positive shard-port-step")
+	}
+	if _, err := parseEmailTemplate(c.ClientEmailTemplate); err != nil {
+		return fmt.Errorf("invalid client-email-template: %w", err)
+	}
 	if c.ConfigDir == "" {
 		return errors.New("config directory is required")
 	}
@@ -143,6 +321,20 @@ func (c Config) validate() error {
 	return nil
 }
 
+func (c Config) tlsEnabled() bool {
+	return c.TLSSelfSigned || c.TLSCert != ""
+}
+
+// tlsPaths returns the certificate and key paths, defaulting to files next to
+// the database when a self-signed certificate is requested without paths.
+func (c Config) tlsPaths() (string, string) {
+	if c.TLSCert != "" {
+		return c.TLSCert, c.TLSKey
+	}
+	dir := filepath.Dir(c.DBPath)
+	return filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key")
+}
+
 func (c Config) portCount() int {
 	return c.MaxPort - c.MinPort + 1
 }
@@ -161,6 +353,29 @@ type ShardDefinition struct {
 	SlotCount     int
 	ContainerName string
 	APIPort       int
+	// Protocol is the inbound protocol; Method, the Shadowsocks method, is
+	// empty for the others. Network is the transports the inbound accepts
+	// (networkTCP, networkUDP or networkBoth), always TCP except for
+	// Shadowsocks.
+	Protocol string
+	Method   string
+	Network  string
+	// ServerName is the REALITY server name of VLESS and Trojan shards and
+	// Dest where unauthenticated connections go, by default port 443 of
+	// ServerName.
+	ServerName string
+	Dest       string
+	// Listen is the host address the shard's port is published on, empty
+	// for all addresses.
+	Listen string
+	// Image replaces the agent's Docker image for this shard when set.
+	Image string
+	// Overlay is a JSON file merged into the shard's config after the
+	// agent's XrayOverlay.
+	Overlay string
+	// Egress names the EgressConfig the shard's traffic leaves through,
+	// empty for direct.
+	Egress string
 }
 
 func (c Config) shardConfigPath(shardID int) string {
@@ -198,48 +413,63 @@ func (c Config) defaultShardCount() int {
 	return 1
 }
 
-func (c Config) shardsFromRaw() ([]ShardDefinition, error) {
-	if strings.TrimSpace(c.ShardRaw) == "" {
+// newShard returns a shard with the agent-wide settings.
+func (c Config) newShard(id, port, slots int) ShardDefinition {
+	return ShardDefinition{
+		ID:            id,
+		Port:          port,
+		SlotCount:     slots,
+		ContainerName: c.shardContainer(id),
+		APIPort:       c.shardAPIPortFor(id),
+		Protocol:      protocolShadowsocks,
+		Method:        c.Method,
+		Network:       networkBoth,
+	}
+}
+
+// expandedShard returns a shard added by auto-expansion: a copy of model,
+// with its protocol, method, network, listen address, image, overlay and
+// egress, under its own ID, port, slot count, container and API port.
+func (c Config) expandedShard(model ShardDefinition, id, port, slots int) ShardDefinition {
+	sh := model
+	sh.ID, sh.Port, sh.SlotCount = id, port, slots
+	sh.ContainerName = c.shardContainer(id)
+	sh.APIPort = c.shardAPIPortFor(id)
+	return sh
+}
+
+func (c Config) shardsFromSpecs() ([]ShardDefinition, error) {
+	if len(c.Shards) == 0 {
 		return nil, nil
 	}
-	parts := strings.Split(c.ShardRaw, ",")
-	var defs []ShardDefinition
-	for idx, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" {
-			continue
-		}
-		sub := strings.Split(part, ":")
-		if len(sub) != 2 {
-			return nil, fmt.Errorf("invalid shard format %q, expected port:slots", part)
+	defs := make([]ShardDefinition, 0, len(c.Shards))
+	for idx, spec := range c.Shards {
+		if err := spec.validate(); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", idx+1, err)
 		}
-		port, err := strconv.Atoi(sub[0])
-		if err != nil {
-			return nil, fmt.Errorf("invalid shard port %q: %w", sub[0], err)
+		def := c.newShard(idx+1, spec.Port, spec.Slots)
+		if spec.Protocol != "" && spec.Protocol != protocolShadowsocks {
+			def.Protocol, def.Method, def.Network = spec.Protocol, "", networkTCP
 		}
-		slots, err := strconv.Atoi(sub[1])
-		if err != nil {
-			return nil, fmt.Errorf("invalid shard slot count %q: %w", sub[1], err)
+		if spec.Method != "" {
+			def.Method = spec.Method
 		}
-		if slots <= 0 {
-			return nil, fmt.Errorf("shard slots must be positive for %q", part)
+		if spec.Network != "" {
+			def.Network = spec.Network
 		}
-		defs = append(defs, ShardDefinition{
-			ID:            idx + 1,
-			Port:          port,
-			SlotCount:     slots,
-			ContainerName: c.shardContainer(idx + 1),
-			APIPort:       c.shardAPIPortFor(idx + 1),
-		})
-	}
-	if len(defs) == 0 {
-		return nil, errors.New("no valid shard definitions provided")
+		def.ServerName = spec.ServerName
+		def.Dest = spec.Dest
+		def.Listen = spec.Listen
+		def.Image = spec.Image
+		def.Overlay = spec.Overlay
+		def.Egress = spec.Egress
+		defs = append(defs, def)
 	}
 	return defs, nil
 }
 
 func (c Config) BuildShards() ([]ShardDefinition, error) {
-	if defs, err := c.shardsFromRaw(); err != nil {
+	if defs, err := c.shardsFromSpecs(); err != nil {
 		return nil, err
 	} else if defs != nil {
 		return defs, nil
@@ -253,13 +483,7 @@ func (c Config) BuildShards() ([]ShardDefinition, error) {
 	for i := 0; i < count; i++ {
 		id := i + 1
 		port := c.MinPort + i*c.ShardPortStep
-		defs = append(defs, ShardDefinition{
-			ID:            id,
-			Port:          port,
-			SlotCount:     size,
-			ContainerName: c.shardContainer(id),
-			APIPort:       c.shardAPIPortFor(id),
-		})
+		defs = append(defs, c.newShard(id, port, size))
 	}
 	return defs, nil
 }
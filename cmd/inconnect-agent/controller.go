@@ -0,0 +1,1294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	nodeRequestTimeout = 10 * time.Second
+	maxNodeResponse    = 1 << 20
+	// maxNodeCommands is how many commands per node stay visible. The oldest
+	// finished one makes room for a new command; when none has finished,
+	// new commands are refused.
+	maxNodeCommands = 50
+
+	commandPending   = "pending"
+	commandDelivered = "delivered"
+)
+
+var (
+	errUnknownNode       = errors.New("unknown_node")
+	errNoNodes           = errors.New("no_nodes_available")
+	errNodeUnavailable   = errors.New("node_unavailable")
+	errInvalidNode       = errors.New("invalid_node")
+	errStaticNode        = errors.New("node_configured")
+	errNodeResponseLarge = errors.New("node response too large")
+	errNodeNotReporting  = errors.New("node_not_reporting")
+	errTooManyCommands   = errors.New("too_many_commands")
+	errUnknownUser       = errors.New("unknown_user")
+)
+
+// ControllerConfig configures "inconnect-agent controller", which spreads
+// allocations over a fleet of agents.
+type ControllerConfig struct {
+	Listen    string `yaml:"listen"`
+	AuthToken string `yaml:"authToken"`
+	// AgentToken is expected from agents registering themselves; AuthToken
+	// is used when it is empty.
+	AgentToken string `yaml:"agentToken"`
+	// StateFile keeps the nodes registered through the API across restarts.
+	StateFile string `yaml:"stateFile"`
+	// OwnersFile keeps which node holds the slots of each user, so releases
+	// need only the user ID.
+	OwnersFile  string `yaml:"ownersFile"`
+	PollSeconds int    `yaml:"pollInterval"`
+	// UnhealthyAfter is the number of failed polls after which a node gets
+	// no new users.
+	UnhealthyAfter int          `yaml:"unhealthyAfter"`
+	Nodes          []NodeConfig `yaml:"nodes"`
+}
+
+// NodeConfig is an agent managed by the controller. URL is the agent's HTTP
+// API, called with AuthToken or signed with HMACSecret like any client.
+type NodeConfig struct {
+	ID         string            `yaml:"id" json:"id"`
+	URL        string            `yaml:"url" json:"url"`
+	AuthToken  string            `yaml:"authToken" json:"authToken,omitempty"`
+	HMACSecret string            `yaml:"hmacSecret" json:"hmacSecret,omitempty"`
+	Region     string            `yaml:"region" json:"region,omitempty"`
+	Labels     map[string]string `yaml:"labels" json:"labels,omitempty"`
+}
+
+func (n NodeConfig) validate() error {
+	if !validNodeID(n.ID) {
+		return fmt.Errorf("%w: invalid id %q", errInvalidNode, n.ID)
+	}
+	u, err := url.Parse(n.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: invalid url %q", errInvalidNode, n.URL)
+	}
+	return nil
+}
+
+func validNodeID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/ ")
+}
+
+// matches reports whether the node is in region and carries all labels;
+// empty criteria match every node.
+func (n NodeConfig) matches(region string, labels map[string]string) bool {
+	if region != "" && n.Region != region {
+		return false
+	}
+	for k, v := range labels {
+		if n.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func defaultControllerConfig() ControllerConfig {
+	return ControllerConfig{
+		Listen:         "127.0.0.1:8090",
+		StateFile:      "/var/lib/inconnect-agent/controller-nodes.json",
+		OwnersFile:     "/var/lib/inconnect-agent/controller-owners.json",
+		PollSeconds:    10,
+		UnhealthyAfter: 3,
+	}
+}
+
+func (c *ControllerConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Controller HTTP listen address")
+	fs.StringVar(&c.AuthToken, "auth-token", c.AuthToken, "X-Auth-Token required for controller requests")
+	fs.StringVar(&c.AgentToken, "agent-token", c.AgentToken, "X-Auth-Token required from self-registering agents (default: auth-token)")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "File keeping nodes registered through the API")
+	fs.StringVar(&c.OwnersFile, "owners-file", c.OwnersFile, "File keeping the node and slots of each user allocated through the controller")
+	fs.IntVar(&c.PollSeconds, "poll-interval", c.PollSeconds, "Seconds between node health and stats polls")
+	fs.IntVar(&c.UnhealthyAfter, "unhealthy-after", c.UnhealthyAfter, "Failed polls after which a node is marked unhealthy")
+}
+
+func (c ControllerConfig) validate() error {
+	if c.PollSeconds <= 0 {
+		return errors.New("poll-interval must be positive")
+	}
+	if c.UnhealthyAfter <= 0 {
+		return errors.New("unhealthy-after must be positive")
+	}
+	seen := make(map[string]bool)
+	for _, n := range c.Nodes {
+		if err := n.validate(); err != nil {
+			return err
+		}
+		if seen[n.ID] {
+			return fmt.Errorf("duplicate node id %q", n.ID)
+		}
+		seen[n.ID] = true
+	}
+	return nil
+}
+
+// nodeStats is the body of an agent's GET /stats.
+type nodeStats struct {
+	Shards []ShardStatus `json:"shards"`
+	Totals SlotCounts    `json:"totals"`
+}
+
+// NodeStatus is what the controller knows about a node.
+type NodeStatus struct {
+	NodeConfig
+	// Static nodes come from the config file and cannot be removed through
+	// the API.
+	Static bool `json:"static"`
+	// SelfRegistered nodes were added by their own heartbeat. The controller
+	// cannot reach them, so they are not polled and get no allocations;
+	// their health and stats come from the heartbeats.
+	SelfRegistered bool       `json:"selfRegistered,omitempty"`
+	Healthy        bool       `json:"healthy"`
+	Failures       int        `json:"failures"`
+	LastSeen       *time.Time `json:"lastSeen,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	Stats          *nodeStats `json:"stats,omitempty"`
+	// Agent is set once the node has sent a heartbeat.
+	Agent *AgentInfo `json:"agent,omitempty"`
+
+	commands []*NodeCommand
+}
+
+// AgentInfo is what a node reported about itself in its last heartbeat.
+type AgentInfo struct {
+	PublicIP         string    `json:"publicIP,omitempty"`
+	Version          string    `json:"version"`
+	HeartbeatSeconds int       `json:"heartbeatInterval"`
+	Healthy          bool      `json:"healthy"`
+	Problems         []string  `json:"problems,omitempty"`
+	RegisteredAt     time.Time `json:"registeredAt"`
+	LastHeartbeat    time.Time `json:"lastHeartbeat"`
+}
+
+// NodeCommand is a job queued for a node and handed to it in a heartbeat
+// response. Its status is pending until delivered and then follows the
+// agent's job.
+type NodeCommand struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	Shards      []int      `json:"shards,omitempty"`
+	Status      string     `json:"status"`
+	JobID       string     `json:"jobId,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (c *NodeCommand) finished() bool {
+	return c.Status == jobSucceeded || c.Status == jobFailed
+}
+
+// Controller keeps a registry of agents, polls their /stats for health and
+// capacity, and forwards allocations to them.
+type Controller struct {
+	cfg    ControllerConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	nodes map[string]*NodeStatus
+	// owners lists the slots allocated through the controller by user ID.
+	owners map[string][]OwnedSlot
+}
+
+// OwnedSlot is a slot a user holds on a node.
+type OwnedSlot struct {
+	NodeID string `json:"nodeId"`
+	SlotID int    `json:"slotId"`
+}
+
+func NewController(cfg ControllerConfig) *Controller {
+	c := &Controller{
+		cfg:    cfg,
+		client: &http.Client{Timeout: nodeRequestTimeout},
+		nodes:  make(map[string]*NodeStatus),
+		owners: make(map[string][]OwnedSlot),
+	}
+	for _, n := range cfg.Nodes {
+		c.nodes[n.ID] = &NodeStatus{NodeConfig: n, Static: true}
+	}
+	return c
+}
+
+// loadState adds the nodes registered before the last restart.
+func (c *Controller) loadState() error {
+	if c.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var nodes []NodeConfig
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return fmt.Errorf("parse %s: %w", c.cfg.StateFile, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range nodes {
+		if _, ok := c.nodes[n.ID]; ok {
+			continue
+		}
+		c.nodes[n.ID] = &NodeStatus{NodeConfig: n}
+	}
+	return nil
+}
+
+// loadOwners reads the slot ownership saved before the last restart.
+func (c *Controller) loadOwners() error {
+	if c.cfg.OwnersFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.cfg.OwnersFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := json.Unmarshal(data, &c.owners); err != nil {
+		return fmt.Errorf("parse %s: %w", c.cfg.OwnersFile, err)
+	}
+	if c.owners == nil {
+		c.owners = make(map[string][]OwnedSlot)
+	}
+	return nil
+}
+
+// saveOwners writes the slot ownership; the caller holds c.mu.
+func (c *Controller) saveOwners() {
+	if c.cfg.OwnersFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(c.owners, "", "  ")
+	if err == nil {
+		err = ensureParentDir(c.cfg.OwnersFile)
+	}
+	tmp := c.cfg.OwnersFile + ".tmp"
+	if err == nil {
+		err = os.WriteFile(tmp, data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.cfg.OwnersFile)
+	}
+	if err != nil {
+		log.Printf("save slot owners: %v", err)
+	}
+}
+
+// recordOwner remembers that userID holds slotID on nodeID. A record of
+// another user for the slot is dropped: the slot was released on the node
+// directly and has been allocated again.
+func (c *Controller) recordOwner(userID, nodeID string, slotID int) {
+	if userID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forgetOwnedLocked(nodeID, []int{slotID})
+	c.owners[userID] = append(c.owners[userID], OwnedSlot{NodeID: nodeID, SlotID: slotID})
+	c.saveOwners()
+}
+
+// forgetOwned drops released slots from the ownership records.
+func (c *Controller) forgetOwned(nodeID string, slotIDs []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forgetOwnedLocked(nodeID, slotIDs)
+	c.saveOwners()
+}
+
+func (c *Controller) forgetOwnedLocked(nodeID string, slotIDs []int) {
+	released := make(map[int]bool, len(slotIDs))
+	for _, id := range slotIDs {
+		released[id] = true
+	}
+	for user, slots := range c.owners {
+		kept := slots[:0]
+		for _, s := range slots {
+			if s.NodeID != nodeID || !released[s.SlotID] {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.owners, user)
+		} else {
+			c.owners[user] = kept
+		}
+	}
+}
+
+// ownedSlots returns the slots of userID grouped by node, in node order.
+func (c *Controller) ownedSlots(userID string) ([]string, map[string][]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	byNode := make(map[string][]int)
+	var nodes []string
+	for _, s := range c.owners[userID] {
+		if _, ok := byNode[s.NodeID]; !ok {
+			nodes = append(nodes, s.NodeID)
+		}
+		byNode[s.NodeID] = append(byNode[s.NodeID], s.SlotID)
+	}
+	sort.Strings(nodes)
+	return nodes, byNode
+}
+
+// slotOwner returns the only node on which all of slotIDs are recorded as
+// allocated, or "" when there is none or more than one.
+func (c *Controller) slotOwner(slotIDs []int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	held := make(map[string]map[int]bool)
+	for _, slots := range c.owners {
+		for _, s := range slots {
+			if held[s.NodeID] == nil {
+				held[s.NodeID] = make(map[int]bool)
+			}
+			held[s.NodeID][s.SlotID] = true
+		}
+	}
+	owner := ""
+	for nodeID, ids := range held {
+		all := true
+		for _, id := range slotIDs {
+			if !ids[id] {
+				all = false
+				break
+			}
+		}
+		if !all {
+			continue
+		}
+		if owner != "" {
+			return ""
+		}
+		owner = nodeID
+	}
+	return owner
+}
+
+// saveState writes the registered nodes; the caller holds c.mu. The file
+// holds node credentials, so it is only readable by the owner.
+func (c *Controller) saveState() error {
+	if c.cfg.StateFile == "" {
+		return nil
+	}
+	nodes := []NodeConfig{}
+	for _, n := range c.sortedNodes() {
+		if !n.Static && !n.SelfRegistered {
+			nodes = append(nodes, n.NodeConfig)
+		}
+	}
+	data, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureParentDir(c.cfg.StateFile); err != nil {
+		return err
+	}
+	tmp := c.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.cfg.StateFile)
+}
+
+// sortedNodes returns the nodes ordered by ID; the caller holds c.mu.
+func (c *Controller) sortedNodes() []*NodeStatus {
+	nodes := make([]*NodeStatus, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Register adds a node or updates a registered one and polls it right away.
+// A node that registered itself keeps its heartbeat state and commands.
+func (c *Controller) Register(ctx context.Context, n NodeConfig) error {
+	if err := n.validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	node := &NodeStatus{NodeConfig: n}
+	if existing, ok := c.nodes[n.ID]; ok {
+		if existing.Static {
+			c.mu.Unlock()
+			return errStaticNode
+		}
+		node.Agent, node.commands = existing.Agent, existing.commands
+	}
+	c.nodes[n.ID] = node
+	err := c.saveState()
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("save controller state: %w", err)
+	}
+	log.Printf("node %s registered at %s", n.ID, n.URL)
+	c.poll(ctx, n)
+	return nil
+}
+
+// Remove forgets a node registered through the API.
+func (c *Controller) Remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return errUnknownNode
+	}
+	if n.Static {
+		return errStaticNode
+	}
+	delete(c.nodes, id)
+	if err := c.saveState(); err != nil {
+		return fmt.Errorf("save controller state: %w", err)
+	}
+	log.Printf("node %s removed", id)
+	return nil
+}
+
+// Nodes returns copies of all node states ordered by ID.
+func (c *Controller) Nodes() []NodeStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]NodeStatus, 0, len(c.nodes))
+	for _, n := range c.sortedNodes() {
+		out = append(out, *n)
+	}
+	return out
+}
+
+func (c *Controller) node(id string) (NodeConfig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return NodeConfig{}, false
+	}
+	return n.NodeConfig, true
+}
+
+// StartPolling polls every node each PollSeconds, starting immediately.
+func (c *Controller) StartPolling(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.cfg.PollSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			c.pollAll(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (c *Controller) pollAll(ctx context.Context) {
+	c.mu.Lock()
+	nodes := make([]NodeConfig, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.SelfRegistered {
+			c.checkHeartbeat(n)
+			continue
+		}
+		nodes = append(nodes, n.NodeConfig)
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n NodeConfig) {
+			defer wg.Done()
+			c.poll(ctx, n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// poll fetches the node's /stats. A node becomes healthy on the first
+// successful poll and unhealthy after UnhealthyAfter failures in a row.
+func (c *Controller) poll(ctx context.Context, n NodeConfig) {
+	var stats nodeStats
+	status, body, err := c.call(ctx, n, http.MethodGet, "/stats", nil)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("stats returned %d: %s", status, nodeErrorCode(body))
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &stats)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node, ok := c.nodes[n.ID]
+	if !ok || node.URL != n.URL {
+		return // removed or re-registered meanwhile
+	}
+	if err != nil {
+		node.Failures++
+		node.LastError = err.Error()
+		if node.Healthy && node.Failures >= c.cfg.UnhealthyAfter {
+			node.Healthy = false
+			log.Printf("node %s unhealthy: %v", n.ID, err)
+		}
+		return
+	}
+	now := time.Now().UTC()
+	if !node.Healthy {
+		log.Printf("node %s healthy: %d free slots", n.ID, stats.Totals.Free)
+	}
+	node.Healthy = true
+	node.Failures = 0
+	node.LastError = ""
+	node.LastSeen = &now
+	node.Stats = &stats
+}
+
+// call sends a request to a node's API and returns the status and body.
+func (c *Controller) call(ctx context.Context, n NodeConfig, method, path string, payload any) (int, []byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(n.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if n.HMACSecret != "" {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, nil, err
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(headerTimestamp, ts)
+		req.Header.Set(headerNonce, hex.EncodeToString(nonce))
+		req.Header.Set(headerSignature, hex.EncodeToString(signRequest(n.HMACSecret, method, signedPath(req.URL), ts, hex.EncodeToString(nonce), body)))
+	} else if n.AuthToken != "" {
+		req.Header.Set(headerAuthToken, n.AuthToken)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxNodeResponse+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) > maxNodeResponse {
+		return 0, nil, errNodeResponseLarge
+	}
+	return resp.StatusCode, data, nil
+}
+
+// nodeErrorCode extracts the error code from an agent error response.
+func nodeErrorCode(body []byte) string {
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		return e.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// candidates returns the healthy nodes matching region and labels that
+// have free slots, most free slots first.
+func (c *Controller) candidates(region string, labels map[string]string) []NodeConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var nodes []*NodeStatus
+	for _, n := range c.sortedNodes() {
+		if n.Healthy && !n.SelfRegistered && n.Stats != nil && n.Stats.Totals.Free > 0 && n.matches(region, labels) {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Stats.Totals.Free > nodes[j].Stats.Totals.Free })
+	out := make([]NodeConfig, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.NodeConfig
+	}
+	return out
+}
+
+// setFree records the free slot count a node reported after an allocation,
+// so the next choice does not wait for a poll.
+func (c *Controller) setFree(id string, free int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.nodes[id]; ok && n.Stats != nil {
+		n.Stats.Totals.Free = free
+	}
+}
+
+// nodeReply is an agent response passed back to the caller.
+type nodeReply struct {
+	Status int
+	Body   map[string]any
+}
+
+// AddUser allocates a slot on the matching node with the most free slots and
+// records the node as the owner of the slot. A node that is full, or that
+// could not be connected to, is skipped in favour of the next one. Any other
+// failure may come after the node allocated, so it is returned rather than
+// retried elsewhere, which would give the user a second slot.
+func (c *Controller) AddUser(ctx context.Context, userID string, metadata map[string]any, clientKey, region string, labels map[string]string) (string, nodeReply, error) {
+	payload := map[string]any{"user_id": userID}
+	if len(metadata) > 0 {
+		payload["metadata"] = metadata
+	}
+	if clientKey != "" {
+		payload["client_key"] = clientKey
+	}
+	nodes := c.candidates(region, labels)
+	if len(nodes) == 0 {
+		return "", nodeReply{}, errNoNodes
+	}
+	for _, n := range nodes {
+		status, body, err := c.call(ctx, n, http.MethodPost, "/adduser", payload)
+		if err != nil && notConnected(err) {
+			log.Printf("adduser on node %s failed: %v", n.ID, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("adduser on node %s failed, the outcome is unknown: %v", n.ID, err)
+			return n.ID, nodeReply{}, errNodeUnavailable
+		}
+		var reply map[string]any
+		if err := json.Unmarshal(body, &reply); err != nil {
+			log.Printf("adduser on node %s: invalid response, the outcome is unknown: %v", n.ID, err)
+			return n.ID, nodeReply{}, errNodeUnavailable
+		}
+		if status == http.StatusConflict && reply["error"] == errNoFreePorts.Error() {
+			c.setFree(n.ID, 0)
+			continue
+		}
+		if status == http.StatusOK {
+			if free, ok := reply["freeSlots"].(float64); ok {
+				c.setFree(n.ID, int(free))
+			}
+			if slotID, ok := reply["slotId"].(float64); ok {
+				c.recordOwner(userID, n.ID, int(slotID))
+			}
+			reply["nodeId"] = n.ID
+		}
+		return n.ID, nodeReply{Status: status, Body: reply}, nil
+	}
+	return "", nodeReply{}, errNoFreePorts
+}
+
+// notConnected reports whether a request failed before reaching the node,
+// which only a failed dial proves.
+func notConnected(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// DeleteUserByID releases every slot the controller allocated to userID,
+// node by node. The reply of the first node that does not release is
+// returned as is.
+func (c *Controller) DeleteUserByID(ctx context.Context, userID string) (nodeReply, error) {
+	nodes, byNode := c.ownedSlots(userID)
+	if len(nodes) == 0 {
+		return nodeReply{}, errUnknownUser
+	}
+	var released []OwnedSlot
+	for _, nodeID := range nodes {
+		reply, err := c.DeleteUser(ctx, nodeID, 0, byNode[nodeID])
+		if err != nil || reply.Status != http.StatusOK {
+			return reply, err
+		}
+		for _, id := range byNode[nodeID] {
+			released = append(released, OwnedSlot{NodeID: nodeID, SlotID: id})
+		}
+	}
+	return nodeReply{Status: http.StatusOK, Body: map[string]any{"status": "ok", "released": released}}, nil
+}
+
+// DeleteUser forwards a release to the node that owns the slots.
+func (c *Controller) DeleteUser(ctx context.Context, nodeID string, slotID int, slotIDs []int) (nodeReply, error) {
+	n, ok := c.node(nodeID)
+	if !ok {
+		return nodeReply{}, errUnknownNode
+	}
+	if n.URL == "" {
+		return nodeReply{}, errNodeUnavailable
+	}
+	payload := map[string]any{}
+	if len(slotIDs) > 0 {
+		payload["slotIds"] = slotIDs
+	} else {
+		payload["slotId"] = slotID
+	}
+	status, body, err := c.call(ctx, n, http.MethodPost, "/deleteuser", payload)
+	if err != nil {
+		log.Printf("deleteuser on node %s failed: %v", n.ID, err)
+		return nodeReply{}, errNodeUnavailable
+	}
+	var reply map[string]any
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return nodeReply{}, errNodeUnavailable
+	}
+	if status == http.StatusOK {
+		if len(slotIDs) == 0 {
+			slotIDs = []int{slotID}
+		}
+		c.forgetOwned(nodeID, slotIDs)
+	}
+	return nodeReply{Status: status, Body: reply}, nil
+}
+
+// FleetStats sums the last polled stats of the healthy nodes.
+func (c *Controller) FleetStats() (SlotCounts, []NodeStatus) {
+	var totals SlotCounts
+	nodes := c.Nodes()
+	for _, n := range nodes {
+		if !n.Healthy || n.Stats == nil {
+			continue
+		}
+		totals.Free += n.Stats.Totals.Free
+		totals.Used += n.Stats.Totals.Used
+		totals.Reserved += n.Stats.Totals.Reserved
+		totals.Cooldown += n.Stats.Totals.Cooldown
+	}
+	return totals, nodes
+}
+
+// checkHeartbeat marks a self-registered node unhealthy once it has missed
+// UnhealthyAfter heartbeats; the caller holds c.mu.
+func (c *Controller) checkHeartbeat(n *NodeStatus) {
+	if !n.Healthy || n.Agent == nil {
+		return
+	}
+	timeout := time.Duration(c.cfg.UnhealthyAfter*n.Agent.HeartbeatSeconds) * time.Second
+	if time.Since(n.Agent.LastHeartbeat) <= timeout {
+		return
+	}
+	n.Healthy = false
+	n.LastError = fmt.Sprintf("no heartbeat since %s", n.Agent.LastHeartbeat.Format(time.RFC3339))
+	log.Printf("node %s unhealthy: %s", n.ID, n.LastError)
+}
+
+// Heartbeat records a report sent by an agent and returns the commands to
+// hand to it. A registration adds an unknown node as self-registered; a
+// heartbeat from an unknown node fails with errUnknownNode so that the agent
+// registers again, for example after the controller restarted.
+//
+// The report of a node the controller also polls only updates its agent
+// information, as health and stats come from the polls.
+func (c *Controller) Heartbeat(report AgentReport, register bool) ([]AgentCommand, error) {
+	if !validNodeID(report.NodeID) {
+		return nil, fmt.Errorf("%w: invalid id %q", errInvalidNode, report.NodeID)
+	}
+	now := time.Now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[report.NodeID]
+	if !ok {
+		if !register {
+			return nil, errUnknownNode
+		}
+		n = &NodeStatus{NodeConfig: NodeConfig{ID: report.NodeID}, SelfRegistered: true}
+		c.nodes[n.ID] = n
+		log.Printf("node %s registered itself from %s", n.ID, report.PublicIP)
+	}
+	if n.Agent == nil || register {
+		n.Agent = &AgentInfo{RegisteredAt: now}
+	}
+	n.Agent.PublicIP = report.PublicIP
+	n.Agent.Version = report.Version
+	n.Agent.HeartbeatSeconds = report.HeartbeatSeconds
+	n.Agent.Healthy = report.Healthy
+	n.Agent.Problems = report.Problems
+	n.Agent.LastHeartbeat = now
+
+	if n.SelfRegistered {
+		n.Region, n.Labels = report.Region, report.Labels
+		n.Stats = &nodeStats{Shards: report.Shards, Totals: report.Totals}
+		n.LastSeen = &now
+		n.Failures = 0
+		n.LastError = strings.Join(report.Problems, "; ")
+		if n.Healthy != report.Healthy {
+			if report.Healthy {
+				log.Printf("node %s healthy: %d free slots", n.ID, report.Totals.Free)
+			} else {
+				log.Printf("node %s unhealthy: %s", n.ID, n.LastError)
+			}
+		}
+		n.Healthy = report.Healthy
+	}
+
+	reported := make(map[string]bool, len(report.Results))
+	for _, r := range report.Results {
+		reported[r.ID] = true
+		for _, cmd := range n.commands {
+			if cmd.ID != r.ID || cmd.finished() {
+				continue
+			}
+			cmd.Status, cmd.JobID, cmd.Error = r.Status, r.JobID, r.Error
+			if cmd.finished() {
+				cmd.FinishedAt = &now
+			}
+		}
+	}
+
+	var out []AgentCommand
+	for _, cmd := range n.commands {
+		switch {
+		case cmd.finished():
+			continue
+		case register && cmd.Status != commandPending:
+			// the agent restarted and lost the jobs it was given
+			cmd.Status, cmd.Error, cmd.FinishedAt = jobFailed, "agent_restarted", &now
+			continue
+		case cmd.Status == commandDelivered && !reported[cmd.ID]:
+			// the previous response did not reach the agent
+		case cmd.Status != commandPending:
+			continue
+		}
+		cmd.Status, cmd.DeliveredAt = commandDelivered, &now
+		out = append(out, AgentCommand{ID: cmd.ID, Type: cmd.Type, Shards: cmd.Shards})
+	}
+	return out, nil
+}
+
+// QueueCommand queues a reload, restart, reset or rotate for the node's next
+// heartbeat. Only nodes that send heartbeats can receive commands.
+func (c *Controller) QueueCommand(id, cmdType string, shards []int) (NodeCommand, error) {
+	switch cmdType {
+	case jobReload, jobRestart, jobReset, jobRotate:
+	default:
+		return NodeCommand{}, errUnknownJob
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return NodeCommand{}, errUnknownNode
+	}
+	if n.Agent == nil {
+		return NodeCommand{}, errNodeNotReporting
+	}
+	if len(n.commands) >= maxNodeCommands {
+		drop := -1
+		for i, old := range n.commands {
+			if old.finished() {
+				drop = i
+				break
+			}
+		}
+		if drop < 0 {
+			return NodeCommand{}, errTooManyCommands
+		}
+		n.commands = append(n.commands[:drop], n.commands[drop+1:]...)
+	}
+	cmd := &NodeCommand{
+		ID:        newJobID(),
+		Type:      cmdType,
+		Shards:    shards,
+		Status:    commandPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	n.commands = append(n.commands, cmd)
+	log.Printf("node %s: %s queued as command %s", id, cmdType, cmd.ID)
+	return *cmd, nil
+}
+
+// Commands returns copies of the node's commands, oldest first.
+func (c *Controller) Commands(id string) ([]NodeCommand, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return nil, errUnknownNode
+	}
+	out := make([]NodeCommand, 0, len(n.commands))
+	for _, cmd := range n.commands {
+		out = append(out, *cmd)
+	}
+	return out, nil
+}
+
+func (c *Controller) Router() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/adduser", c.authorized(http.MethodPost, c.handleAddUser))
+	mux.HandleFunc("/deleteuser", c.authorized(http.MethodPost, c.handleDeleteUser))
+	mux.HandleFunc("/stats", c.authorized(http.MethodGet, c.handleStats))
+	mux.HandleFunc("/nodes", c.authorized("", c.handleNodes))
+	mux.HandleFunc("/nodes/", c.authorized("", c.handleNode))
+	mux.HandleFunc("/agents/register", c.agentAuthorized(c.handleAgentReport(true)))
+	mux.HandleFunc("/agents/heartbeat", c.agentAuthorized(c.handleAgentReport(false)))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return mux
+}
+
+// authorized checks the method (any when empty) and the controller token.
+func (c *Controller) authorized(method string, handler httpHandler) httpHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if method != "" && r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+			return
+		}
+		if c.cfg.AuthToken != "" &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(headerAuthToken)), []byte(c.cfg.AuthToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errUnauthorized.Error())
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// agentAuthorized checks that an agent report is a POST carrying the agent
+// token, or the controller token when no agent token is set.
+func (c *Controller) agentAuthorized(handler httpHandler) httpHandler {
+	token := c.cfg.AgentToken
+	if token == "" {
+		token = c.cfg.AuthToken
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(headerAuthToken)), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errUnauthorized.Error())
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (c *Controller) handleAgentReport(register bool) httpHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report AgentReport
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxNodeResponse)).Decode(&report); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json")
+			return
+		}
+		commands, err := c.Heartbeat(report, register)
+		switch {
+		case errors.Is(err, errInvalidNode):
+			writeError(w, http.StatusBadRequest, errInvalidNode.Error())
+		case errors.Is(err, errUnknownNode):
+			writeError(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "internal_error")
+		default:
+			if commands == nil {
+				commands = []AgentCommand{}
+			}
+			writeJSON(w, http.StatusOK, heartbeatResponse{Commands: commands})
+		}
+	}
+}
+
+func (c *Controller) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID    string            `json:"user_id"`
+		Metadata  map[string]any    `json:"metadata"`
+		ClientKey string            `json:"client_key"`
+		Region    string            `json:"region"`
+		Labels    map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	_, reply, err := c.AddUser(r.Context(), req.UserID, req.Metadata, req.ClientKey, req.Region, req.Labels)
+	switch {
+	case errors.Is(err, errNoNodes):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, errNoFreePorts):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errNodeUnavailable):
+		writeError(w, http.StatusBadGateway, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "internal_error")
+	default:
+		writeJSON(w, reply.Status, reply.Body)
+	}
+}
+
+func (c *Controller) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID  string `json:"user_id"`
+		NodeID  string `json:"nodeId"`
+		SlotID  int    `json:"slotId"`
+		SlotIDs []int  `json:"slotIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json")
+		return
+	}
+	var (
+		reply nodeReply
+		err   error
+	)
+	switch {
+	case req.UserID != "":
+		reply, err = c.DeleteUserByID(r.Context(), req.UserID)
+	case req.SlotID == 0 && len(req.SlotIDs) == 0:
+		writeError(w, http.StatusBadRequest, "slot_required")
+		return
+	default:
+		nodeID := req.NodeID
+		if nodeID == "" {
+			ids := req.SlotIDs
+			if len(ids) == 0 {
+				ids = []int{req.SlotID}
+			}
+			if nodeID = c.slotOwner(ids); nodeID == "" {
+				writeError(w, http.StatusBadRequest, "node_required")
+				return
+			}
+		}
+		reply, err = c.DeleteUser(r.Context(), nodeID, req.SlotID, req.SlotIDs)
+	}
+	switch {
+	case errors.Is(err, errUnknownNode), errors.Is(err, errUnknownUser):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeJSON(w, reply.Status, reply.Body)
+	}
+}
+
+func (c *Controller) handleStats(w http.ResponseWriter, r *http.Request) {
+	totals, nodes := c.FleetStats()
+	healthy := 0
+	for _, n := range nodes {
+		if n.Healthy {
+			healthy++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"totals":       totals,
+		"nodes":        publicNodes(nodes),
+		"healthyNodes": healthy,
+	})
+}
+
+func (c *Controller) handleNodes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"nodes": publicNodes(c.Nodes())})
+	case http.MethodPost:
+		var n NodeConfig
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json")
+			return
+		}
+		err := c.Register(r.Context(), n)
+		switch {
+		case errors.Is(err, errInvalidNode):
+			writeError(w, http.StatusBadRequest, errInvalidNode.Error())
+		case errors.Is(err, errStaticNode):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "internal_error")
+		default:
+			n, _ := c.nodeStatus(n.ID)
+			writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "node": publicNode(n)})
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+	}
+}
+
+func (c *Controller) handleNode(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/nodes/"), "/")
+	if sub == "commands" {
+		c.handleNodeCommands(w, r, id)
+		return
+	}
+	if sub != "" {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	err := c.Remove(id)
+	switch {
+	case errors.Is(err, errUnknownNode):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errStaticNode):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "internal_error")
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+func (c *Controller) handleNodeCommands(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		commands, err := c.Commands(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"commands": commands})
+	case http.MethodPost:
+		var req struct {
+			Type   string `json:"type"`
+			Shards []int  `json:"shards"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json")
+			return
+		}
+		cmd, err := c.QueueCommand(id, req.Type, req.Shards)
+		switch {
+		case errors.Is(err, errUnknownJob):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, errUnknownNode):
+			writeError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, errNodeNotReporting):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, errTooManyCommands):
+			writeError(w, http.StatusTooManyRequests, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "internal_error")
+		default:
+			writeJSON(w, http.StatusAccepted, cmd)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+	}
+}
+
+func (c *Controller) nodeStatus(id string) (NodeStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return NodeStatus{}, false
+	}
+	return *n, true
+}
+
+// publicNode hides the node credentials from API responses.
+func publicNode(n NodeStatus) NodeStatus {
+	n.AuthToken, n.HMACSecret = "", ""
+	return n
+}
+
+func publicNodes(nodes []NodeStatus) []NodeStatus {
+	for i := range nodes {
+		nodes[i] = publicNode(nodes[i])
+	}
+	return nodes
+}
+
+// loadControllerConfig reads the controller flags and the config file given
+// with -config; flags given on the command line take precedence over it.
+func loadControllerConfig(fs *flag.FlagSet, args []string) ControllerConfig {
+	cfg := defaultControllerConfig()
+	configPath := fs.String("config", "", "Path to the controller YAML or JSON config file")
+	cfg.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("parse flags: %v", err)
+	}
+	if *configPath != "" {
+		flagOverrides := captureSetFlags(fs)
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			log.Fatalf("read config file: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			log.Fatalf("parse config file: %v", err)
+		}
+		for name, value := range flagOverrides {
+			if name == "config" {
+				continue
+			}
+			if err := fs.Lookup(name).Value.Set(value); err != nil {
+				log.Fatalf("apply flag %s: %v", name, err)
+			}
+		}
+		log.Printf("configuration loaded from %s", *configPath)
+	}
+	return cfg
+}
+
+// runController implements "inconnect-agent controller [flags]".
+func runController(args []string) {
+	cfg := loadControllerConfig(flag.NewFlagSet("controller", flag.ExitOnError), args)
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	controller := NewController(cfg)
+	if err := controller.loadState(); err != nil {
+		log.Fatalf("load controller state: %v", err)
+	}
+	if err := controller.loadOwners(); err != nil {
+		log.Fatalf("load slot owners: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controller.StartPolling(ctx)
+
+	server := &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      controller.Router(),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+	go func() {
+		log.Printf("controller listening on %s with %d nodes", cfg.Listen, len(controller.Nodes()))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("controller server error: %v", err)
+		}
+	}()
+	waitForShutdown(server, nil, cancel)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentReport is what an agent sends to the control plane when it registers
+// and with every heartbeat.
+type AgentReport struct {
+	NodeID           string            `json:"nodeId"`
+	Region           string            `json:"region,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	PublicIP         string            `json:"publicIP"`
+	Version          string            `json:"version"`
+	HeartbeatSeconds int               `json:"heartbeatInterval"`
+	Healthy          bool              `json:"healthy"`
+	Problems         []string          `json:"problems,omitempty"`
+	Shards           []ShardStatus     `json:"shards"`
+	Totals           SlotCounts        `json:"totals"`
+	Results          []CommandResult   `json:"results,omitempty"`
+}
+
+// AgentCommand is a job the control plane asks the agent to run.
+type AgentCommand struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Shards []int  `json:"shards,omitempty"`
+}
+
+// CommandResult reports the job started for a command. Results are sent
+// with every heartbeat until the job has finished and the control plane has
+// acknowledged the heartbeat carrying the final status.
+type CommandResult struct {
+	ID     string `json:"id"`
+	JobID  string `json:"jobId,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// maxFinishedCommands is how many acknowledged command IDs the agent
+// remembers to drop a command the control plane delivers again.
+const maxFinishedCommands = 256
+
+type heartbeatResponse struct {
+	Commands []AgentCommand `json:"commands"`
+}
+
+// controlPlane registers the agent with a control plane and sends it
+// heartbeats. The agent only makes outgoing requests, so it works behind NAT
+// where its API cannot be reached; commands for it come back in the
+// heartbeat responses.
+type controlPlane struct {
+	agent    *Agent
+	url      string
+	token    string
+	nodeID   string
+	interval time.Duration
+	client   *http.Client
+
+	mu       sync.Mutex
+	commands map[string]*CommandResult // by command ID
+	// finished holds the IDs of acknowledged commands, oldest first, and
+	// finishedIDs the same IDs as a set.
+	finished    []string
+	finishedIDs map[string]bool
+}
+
+func newControlPlane(agent *Agent, nodeID string) *controlPlane {
+	return &controlPlane{
+		agent:       agent,
+		url:         strings.TrimSuffix(agent.cfg.ControlPlaneURL, "/"),
+		token:       agent.cfg.ControlPlaneToken,
+		nodeID:      nodeID,
+		interval:    time.Duration(agent.cfg.HeartbeatSeconds) * time.Second,
+		client:      &http.Client{Timeout: nodeRequestTimeout},
+		commands:    make(map[string]*CommandResult),
+		finishedIDs: make(map[string]bool),
+	}
+}
+
+// Start registers right away and then sends a heartbeat every interval. A
+// failed registration is retried at the next tick, and the agent registers
+// again when the control plane no longer knows it.
+func (cp *controlPlane) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(cp.interval)
+		defer ticker.Stop()
+		registered := false
+		for {
+			path := "/agents/heartbeat"
+			if !registered {
+				path = "/agents/register"
+			}
+			err := cp.send(ctx, path)
+			switch {
+			case err == nil:
+				if !registered {
+					log.Printf("registered with control plane %s as %s", cp.url, cp.nodeID)
+				}
+				registered = true
+			case errors.Is(err, errUnknownNode) && registered:
+				log.Printf("control plane %s no longer knows node %s, registering again", cp.url, cp.nodeID)
+				registered = false
+				continue
+			case ctx.Err() == nil:
+				log.Printf("control plane %s: %v", cp.url, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// send posts a report to path and runs the commands in the response.
+func (cp *controlPlane) send(ctx context.Context, path string) error {
+	report := cp.report(ctx)
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cp.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cp.token != "" {
+		req.Header.Set(headerAuthToken, cp.token)
+	}
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxNodeResponse+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxNodeResponse {
+		return errNodeResponseLarge
+	}
+	if resp.StatusCode != http.StatusOK {
+		code := nodeErrorCode(data)
+		if resp.StatusCode == http.StatusNotFound && code == errUnknownNode.Error() {
+			return errUnknownNode
+		}
+		return fmt.Errorf("%s returned %d: %s", path, resp.StatusCode, code)
+	}
+	var reply heartbeatResponse
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", path, err)
+	}
+
+	cp.acknowledge(report.Results)
+	for _, cmd := range reply.Commands {
+		cp.run(cmd)
+	}
+	return nil
+}
+
+// report collects the node's state and the status of its commands.
+func (cp *controlPlane) report(ctx context.Context) AgentReport {
+	cfg := cp.agent.cfg
+	report := AgentReport{
+		NodeID:           cp.nodeID,
+		Region:           cfg.NodeRegion,
+		Labels:           cfg.NodeLabels,
+		PublicIP:         cfg.PublicIP,
+		Version:          version,
+		HeartbeatSeconds: cfg.HeartbeatSeconds,
+		Shards:           []ShardStatus{},
+	}
+	shards, totals, err := cp.agent.ShardStats(ctx)
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("stats: %v", err))
+	} else {
+		report.Shards, report.Totals = shards, totals
+	}
+	report.Problems = append(report.Problems, cp.agent.containerProblems(ctx)...)
+	report.Healthy = len(report.Problems) == 0
+	report.Results = cp.results()
+	return report
+}
+
+// containerProblems lists the shards whose Xray container is missing.
+func (a *Agent) containerProblems(ctx context.Context) []string {
+	shards := a.allShards()
+	var problems []string
+	for _, shard := range shards {
+		exists, err := a.docker.containerExists(ctx, shard.ContainerName)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("shard %d: %v", shard.ID, err))
+		case !exists:
+			problems = append(problems, fmt.Sprintf("shard %d: container %s is missing", shard.ID, shard.ContainerName))
+		}
+	}
+	return problems
+}
+
+// run submits a command as a job. A command already known from an earlier
+// response is not run twice.
+func (cp *controlPlane) run(cmd AgentCommand) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if _, ok := cp.commands[cmd.ID]; ok {
+		return
+	}
+	if cp.finishedIDs[cmd.ID] {
+		log.Printf("control plane command %s (%s) already ran, ignoring it", cmd.ID, cmd.Type)
+		return
+	}
+	result := &CommandResult{ID: cmd.ID}
+	job, err := cp.agent.SubmitJob(Caller{Identity: actorControlPlane}, cmd.Type, cmd.Shards)
+	if err != nil && !errors.Is(err, errJobQueued) {
+		result.Status, result.Error = jobFailed, err.Error()
+		log.Printf("control plane command %s (%s) rejected: %v", cmd.ID, cmd.Type, err)
+	} else {
+		result.JobID, result.Status = job.ID, job.Status
+		log.Printf("control plane command %s: %s queued as job %s", cmd.ID, cmd.Type, job.ID)
+	}
+	cp.commands[cmd.ID] = result
+}
+
+// results refreshes the command statuses from their jobs.
+func (cp *controlPlane) results() []CommandResult {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	out := make([]CommandResult, 0, len(cp.commands))
+	for _, result := range cp.commands {
+		if result.JobID != "" && result.Status != jobSucceeded && result.Status != jobFailed {
+			job, err := cp.agent.jobs.Get(result.JobID)
+			if err != nil {
+				result.Status, result.Error = jobFailed, err.Error()
+			} else {
+				result.Status, result.Error = job.Status, job.Error
+			}
+		}
+		out = append(out, *result)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// acknowledge forgets the commands whose final status the control plane has
+// received, keeping their IDs so that they do not run again if delivered
+// once more.
+func (cp *controlPlane) acknowledge(sent []CommandResult) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, result := range sent {
+		if result.Status != jobSucceeded && result.Status != jobFailed {
+			continue
+		}
+		delete(cp.commands, result.ID)
+		if cp.finishedIDs[result.ID] {
+			continue
+		}
+		cp.finishedIDs[result.ID] = true
+		cp.finished = append(cp.finished, result.ID)
+		if len(cp.finished) > maxFinishedCommands {
+			delete(cp.finishedIDs, cp.finished[0])
+			cp.finished = cp.finished[1:]
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Upstream types an egress can chain to.
+const (
+	egressSOCKS       = "socks"
+	egressHTTP        = "http"
+	egressWireGuard   = "wireguard"
+	egressShadowsocks = "shadowsocks"
+)
+
+// EgressConfig is an alternative outbound. Shards with egress set send all
+// their traffic through it; Users lists client emails routed through it on
+// any shard.
+type EgressConfig struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Address  string `yaml:"address"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Method is the cipher of a Shadowsocks upstream.
+	Method string `yaml:"method"`
+	// PrivateKey, PublicKey (the peer's), LocalAddresses, MTU and Reserved
+	// configure a WireGuard tunnel such as Cloudflare WARP.
+	PrivateKey     string   `yaml:"privateKey"`
+	PublicKey      string   `yaml:"publicKey"`
+	LocalAddresses []string `yaml:"localAddresses"`
+	MTU            int      `yaml:"mtu"`
+	Reserved       []int    `yaml:"reserved"`
+	Users          []string `yaml:"users"`
+}
+
+func (e EgressConfig) validate() error {
+	if e.Name == "" {
+		return errors.New("name is required")
+	}
+	if e.Name == "api" || e.Name == "direct" {
+		return fmt.Errorf("name %q is taken by the agent's outbounds", e.Name)
+	}
+	if _, _, err := splitEgressAddress(e.Address); err != nil {
+		return err
+	}
+	switch e.Type {
+	case egressSOCKS, egressHTTP:
+		if e.Password != "" && e.User == "" {
+			return errors.New("password needs user")
+		}
+	case egressShadowsocks:
+		if !validMethod(e.Method) {
+			return fmt.Errorf("unsupported method %q", e.Method)
+		}
+		if e.Password == "" {
+			return errors.New("shadowsocks needs password")
+		}
+		// a Shadowsocks 2022 password is a key, or the server's and the
+		// user's keys joined by ":" for a multi-user server
+		if _, ok := methodKeySizes[e.Method]; ok {
+			for _, key := range strings.Split(e.Password, ":") {
+				if err := validateMethodKey(e.Method, key); err != nil {
+					return fmt.Errorf("invalid password: %w", err)
+				}
+			}
+		}
+	case egressWireGuard:
+		if e.PrivateKey == "" || e.PublicKey == "" {
+			return errors.New("wireguard needs privateKey and publicKey")
+		}
+		if len(e.LocalAddresses) == 0 {
+			return errors.New("wireguard needs localAddresses")
+		}
+		for _, addr := range e.LocalAddresses {
+			if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+				return fmt.Errorf("invalid local address %q", addr)
+			}
+		}
+		if len(e.Reserved) != 0 && len(e.Reserved) != 3 {
+			return errors.New("reserved must have 3 bytes")
+		}
+	default:
+		return fmt.Errorf("unsupported type %q, expected socks, http, wireguard or shadowsocks", e.Type)
+	}
+	return nil
+}
+
+func splitEgressAddress(address string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid address %q: bad port", address)
+	}
+	return host, port, nil
+}
+
+// validateEgress checks the egress list and the shards referring to it.
+func (c Config) validateEgress() error {
+	names := make(map[string]bool, len(c.Egress))
+	for i, e := range c.Egress {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("egress %d: %w", i+1, err)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("egress %d: duplicate name %q", i+1, e.Name)
+		}
+		names[e.Name] = true
+	}
+	for i, sp := range c.Shards {
+		if sp.Egress != "" && !names[sp.Egress] {
+			return fmt.Errorf("shard %d: unknown egress %q", i+1, sp.Egress)
+		}
+	}
+	return nil
+}
+
+// egressTag is the outbound tag of an egress in generated configs.
+func egressTag(name string) string {
+	return "egress-" + name
+}
+
+// xrayOutbound is the Xray outbound of the egress.
+func (e EgressConfig) xrayOutbound() outbound {
+	host, port, _ := splitEgressAddress(e.Address)
+	out := outbound{Protocol: e.Type, Tag: egressTag(e.Name)}
+	switch e.Type {
+	case egressWireGuard:
+		peer := map[string]any{
+			"publicKey": e.PublicKey,
+			"endpoint":  e.Address,
+		}
+		out.Settings = map[string]any{
+			"secretKey": e.PrivateKey,
+			"address":   e.LocalAddresses,
+			"peers":     []map[string]any{peer},
+		}
+		if e.MTU > 0 {
+			out.Settings["mtu"] = e.MTU
+		}
+		if len(e.Reserved) > 0 {
+			out.Settings["reserved"] = e.Reserved
+		}
+	case egressShadowsocks:
+		out.Settings = map[string]any{"servers": []map[string]any{{
+			"address":  host,
+			"port":     port,
+			"method":   e.Method,
+			"password": e.Password,
+		}}}
+	default:
+		server := map[string]any{"address": host, "port": port}
+		if e.User != "" {
+			server["users"] = []map[string]string{{"user": e.User, "pass": e.Password}}
+		}
+		out.Settings = map[string]any{"servers": []map[string]any{server}}
+	}
+	return out
+}
+
+// shardEgress returns the outbounds and routing rules that send the shard's
+// traffic through its egress and the clients listed by an egress through
+// theirs. The shard's egress is returned first among the outbounds, to be
+// the default one; the others, reached only through user rules, are
+// returned in users. User rules only cover clients present on the shard.
+func shardEgress(egress []EgressConfig, shard ShardDefinition, emails []string) (outbounds, users []outbound, rules []routingRule) {
+	present := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		present[email] = true
+	}
+	for _, e := range egress {
+		var clients []string
+		for _, user := range e.Users {
+			if present[user] {
+				clients = append(clients, user)
+			}
+		}
+		switch {
+		case e.Name == shard.Egress:
+			outbounds = append(outbounds, e.xrayOutbound())
+		case len(clients) > 0:
+			users = append(users, e.xrayOutbound())
+		}
+		if len(clients) > 0 {
+			rules = append(rules, routingRule{User: clients, OutboundTag: egressTag(e.Name), Type: "field"})
+		}
+	}
+	return outbounds, users, rules
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testEgress = []EgressConfig{
+	{Name: "warp", Type: egressSOCKS, Address: "127.0.0.1:40000"},
+	{Name: "de", Type: egressHTTP, Address: "10.0.0.1:3128", Users: []string{"u3", "u1"}},
+	{Name: "nl", Type: egressSOCKS, Address: "10.0.0.2:1080", Users: []string{"u2", "gone"}},
+}
+
+func outboundTags(outbounds []outbound) []string {
+	var tags []string
+	for _, o := range outbounds {
+		tags = append(tags, o.Tag)
+	}
+	return tags
+}
+
+func TestShardEgress(t *testing.T) {
+	tests := []struct {
+		name      string
+		egress    []EgressConfig
+		shard     string
+		emails    []string
+		outbounds []string
+		users     []string
+		rules     []routingRule
+	}{
+		{
+			name:   "no egress",
+			emails: []string{"u1"},
+		},
+		{
+			name:   "no egress used",
+			egress: testEgress,
+			emails: []string{"u9"},
+		},
+		{
+			name:      "shard egress only",
+			egress:    testEgress,
+			shard:     "warp",
+			emails:    []string{"u9"},
+			outbounds: []string{"egress-warp"},
+		},
+		{
+			name:   "user egress",
+			egress: testEgress,
+			emails: []string{"u1"},
+			users:  []string{"egress-de"},
+			rules: []routingRule{
+				{User: []string{"u1"}, OutboundTag: "egress-de", Type: "field"},
+			},
+		},
+		{
+			name:      "shard and user egress in config order",
+			egress:    testEgress,
+			shard:     "warp",
+			emails:    []string{"u2", "u1", "u3"},
+			outbounds: []string{"egress-warp"},
+			users:     []string{"egress-de", "egress-nl"},
+			rules: []routingRule{
+				{User: []string{"u3", "u1"}, OutboundTag: "egress-de", Type: "field"},
+				{User: []string{"u2"}, OutboundTag: "egress-nl", Type: "field"},
+			},
+		},
+		{
+			name:      "shard egress with its own users",
+			egress:    testEgress,
+			shard:     "de",
+			emails:    []string{"u1", "u2"},
+			outbounds: []string{"egress-de"},
+			users:     []string{"egress-nl"},
+			rules: []routingRule{
+				{User: []string{"u1"}, OutboundTag: "egress-de", Type: "field"},
+				{User: []string{"u2"}, OutboundTag: "egress-nl", Type: "field"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbounds, users, rules := shardEgress(tt.egress, ShardDefinition{ID: 1, Egress: tt.shard}, tt.emails)
+			if got := outboundTags(outbounds); !reflect.DeepEqual(got, tt.outbounds) {
+				t.Errorf("outbounds = %v, want %v", got, tt.outbounds)
+			}
+			if got := outboundTags(users); !reflect.DeepEqual(got, tt.users) {
+				t.Errorf("user outbounds = %v, want %v", got, tt.users)
+			}
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("rules = %+v, want %+v", rules, tt.rules)
+			}
+		})
+	}
+}
+
+// TestBuildXrayConfigEgressOrder checks where the egress outbounds and rules
+// end up in the generated config: the shard's egress is the first (default)
+// outbound, and user rules come after the api rule and any overlay rules.
+func TestBuildXrayConfigEgressOrder(t *testing.T) {
+	blockRule := map[string]any{"outboundTag": "block", "protocol": []any{"bittorrent"}, "type": "field"}
+	tests := []struct {
+		name      string
+		egress    []EgressConfig
+		shard     string
+		overlays  []map[string]any
+		outbounds []string
+		rules     []string
+	}{
+		{
+			name:      "no egress",
+			outbounds: []string{"direct", "api"},
+			rules:     []string{"api"},
+		},
+		{
+			name:      "shard egress",
+			egress:    testEgress,
+			shard:     "warp",
+			outbounds: []string{"egress-warp", "direct", "api", "egress-de", "egress-nl"},
+			rules:     []string{"api", "egress-de", "egress-nl"},
+		},
+		{
+			name:      "user egress",
+			egress:    testEgress,
+			outbounds: []string{"direct", "api", "egress-de", "egress-nl"},
+			rules:     []string{"api", "egress-de", "egress-nl"},
+		},
+		{
+			name:   "overlay rules before user rules",
+			egress: testEgress,
+			shard:  "warp",
+			overlays: []map[string]any{
+				{
+					"outbounds": []any{map[string]any{"tag": "block", "protocol": "blackhole"}},
+					"routing":   map[string]any{"rules": []any{blockRule}},
+				},
+			},
+			outbounds: []string{"egress-warp", "direct", "api", "egress-de", "egress-nl", "block"},
+			rules:     []string{"api", "block", "egress-de", "egress-nl"},
+		},
+		{
+			name:   "overlays in order",
+			egress: testEgress,
+			overlays: []map[string]any{
+				{"routing": map[string]any{"rules": []any{blockRule}}},
+				{"routing": map[string]any{"rules": []any{map[string]any{"outboundTag": "direct", "domain": []any{"example.com"}, "type": "field"}}}},
+			},
+			outbounds: []string{"direct", "api", "egress-de", "egress-nl"},
+			rules:     []string{"api", "block", "direct", "egress-de", "egress-nl"},
+		},
+	}
+	shard := ShardDefinition{ID: 1, Port: 50001, Protocol: protocolShadowsocks, Method: "chacha20-ietf-poly1305", Network: networkBoth}
+	slots := []Slot{{ID: 1, ShardID: 1, Password: "p1"}, {ID: 2, ShardID: 1, Password: "p2"}}
+	emails := map[int]string{1: "u1", 2: "u2"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shard := shard
+			shard.Egress = tt.shard
+			data, err := buildXrayConfig(slots, shard, Config{Egress: tt.egress}, emails, "", tt.overlays)
+			if err != nil {
+				t.Fatalf("buildXrayConfig() = %v", err)
+			}
+			var got struct {
+				Outbounds []outbound `json:"outbounds"`
+				Routing   struct {
+					Rules []routingRule `json:"rules"`
+				} `json:"routing"`
+			}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if tags := outboundTags(got.Outbounds); !reflect.DeepEqual(tags, tt.outbounds) {
+				t.Errorf("outbounds = %v, want %v", tags, tt.outbounds)
+			}
+			var rules []string
+			for _, rule := range got.Routing.Rules {
+				rules = append(rules, rule.OutboundTag)
+			}
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("rules = %v, want %v", rules, tt.rules)
+			}
+		})
+	}
+}
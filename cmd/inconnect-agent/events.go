@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published on the agent's event bus.
+const (
+	eventSlotAllocated  = "slot.allocated"
+	eventSlotReserved   = "slot.reserved"
+	eventSlotRotated    = "slot.rotated"
+	eventShardReloading = "shard.reloading"
+	eventShardReloaded  = "shard.reloaded"
+	eventShardRestarted = "shard.restarted"
+	eventReloadFailed   = "reload.failed"
+	eventShardAdded     = "shard.added"
+	eventDockerFallback = "docker.fallback"
+	eventScheduler      = "scheduler.triggered"
+	eventCapacityLow    = "capacity.low"
+	eventResetCompleted = "reset.completed"
+	eventJobQueued      = "job.queued"
+	eventJobStarted     = "job.started"
+	eventJobFinished    = "job.finished"
+	eventSyncCompleted  = "sync.completed"
+)
+
+var eventTypes = []string{
+	eventSlotAllocated, eventSlotReserved, eventSlotRotated,
+	eventShardReloading, eventShardReloaded, eventShardRestarted, eventReloadFailed, eventShardAdded,
+	eventDockerFallback, eventScheduler,
+	eventCapacityLow, eventResetCompleted,
+	eventJobQueued, eventJobStarted, eventJobFinished,
+	eventSyncCompleted,
+}
+
+func knownEventType(t string) bool {
+	for _, known := range eventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event describes something the agent did.
+type Event struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	SlotID  int       `json:"slotId,omitempty"`
+	ShardID int       `json:"shardId,omitempty"`
+	UserID  string    `json:"userId,omitempty"`
+	Job     *Job      `json:"job,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// subscriberBuffer is how many events a slow subscriber may lag behind
+// before further events are dropped for it.
+const subscriberBuffer = 256
+
+// EventBus fans events out to in-process subscribers. Publishing never
+// blocks on a subscriber.
+type EventBus struct {
+	mu     sync.Mutex
+	seq    int64
+	nextID int
+	subs   map[int]chan Event
+	queues map[int]*eventQueue
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]chan Event), queues: make(map[int]*eventQueue)}
+}
+
+// eventQueue holds the events a lossless subscriber has not taken yet.
+type eventQueue struct {
+	pending []Event
+	wake    chan struct{}
+}
+
+func (b *EventBus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	ev.Seq = b.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	for _, q := range b.queues {
+		q.pending = append(q.pending, ev)
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of future events and a function that
+// unsubscribes and closes it.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, subscriberBuffer)
+	b.subs[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// SubscribeAll is Subscribe for subscribers that must see every event, such
+// as the webhook outbox. Events the subscriber has not taken yet queue up in
+// memory instead of being dropped, so Publish still never blocks. The
+// returned function unsubscribes; the channel closes once the events
+// published before that have been received.
+func (b *EventBus) SubscribeAll() (<-chan Event, func()) {
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	q := &eventQueue{wake: make(chan struct{}, 1)}
+	b.queues[id] = q
+	b.mu.Unlock()
+
+	ch := make(chan Event)
+	stop := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			b.mu.Lock()
+			batch := q.pending
+			q.pending = nil
+			b.mu.Unlock()
+			for _, ev := range batch {
+				ch <- ev
+			}
+			if len(batch) > 0 {
+				continue
+			}
+			select {
+			case <-q.wake:
+			case <-stop:
+				b.mu.Lock()
+				batch = q.pending
+				q.pending = nil
+				b.mu.Unlock()
+				for _, ev := range batch {
+					ch <- ev
+				}
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.queues, id)
+			b.mu.Unlock()
+			close(stop)
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"inconnect-agent/api/agentpb"
+)
+
+// grpcPermissions maps each RPC to the HTTP permission it requires.
+var grpcPermissions = map[string]string{
+	agentpb.AgentService_AllocateSlot_FullMethodName: "adduser",
+	agentpb.AgentService_ReserveSlot_FullMethodName:  "deleteuser",
+	agentpb.AgentService_ListSlots_FullMethodName:    "stats",
+	agentpb.AgentService_Stats_FullMethodName:        "stats",
+	agentpb.AgentService_Reload_FullMethodName:       "reload",
+	agentpb.AgentService_Restart_FullMethodName:      "restart",
+	agentpb.AgentService_Reset_FullMethodName:        "reset",
+	agentpb.AgentService_WatchEvents_FullMethodName:  "stats",
+}
+
+// grpcJobPoll bounds how long a job stream waits without events before it
+// re-reads the job, in case the subscriber fell behind and missed them.
+const grpcJobPoll = 2 * time.Second
+
+type grpcServer struct {
+	agentpb.UnimplementedAgentServiceServer
+	agent *Agent
+}
+
+// newGRPCServer serves AgentService over the same TLS and auth settings as
+// the HTTP API.
+func newGRPCServer(a *Agent, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := a.authorizeRPC(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := a.authorizeRPC(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	agentpb.RegisterAgentServiceServer(s, &grpcServer{agent: a})
+	return s
+}
+
+// grpcRequest presents an RPC as an *http.Request so the HTTP authentication,
+// permission and rate-limit checks apply unchanged. Metadata becomes headers
+// and the peer's TLS state becomes r.TLS.
+func grpcRequest(ctx context.Context, fullMethod string) *http.Request {
+	r := &http.Request{
+		Method: "GRPC",
+		URL:    &url.URL{Path: fullMethod},
+		Header: http.Header{},
+		Body:   http.NoBody,
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vals := range md {
+			for _, v := range vals {
+				r.Header.Add(k, v)
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := info.State
+			r.TLS = &state
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// authorizeRPC applies the HTTP checks to an RPC. An HMAC signature over gRPC
+// covers only the method, timestamp and nonce, not the request message, so
+// it is accepted on TLS connections only, where the headers cannot be moved
+// to another message.
+func (a *Agent) authorizeRPC(ctx context.Context, fullMethod string) error {
+	r := grpcRequest(ctx, fullMethod)
+	if r.TLS == nil && a.cfg.HMACSecret != "" && r.Header.Get(headerSignature) != "" {
+		return status.Error(codes.Unauthenticated, errHMACNeedsTLS.Error())
+	}
+	if err := a.authenticate(r); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	permission, ok := grpcPermissions[fullMethod]
+	if !ok || !a.permitted(r, permission) {
+		return status.Error(codes.PermissionDenied, errForbidden.Error())
+	}
+	if allowed, wait := a.allowRate(r, permission); !allowed {
+		_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", fmt.Sprintf("%.0f", wait.Seconds()+0.5)))
+		return status.Error(codes.ResourceExhausted, "rate_limited")
+	}
+	return nil
+}
+
+func (s *grpcServer) caller(ctx context.Context) Caller {
+	return s.agent.callerFromRequest(grpcRequest(ctx, ""))
+}
+
+func (s *grpcServer) AllocateSlot(ctx context.Context, req *agentpb.AllocateSlotRequest) (*agentpb.AllocateSlotResponse, error) {
+	alloc, err := s.agent.AllocateSlot(ctx, s.caller(ctx), req.GetUserId(), req.GetMetadata().AsMap(), req.GetClientKey())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &agentpb.AllocateSlotResponse{
+		Slot:      slotToProto(s.agent.slotResource(alloc.Slot, true)),
+		FreeSlots: int32(alloc.FreeSlots),
+	}, nil
+}
+
+func (s *grpcServer) ReserveSlot(ctx context.Context, req *agentpb.ReserveSlotRequest) (*agentpb.ReserveSlotResponse, error) {
+	if len(req.GetSlotIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "slot_required")
+	}
+	ids := make([]int, len(req.GetSlotIds()))
+	for i, id := range req.GetSlotIds() {
+		ids[i] = int(id)
+	}
+	if err := s.agent.ReserveSlots(ctx, s.caller(ctx), ids); err != nil {
+		return nil, grpcError(err)
+	}
+	return &agentpb.ReserveSlotResponse{}, nil
+}
+
+func (s *grpcServer) ListSlots(ctx context.Context, req *agentpb.ListSlotsRequest) (*agentpb.ListSlotsResponse, error) {
+	filter := SlotFilter{
+		Status:   req.GetStatus(),
+		ShardID:  int(req.GetShardId()),
+		UserID:   req.GetUserId(),
+		Limit:    int(req.GetLimit()),
+		Offset:   int(req.GetOffset()),
+		Metadata: req.GetMetadata(),
+	}
+	filter.Limit = pageLimit(filter.Limit)
+	for key := range filter.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, status.Error(codes.InvalidArgument, errInvalidMetadataKey.Error())
+		}
+	}
+	slots, err := s.agent.store.ListSlots(ctx, filter)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &agentpb.ListSlotsResponse{}
+	for _, slot := range slots {
+		resp.Slots = append(resp.Slots, slotToProto(s.agent.slotResource(slot, false)))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Stats(ctx context.Context, _ *agentpb.StatsRequest) (*agentpb.StatsResponse, error) {
+	shards, totals, err := s.agent.ShardStats(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &agentpb.StatsResponse{Totals: countsToProto(totals)}
+	for _, sh := range shards {
+		resp.Shards = append(resp.Shards, &agentpb.ShardStats{
+			Id:        int32(sh.ID),
+			Port:      int32(sh.Port),
+			SlotCount: int32(sh.SlotCount),
+			Counts:    countsToProto(sh.SlotCounts),
+			Protocol:  sh.Protocol,
+			Method:    sh.Method,
+			Network:   sh.Network,
+			Egress:    sh.Egress,
+		})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Reload(req *agentpb.JobRequest, stream agentpb.AgentService_ReloadServer) error {
+	return s.streamJob(stream, jobReload, shardTarget(req.GetShardId()))
+}
+
+func (s *grpcServer) Restart(req *agentpb.JobRequest, stream agentpb.AgentService_RestartServer) error {
+	return s.streamJob(stream, jobRestart, shardTarget(req.GetShardId()))
+}
+
+func (s *grpcServer) Reset(_ *agentpb.ResetRequest, stream agentpb.AgentService_ResetServer) error {
+	return s.streamJob(stream, jobReset, nil)
+}
+
+type jobStream interface {
+	Context() context.Context
+	Send(*agentpb.JobUpdate) error
+}
+
+// streamJob submits a job and forwards its state changes, plus per-shard
+// reload events while it runs, until it finishes.
+func (s *grpcServer) streamJob(stream jobStream, jobType string, target []int) error {
+	ctx := stream.Context()
+	events, unsubscribe := s.agent.events.Subscribe()
+	defer unsubscribe()
+
+	job, err := s.agent.SubmitJob(s.caller(ctx), jobType, target)
+	coalesced := errors.Is(err, errJobQueued)
+	if err != nil && !coalesced {
+		return grpcError(err)
+	}
+	if err := stream.Send(&agentpb.JobUpdate{Job: jobToProto(job), Coalesced: coalesced}); err != nil {
+		return err
+	}
+
+	inJob := make(map[int]bool, len(job.Shards))
+	for _, id := range job.Shards {
+		inJob[id] = true
+	}
+	running := job.Status == jobRunning
+	ticker := time.NewTicker(grpcJobPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			switch {
+			case ev.Type == eventJobQueued:
+				// already reported by the first update
+			case ev.Job != nil && ev.Job.ID == job.ID:
+				job = *ev.Job
+				running = job.Status == jobRunning
+				if err := stream.Send(&agentpb.JobUpdate{Job: jobToProto(job)}); err != nil {
+					return err
+				}
+				if ev.Type == eventJobFinished {
+					return nil
+				}
+			case running && (ev.Type == eventShardReloaded || ev.Type == eventShardRestarted) && inJob[ev.ShardID]:
+				if err := stream.Send(&agentpb.JobUpdate{Job: jobToProto(job), ShardId: int32(ev.ShardID)}); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			latest, err := s.agent.jobs.Get(job.ID)
+			if err != nil {
+				return grpcError(err)
+			}
+			if latest.FinishedAt != nil {
+				return stream.Send(&agentpb.JobUpdate{Job: jobToProto(latest)})
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *grpcServer) WatchEvents(req *agentpb.WatchEventsRequest, stream agentpb.AgentService_WatchEventsServer) error {
+	wanted := make(map[string]bool, len(req.GetTypes()))
+	for _, t := range req.GetTypes() {
+		wanted[t] = true
+	}
+	events, unsubscribe := s.agent.events.Subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case ev := <-events:
+			if len(wanted) > 0 && !wanted[ev.Type] {
+				continue
+			}
+			if err := stream.Send(eventToProto(ev)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func shardTarget(id int32) []int {
+	if id > 0 {
+		return []int{int(id)}
+	}
+	return nil
+}
+
+// grpcError maps agent errors to gRPC status codes, keeping the HTTP error
+// codes as messages.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidMetadata):
+		return status.Error(codes.InvalidArgument, "invalid_metadata")
+	case errors.Is(err, errInvalidClientKey):
+		return status.Error(codes.InvalidArgument, errInvalidClientKey.Error())
+	case errors.Is(err, errNoFreePorts):
+		return status.Error(codes.ResourceExhausted, "no_free_ports")
+	case errors.Is(err, errSlotNotFound):
+		return status.Error(codes.NotFound, "slot_not_found")
+	case errors.Is(err, errSlotReserved), errors.Is(err, errSlotFree), errors.Is(err, errSlotNotInUse):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errUnknownShard):
+		return status.Error(codes.InvalidArgument, "unknown_shard")
+	case errors.Is(err, errJobNotFound):
+		return status.Error(codes.NotFound, "job_not_found")
+	case errors.Is(err, errTooManyJobs):
+		return status.Error(codes.ResourceExhausted, "too_many_jobs")
+	default:
+		return status.Error(codes.Internal, "internal_error")
+	}
+}
+
+func slotToProto(s SlotResource) *agentpb.Slot {
+	pb := &agentpb.Slot{
+		Id:        int32(s.ID),
+		ShardId:   int32(s.ShardID),
+		Status:    s.Status,
+		UserId:    s.UserID,
+		UpdatedAt: timestamppb.New(s.UpdatedAt),
+	}
+	if s.AvailableAt != nil {
+		pb.AvailableAt = timestamppb.New(*s.AvailableAt)
+	}
+	if s.Metadata != nil {
+		pb.Metadata, _ = structpb.NewStruct(s.Metadata)
+	}
+	if s.Connection != nil {
+		pb.Connection = &agentpb.Connection{
+			Ip:       s.Connection.IP,
+			Port:     int32(s.Connection.Port),
+			Method:   s.Connection.Method,
+			Password: s.Connection.Password,
+			Protocol: s.Connection.Protocol,
+			Uri:      s.Connection.URI,
+		}
+	}
+	return pb
+}
+
+func countsToProto(c SlotCounts) *agentpb.SlotCounts {
+	return &agentpb.SlotCounts{Free: int32(c.Free), Used: int32(c.Used), Reserved: int32(c.Reserved), Cooldown: int32(c.Cooldown)}
+}
+
+func jobToProto(j Job) *agentpb.Job {
+	pb := &agentpb.Job{
+		Id:        j.ID,
+		Type:      j.Type,
+		Status:    j.Status,
+		CreatedAt: timestamppb.New(j.CreatedAt),
+		Error:     j.Error,
+	}
+	for _, id := range j.Shards {
+		pb.Shards = append(pb.Shards, int32(id))
+	}
+	if j.StartedAt != nil {
+		pb.StartedAt = timestamppb.New(*j.StartedAt)
+	}
+	if j.FinishedAt != nil {
+		pb.FinishedAt = timestamppb.New(*j.FinishedAt)
+	}
+	if len(j.Rotated) > 0 {
+		pb.Rotated = make(map[int32]int32, len(j.Rotated))
+		for k, v := range j.Rotated {
+			pb.Rotated[int32(k)] = int32(v)
+		}
+	}
+	return pb
+}
+
+func eventToProto(ev Event) *agentpb.Event {
+	pb := &agentpb.Event{
+		Seq:     ev.Seq,
+		Time:    timestamppb.New(ev.Time),
+		Type:    ev.Type,
+		SlotId:  int32(ev.SlotID),
+		ShardId: int32(ev.ShardID),
+		UserId:  ev.UserID,
+		Detail:  ev.Detail,
+	}
+	if ev.Job != nil {
+		pb.Job = jobToProto(*ev.Job)
+	}
+	return pb
+}
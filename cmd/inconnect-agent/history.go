@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// historyTimeFormat has a fixed width so that stored times compare correctly
+// as strings.
+const historyTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// Assignment is one period during which a user held a slot. The old
+// password keeps working until the slot is rotated, so a holder is
+// answerable for the slot until RotatedAt, not just ReleasedAt.
+type Assignment struct {
+	ID            int64      `json:"id"`
+	SlotID        int        `json:"slotId"`
+	ShardID       int        `json:"shardId"`
+	UserID        string     `json:"userId,omitempty"`
+	AllocatedAt   time.Time  `json:"allocatedAt"`
+	ReleasedAt    *time.Time `json:"releasedAt,omitempty"`
+	RotatedAt     *time.Time `json:"rotatedAt,omitempty"`
+	UplinkBytes   *int64     `json:"uplinkBytes,omitempty"`
+	DownlinkBytes *int64     `json:"downlinkBytes,omitempty"`
+}
+
+// AssignmentFilter narrows Assignments; zero values match everything. At
+// selects assignments whose slot could be used by their holder at that time.
+type AssignmentFilter struct {
+	SlotID  int
+	ShardID int
+	UserID  string
+	At      time.Time
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Traffic is the byte count Xray reported for a slot's user.
+type Traffic struct {
+	Uplink   int64
+	Downlink int64
+}
+
+func formatHistoryTime(t time.Time) string {
+	return t.UTC().Format(historyTimeFormat)
+}
+
+func recordAllocation(ctx context.Context, tx *Tx, slot *Slot, at time.Time) error {
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO slot_assignments (slot_id, shard_id, user_id, allocated_at)
+VALUES (?, ?, ?, ?)`,
+		slot.ID, slot.ShardID, slot.UserID.String, formatHistoryTime(at)); err != nil {
+		return fmt.Errorf("record assignment of slot %d: %w", slot.ID, err)
+	}
+	return nil
+}
+
+func recordRelease(ctx context.Context, tx *Tx, slotID int, at time.Time, traffic *Traffic) error {
+	var up, down any
+	if traffic != nil {
+		up, down = traffic.Uplink, traffic.Downlink
+	}
+	if _, err := tx.ExecContext(ctx, `
+UPDATE slot_assignments
+SET released_at = ?, uplink_bytes = ?, downlink_bytes = ?
+WHERE slot_id = ? AND released_at IS NULL`,
+		formatHistoryTime(at), up, down, slotID); err != nil {
+		return fmt.Errorf("record release of slot %d: %w", slotID, err)
+	}
+	return nil
+}
+
+func recordRotation(ctx context.Context, tx *Tx, slotID int, at time.Time) error {
+	if _, err := tx.ExecContext(ctx, `
+UPDATE slot_assignments
+SET rotated_at = ?
+WHERE slot_id = ? AND released_at IS NOT NULL AND rotated_at IS NULL`,
+		formatHistoryTime(at), slotID); err != nil {
+		return fmt.Errorf("record rotation of slot %d: %w", slotID, err)
+	}
+	return nil
+}
+
+// closeAssignments ends every open assignment, used when all slots are
+// replaced by a reset or an import.
+func closeAssignments(ctx context.Context, db querier, at time.Time) error {
+	ts := formatHistoryTime(at)
+	if _, err := db.ExecContext(ctx, `
+UPDATE slot_assignments
+SET released_at = COALESCE(released_at, ?), rotated_at = ?
+WHERE rotated_at IS NULL`, ts, ts); err != nil {
+		return fmt.Errorf("close assignments: %w", err)
+	}
+	return nil
+}
+
+// Assignments returns matching history entries, newest first.
+func (s *SlotStore) Assignments(ctx context.Context, f AssignmentFilter) ([]Assignment, error) {
+	query := `
+SELECT id, slot_id, shard_id, user_id, allocated_at, released_at, rotated_at, uplink_bytes, downlink_bytes
+FROM slot_assignments
+WHERE 1 = 1`
+	var args []any
+	if f.SlotID > 0 {
+		query += ` AND slot_id = ?`
+		args = append(args, f.SlotID)
+	}
+	if f.ShardID > 0 {
+		query += ` AND shard_id = ?`
+		args = append(args, f.ShardID)
+	}
+	if f.UserID != "" {
+		query += ` AND user_id = ?`
+		args = append(args, f.UserID)
+	}
+	if !f.At.IsZero() {
+		at := formatHistoryTime(f.At)
+		query += ` AND allocated_at <= ? AND (rotated_at IS NULL OR rotated_at > ?)`
+		args = append(args, at, at)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND (rotated_at IS NULL OR rotated_at >= ?)`
+		args = append(args, formatHistoryTime(f.Since))
+	}
+	if !f.Until.IsZero() {
+		query += ` AND allocated_at <= ?`
+		args = append(args, formatHistoryTime(f.Until))
+	}
+	query += ` ORDER BY allocated_at DESC, id DESC LIMIT ?`
+	args = append(args, pageLimit(f.Limit))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query assignments: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Assignment
+	for rows.Next() {
+		var a Assignment
+		var allocated string
+		var released, rotated sql.NullString
+		var up, down sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.SlotID, &a.ShardID, &a.UserID, &allocated, &released, &rotated, &up, &down); err != nil {
+			return nil, fmt.Errorf("scan assignment: %w", err)
+		}
+		a.AllocatedAt, _ = time.Parse(historyTimeFormat, allocated)
+		a.ReleasedAt = parseHistoryTime(released)
+		a.RotatedAt = parseHistoryTime(rotated)
+		if up.Valid {
+			a.UplinkBytes = &up.Int64
+		}
+		if down.Valid {
+			a.DownlinkBytes = &down.Int64
+		}
+		out = append(out, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate assignments: %w", err)
+	}
+	return out, nil
+}
+
+func parseHistoryTime(v sql.NullString) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t, err := time.Parse(historyTimeFormat, v.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -1,95 +1,102 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type httpHandler func(http.ResponseWriter, *http.Request)
 
+// errorWriter renders an error code in the format of the API being served.
+type errorWriter func(w http.ResponseWriter, status int, code string)
+
 func (a *Agent) Router() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/adduser", a.wrap(a.handleAddUser))
-	mux.Handle("/deleteuser", a.wrap(a.handleDeleteUser))
-	mux.Handle("/reload", a.wrap(a.handleReload))
-	mux.Handle("/restart", a.wrap(a.handleRestart))
-	mux.Handle("/reset", a.wrap(a.handleReset))
+	mux.Handle("/adduser", a.wrap("adduser", a.handleAddUser))
+	mux.Handle("/deleteuser", a.wrap("deleteuser", a.handleDeleteUser))
+	mux.Handle("/reload", a.wrap("reload", a.handleReload))
+	mux.Handle("/restart", a.wrap("restart", a.handleRestart))
+	mux.Handle("/reset", a.wrap("reset", a.handleReset))
+	mux.Handle("/backup", a.wrap("backup", a.handleBackup))
 	mux.HandleFunc("/stats", a.handleStats)
+	mux.HandleFunc("/audit", a.handleAudit)
+	mux.HandleFunc("/events", a.handleEvents)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	mux.Handle("/v1/", a.v1Handler())
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	})
 	return mux
 }
 
-func (a *Agent) wrap(handler httpHandler) http.Handler {
+func (a *Agent) wrap(permission string, handler httpHandler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
 			return
 		}
-		if a.cfg.AuthToken != "" {
-			if got := r.Header.Get("X-Auth-Token"); got != a.cfg.AuthToken {
-				writeError(w, http.StatusUnauthorized, "unauthorized")
-				return
-			}
+		if !a.checkAccess(w, r, permission, writeError) || !a.checkRate(w, r, permission, writeError) {
+			return
 		}
 		handler(w, r)
 	})
 }
 
 func (a *Agent) handleAddUser(w http.ResponseWriter, r *http.Request) {
-	a.opLock.RLock()
-	defer a.opLock.RUnlock()
-
 	var req struct {
-		UserID string `json:"user_id"`
+		UserID    string         `json:"user_id"`
+		Metadata  map[string]any `json:"metadata"`
+		ClientKey string         `json:"client_key"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
 		writeError(w, http.StatusBadRequest, "invalid_json")
 		return
 	}
-	slot, err := a.store.AllocateSlot(r.Context(), req.UserID)
+	alloc, err := a.AllocateSlot(r.Context(), a.callerFromRequest(r), req.UserID, req.Metadata, req.ClientKey)
 	if err != nil {
 		switch {
+		case errors.Is(err, errInvalidMetadata):
+			writeError(w, http.StatusBadRequest, "invalid_metadata")
+		case errors.Is(err, errInvalidClientKey):
+			writeError(w, http.StatusBadRequest, errInvalidClientKey.Error())
 		case errors.Is(err, errNoFreePorts):
 			writeError(w, http.StatusConflict, "no_free_ports")
+		case errors.Is(err, errUnknownShard):
+			writeError(w, http.StatusInternalServerError, "unknown_shard")
+		case errors.Is(err, errStatsFailed):
+			writeError(w, http.StatusInternalServerError, "stats_error")
 		default:
 			writeError(w, http.StatusInternalServerError, "internal_error")
 		}
 		return
 	}
-	shard, ok := a.shardMap[slot.ShardID]
-	if !ok {
-		writeError(w, http.StatusInternalServerError, "unknown_shard")
-		return
-	}
-	_, totals, err := a.store.SlotStats(r.Context())
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "stats_error")
-		return
-	}
 	resp := map[string]any{
 		"status":     "ok",
-		"slotId":     slot.ID,
-		"shardId":    shard.ID,
-		"listenPort": shard.Port,
-		"password":   fmt.Sprintf("%s:%s", a.store.ServerPassword(shard.ID), slot.Password),
-		"method":     a.cfg.Method,
+		"slotId":     alloc.Slot.ID,
+		"shardId":    alloc.Shard.ID,
+		"listenPort": alloc.Shard.Port,
+		"password":   alloc.Connection.Password,
+		"protocol":   alloc.Connection.Protocol,
 		"ip":         a.cfg.PublicIP,
-		"freeSlots":  totals.Free,
+		"freeSlots":  alloc.FreeSlots,
+	}
+	if alloc.Connection.Method != "" {
+		resp["method"] = alloc.Connection.Method
+	}
+	if alloc.Connection.URI != "" {
+		resp["uri"] = alloc.Connection.URI
+	}
+	if alloc.Slot.Metadata != nil {
+		resp["metadata"] = alloc.Slot.Metadata
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
 func (a *Agent) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	a.opLock.RLock()
-	defer a.opLock.RUnlock()
-
 	var req struct {
 		SlotID  int   `json:"slotId"`
 		SlotIDs []int `json:"slotIds"`
@@ -108,95 +115,73 @@ func (a *Agent) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "slot_required")
 		return
 	}
-	for _, id := range targets {
-		err := a.store.ReserveSlot(r.Context(), id)
-		if err != nil {
-			switch {
-			case errors.Is(err, errSlotNotFound):
-				writeError(w, http.StatusNotFound, "slot_not_found")
-			case errors.Is(err, errSlotReserved):
-				writeError(w, http.StatusBadRequest, "already_reserved")
-			case errors.Is(err, errSlotFree):
-				writeError(w, http.StatusBadRequest, "slot_not_in_use")
-			case errors.Is(err, errSlotNotInUse):
-				writeError(w, http.StatusBadRequest, "slot_not_in_use")
-			default:
-				writeError(w, http.StatusInternalServerError, "internal_error")
-			}
-			return
+	if err := a.ReserveSlots(r.Context(), a.callerFromRequest(r), targets); err != nil {
+		switch {
+		case errors.Is(err, errSlotNotFound):
+			writeError(w, http.StatusNotFound, "slot_not_found")
+		case errors.Is(err, errSlotReserved):
+			writeError(w, http.StatusBadRequest, "already_reserved")
+		case errors.Is(err, errSlotFree):
+			writeError(w, http.StatusBadRequest, "slot_not_in_use")
+		case errors.Is(err, errSlotNotInUse):
+			writeError(w, http.StatusBadRequest, "slot_not_in_use")
+		default:
+			writeError(w, http.StatusInternalServerError, "internal_error")
 		}
+		return
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
 func (a *Agent) handleReload(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		ShardID int `json:"shardId"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
-		writeError(w, http.StatusBadRequest, "invalid_json")
-		return
-	}
-	writeJSON(w, http.StatusAccepted, map[string]any{
-		"status":  "accepted",
-		"message": "reload started",
-	})
+	a.handleLegacyJob(w, r, jobReload)
+}
 
-	var target []int
-	if req.ShardID > 0 {
-		target = []int{req.ShardID}
-	}
+func (a *Agent) handleRestart(w http.ResponseWriter, r *http.Request) {
+	a.handleLegacyJob(w, r, jobRestart)
+}
 
-	go func() {
-		processed, err := a.Reload(context.Background(), true, target)
-		if err != nil {
-			log.Printf("async reload failed: %v", err)
-			return
-		}
-		log.Printf("async reload finished: %+v", processed)
-	}()
+func (a *Agent) handleReset(w http.ResponseWriter, r *http.Request) {
+	a.handleLegacyJob(w, r, jobReset)
 }
 
-func (a *Agent) handleRestart(w http.ResponseWriter, r *http.Request) {
+func (a *Agent) handleLegacyJob(w http.ResponseWriter, r *http.Request, jobType string) {
 	var req struct {
 		ShardID int `json:"shardId"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
-		writeError(w, http.StatusBadRequest, "invalid_json")
-		return
+	if jobType != jobReset {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "invalid_json")
+			return
+		}
 	}
-	writeJSON(w, http.StatusAccepted, map[string]any{
-		"status":  "accepted",
-		"message": "restart started",
-	})
-
 	var target []int
 	if req.ShardID > 0 {
 		target = []int{req.ShardID}
 	}
 
-	go func() {
-		processed, err := a.ReloadAndRestart(context.Background(), true, target)
-		if err != nil {
-			log.Printf("async restart failed: %v", err)
-			return
-		}
-		log.Printf("async restart finished: %+v", processed)
-	}()
-}
-
-func (a *Agent) handleReset(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusAccepted, map[string]any{
-		"status":  "accepted",
-		"message": "reset started",
-	})
-	go func() {
-		if err := a.HardReset(context.Background()); err != nil {
-			log.Printf("async reset failed: %v", err)
-			return
-		}
-		log.Printf("async hard reset finished")
-	}()
+	job, err := a.SubmitJob(a.callerFromRequest(r), jobType, target)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusAccepted, map[string]any{
+			"status":  "accepted",
+			"message": jobType + " started",
+			"jobId":   job.ID,
+		})
+	case errors.Is(err, errJobQueued):
+		writeJSON(w, http.StatusAccepted, map[string]any{
+			"status":    "accepted",
+			"message":   jobType + " already queued",
+			"jobId":     job.ID,
+			"coalesced": true,
+		})
+	case errors.Is(err, errTooManyJobs):
+		writeRetryAfter(w, writeError, err.Error(), jobRetryAfter)
+	case errors.Is(err, errUnknownShard):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "internal_error")
+	}
 }
 
 func (a *Agent) handleStats(w http.ResponseWriter, r *http.Request) {
@@ -204,53 +189,67 @@ func (a *Agent) handleStats(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
 		return
 	}
-	if a.cfg.AuthToken != "" {
-		if got := r.Header.Get("X-Auth-Token"); got != a.cfg.AuthToken {
-			writeError(w, http.StatusUnauthorized, "unauthorized")
-			return
-		}
+	if !a.checkAccess(w, r, "stats", writeError) || !a.checkRate(w, r, "stats", writeError) {
+		return
 	}
 
-	a.opLock.RLock()
-	defer a.opLock.RUnlock()
-
-	statsByShard, totals, err := a.store.SlotStats(r.Context())
+	shards, totals, err := a.ShardStats(r.Context())
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "stats_error")
 		return
 	}
-
-	resp := struct {
-		Shards []struct {
-			ID       int `json:"id"`
-			Port     int `json:"port"`
-			Free     int `json:"free"`
-			Used     int `json:"used"`
-			Reserved int `json:"reserved"`
-		} `json:"shards"`
-		Totals SlotCounts `json:"totals"`
+	writeJSON(w, http.StatusOK, struct {
+		Shards []ShardStatus `json:"shards"`
+		Totals SlotCounts    `json:"totals"`
 	}{
+		Shards: shards,
 		Totals: totals,
+	})
+}
+
+func (a *Agent) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	if !a.checkAccess(w, r, "audit", writeError) || !a.checkRate(w, r, "audit", writeError) {
+		return
 	}
 
-	for _, shard := range a.shards {
-		counts := statsByShard[shard.ID]
-		resp.Shards = append(resp.Shards, struct {
-			ID       int `json:"id"`
-			Port     int `json:"port"`
-			Free     int `json:"free"`
-			Used     int `json:"used"`
-			Reserved int `json:"reserved"`
-		}{
-			ID:       shard.ID,
-			Port:     shard.Port,
-			Free:     counts.Free,
-			Used:     counts.Used,
-			Reserved: counts.Reserved,
-		})
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Operation: q.Get("operation"),
+		Actor:     q.Get("actor"),
+		Limit:     100,
+	}
+	var err error
+	parseInt := func(name string, dst *int) {
+		if v := q.Get(name); v != "" && err == nil {
+			*dst, err = strconv.Atoi(v)
+		}
+	}
+	parseTime := func(name string, dst *time.Time) {
+		if v := q.Get(name); v != "" && err == nil {
+			*dst, err = time.Parse(time.RFC3339, v)
+		}
+	}
+	parseInt("slotId", &filter.SlotID)
+	parseInt("shardId", &filter.ShardID)
+	parseInt("limit", &filter.Limit)
+	parseTime("since", &filter.Since)
+	parseTime("until", &filter.Until)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_filter")
+		return
 	}
+	filter.Limit = pageLimit(filter.Limit)
 
-	writeJSON(w, http.StatusOK, resp)
+	entries, err := a.audit.Query(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "audit_error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	jobReload  = "reload"
+	jobRestart = "restart"
+	jobReset   = "reset"
+	// jobRotate replaces the server keys of shards; every client of an
+	// affected Shadowsocks 2022 or REALITY shard needs its new connection.
+	jobRotate = "rotate"
+
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+
+	// jobRetryAfter is suggested to clients rejected because the queue is full.
+	jobRetryAfter = 5 * time.Second
+	// jobHistory is how many finished jobs stay visible in /v1/jobs.
+	jobHistory = 100
+)
+
+var (
+	errJobQueued   = errors.New("job_already_queued")
+	errTooManyJobs = errors.New("too_many_jobs")
+	errJobNotFound = errors.New("job_not_found")
+)
+
+// Job is an asynchronous reload, restart or reset.
+type Job struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Shards     []int       `json:"shards"`
+	Status     string      `json:"status"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+	Rotated    map[int]int `json:"rotated,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type jobFunc func() (map[int]int, error)
+
+// jobQueue runs asynchronous jobs one at a time, caps how many may be in
+// flight, and folds a request into an identical job that has not started yet.
+type jobQueue struct {
+	max    int
+	notify func(eventType string, job Job)
+
+	run     sync.Mutex
+	mu      sync.Mutex
+	pending map[string]*Job
+	jobs    map[string]*Job
+	order   []string
+	active  int
+}
+
+func newJobQueue(max int, notify func(eventType string, job Job)) *jobQueue {
+	return &jobQueue{
+		max:     max,
+		notify:  notify,
+		pending: make(map[string]*Job),
+		jobs:    make(map[string]*Job),
+	}
+}
+
+// Submit schedules fn as a job of jobType over shards. If an identical job is
+// still queued it is returned together with errJobQueued; errTooManyJobs is
+// returned when the queue is full.
+func (q *jobQueue) Submit(jobType string, shards []int, fn jobFunc) (Job, error) {
+	key := fmt.Sprintf("%s:%v", jobType, shards)
+
+	q.mu.Lock()
+	if existing, ok := q.pending[key]; ok {
+		job := existing.snapshot()
+		q.mu.Unlock()
+		return job, errJobQueued
+	}
+	if q.max > 0 && q.active >= q.max {
+		q.mu.Unlock()
+		return Job{}, errTooManyJobs
+	}
+	job := &Job{
+		ID:        newJobID(),
+		Type:      jobType,
+		Shards:    shards,
+		Status:    jobQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	q.pending[key] = job
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	q.active++
+	q.trimLocked()
+	snapshot := job.snapshot()
+	q.mu.Unlock()
+	q.notify(eventJobQueued, snapshot)
+
+	go func() {
+		q.run.Lock()
+		defer q.run.Unlock()
+
+		q.mu.Lock()
+		delete(q.pending, key)
+		started := time.Now().UTC()
+		job.StartedAt = &started
+		job.Status = jobRunning
+		running := job.snapshot()
+		q.mu.Unlock()
+		q.notify(eventJobStarted, running)
+
+		rotated, err := fn()
+
+		q.mu.Lock()
+		finished := time.Now().UTC()
+		job.FinishedAt = &finished
+		job.Rotated = rotated
+		job.Status = jobSucceeded
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+		}
+		q.active--
+		done := job.snapshot()
+		q.mu.Unlock()
+		q.notify(eventJobFinished, done)
+	}()
+	return snapshot, nil
+}
+
+func (q *jobQueue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return job.snapshot(), nil
+}
+
+// List returns known jobs, newest first.
+func (q *jobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.order))
+	for i := len(q.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, q.jobs[q.order[i]].snapshot())
+	}
+	return jobs
+}
+
+// trimLocked forgets the oldest finished jobs beyond jobHistory.
+func (q *jobQueue) trimLocked() {
+	excess := len(q.order) - jobHistory
+	if excess <= 0 {
+		return
+	}
+	kept := q.order[:0]
+	for _, id := range q.order {
+		if excess > 0 && q.jobs[id].FinishedAt != nil {
+			delete(q.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	q.order = kept
+}
+
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Shards = append([]int(nil), j.Shards...)
+	if j.Rotated != nil {
+		c.Rotated = make(map[int]int, len(j.Rotated))
+		for k, v := range j.Rotated {
+			c.Rotated[k] = v
+		}
+	}
+	return c
+}
+
+func newJobID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
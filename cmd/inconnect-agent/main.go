@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,34 +14,31 @@ import (
 	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc"
 )
 
-func main() {
-	cfg := defaultConfig()
-	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	configPathFlag := fs.String("config", "", "Path to YAML or JSON config file")
-	cfg.registerFlags(fs)
-	if err := fs.Parse(os.Args[1:]); err != nil {
-		log.Fatalf("parse flags: %v", err)
-	}
+// version is reported to the control plane; release builds set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
 
-	flagOverrides := captureSetFlags(fs)
+// subcommands run instead of the agent when named as the first argument.
+var subcommands = map[string]func(args []string){
+	"migrate":    runMigrate,
+	"restore":    runRestore,
+	"export":     runExport,
+	"import":     runImport,
+	"genkey":     runGenKey,
+	"controller": runController,
+}
 
-	if configPath := resolveConfigPath(*configPathFlag); configPath != "" {
-		if err := loadConfigFile(configPath, &cfg); err != nil {
-			log.Fatalf("load config %s: %v", configPath, err)
-		}
-		for name, value := range flagOverrides {
-			if name == "config" {
-				continue
-			}
-			if err := fs.Lookup(name).Value.Set(value); err != nil {
-				log.Fatalf("apply flag %s: %v", name, err)
-			}
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
 		}
-		log.Printf("configuration loaded from %s", configPath)
 	}
+	cfg := loadConfig(flag.NewFlagSet(os.Args[0], flag.ExitOnError), os.Args[1:])
 
 	if cfg.PublicIP == "" {
 		if ip, err := detectOutboundIP(); err == nil {
@@ -52,24 +49,27 @@ func main() {
 		}
 	}
 
+	if cfg.ControlPlaneURL != "" && cfg.NodeID == "" {
+		if host, err := os.Hostname(); err == nil {
+			cfg.NodeID = host
+		}
+	}
+
 	if err := cfg.validate(); err != nil {
 		log.Fatalf("invalid configuration: %v", err)
 	}
 	if err := ensureParentDir(cfg.DBPath); err != nil {
 		log.Fatalf("ensure db dir: %v", err)
 	}
-	if err := os.MkdirAll(cfg.ConfigDir, 0o755); err != nil {
+	if err := os.MkdirAll(cfg.ConfigDir, 0o750); err != nil {
 		log.Fatalf("ensure config dir: %v", err)
 	}
 
-	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=1", cfg.DBPath)
-	db, err := sql.Open("sqlite3", dsn)
+	db, err := openDatabase(cfg, false)
 	if err != nil {
 		log.Fatalf("open database: %v", err)
 	}
 	defer db.Close()
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
 
 	shards, err := cfg.BuildShards()
 	if err != nil {
@@ -78,20 +78,53 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	applied, err := migrateSchema(ctx, db)
+	for _, m := range applied {
+		log.Printf("applied schema migration %d: %s", m.Version, m.Description)
+	}
+	if err != nil {
+		log.Fatalf("migrate database: %v", err)
+	}
+	secrets, err := loadSecretBox(cfg)
+	if err != nil {
+		log.Fatalf("load secret key: %v", err)
+	}
 	store := NewSlotStore(db, cfg.AllocStrategy, shards)
+	store.secrets = secrets
+	shards, err = store.LoadShards(ctx, cfg, shards)
+	if err != nil {
+		log.Fatalf("load shards: %v", err)
+	}
 	if err := store.Init(ctx, cfg, shards); err != nil {
 		log.Fatalf("initialize store: %v", err)
 	}
 
+	audit := NewAuditLog(db)
+	if err := audit.Init(ctx, cfg.AuditFile); err != nil {
+		log.Fatalf("initialize audit log: %v", err)
+	}
+	defer audit.Close()
+
 	dockerManager := &DockerManager{
 		Binary: cfg.DockerBinary,
 		Image:  cfg.DockerImage,
 	}
 	cleanupContainers(ctx, dockerManager, cfg, shards)
-	agent := NewAgent(cfg, shards, store, dockerManager)
+	agent := NewAgent(cfg, shards, store, dockerManager, audit)
+
+	webhooks := NewWebhookDispatcher(db, cfg.Webhooks)
+	webhooks.Start(ctx, agent.events)
+	defer webhooks.Close()
 
 	if cfg.ResetOnly {
-		if err := agent.HardReset(ctx); err != nil {
+		err := agent.HardReset(ctx)
+		audit.Record(ctx, AuditEntry{
+			Actor:     actorCLI,
+			Operation: "reset",
+			Shards:    agent.shardIDs(nil),
+			Result:    auditResult(err),
+		})
+		if err != nil {
 			log.Fatalf("hard reset failed: %v", err)
 		}
 		log.Printf("hard reset completed")
@@ -105,12 +138,27 @@ func main() {
 	if cfg.RestartSeconds > 0 {
 		agent.StartAutoRestart(ctx, time.Duration(cfg.RestartSeconds)*time.Second)
 	}
+	if cfg.ReservedCooldownHours > 0 {
+		agent.StartCooldownRelease(ctx, time.Minute)
+	}
+	if cfg.BackupIntervalHours > 0 {
+		agent.StartBackups(ctx, time.Duration(cfg.BackupIntervalHours)*time.Hour)
+	}
 	if cfg.RestartReservedPerShard > 0 {
 		agent.StartAutoRestartOnReserved(ctx, cfg.RestartReservedPerShard, time.Minute)
 	}
 	if len(cfg.RestartAtUTC) > 0 {
 		agent.StartScheduledRestarts(ctx, cfg.RestartAtUTC)
 	}
+	if cfg.databaseURL() != "" {
+		agent.StartSharedReload(ctx, time.Duration(cfg.SharedReloadSeconds)*time.Second)
+	}
+	if cfg.SyncSource != "" {
+		agent.StartSync(ctx, time.Duration(cfg.SyncSeconds)*time.Second)
+	}
+	if cfg.ControlPlaneURL != "" {
+		newControlPlane(agent, cfg.NodeID).Start(ctx)
+	}
 
 	server := &http.Server{
 		Addr:         cfg.ListenAddr,
@@ -120,17 +168,140 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	if cfg.tlsEnabled() {
+		certPath, keyPath := cfg.tlsPaths()
+		if cfg.TLSSelfSigned {
+			if err := ensureSelfSignedCert(certPath, keyPath, tlsHosts(cfg)); err != nil {
+				log.Fatalf("generate self-signed certificate: %v", err)
+			}
+		}
+		certs, err := newCertReloader(certPath, keyPath, cfg.TLSClientCA)
+		if err != nil {
+			log.Fatalf("load tls certificate: %v", err)
+		}
+		server.TLSConfig = certs.TLSConfig()
+		watchCertReload(ctx, certs)
+		log.Printf("tls certificate %s, fingerprint sha256 %s", certPath, certs.Fingerprint())
+		if cfg.TLSClientCA != "" {
+			log.Printf("client certificates required (CA bundle %s)", cfg.TLSClientCA)
+		}
+	}
+
 	go func() {
-		log.Printf("agent HTTP API listening on %s", cfg.ListenAddr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("agent HTTPS API listening on %s", cfg.ListenAddr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("agent HTTP API listening on %s", cfg.ListenAddr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("http server failed: %v", err)
 		}
 	}()
 
-	waitForShutdown(server, cancel)
+	var grpcServer *grpc.Server
+	if cfg.GRPCListen != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCListen)
+		if err != nil {
+			log.Fatalf("grpc listen: %v", err)
+		}
+		grpcServer = newGRPCServer(agent, server.TLSConfig)
+		go func() {
+			log.Printf("agent gRPC API listening on %s", cfg.GRPCListen)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatalf("grpc server failed: %v", err)
+			}
+		}()
+	}
+
+	waitForShutdown(server, grpcServer, cancel)
 }
 
-func waitForShutdown(server *http.Server, cancel context.CancelFunc) {
+// loadConfig parses args into the defaults, then applies the config file
+// with flags given on the command line taking precedence over it.
+func loadConfig(fs *flag.FlagSet, args []string) Config {
+	cfg := defaultConfig()
+	configPathFlag := fs.String("config", "", "Path to YAML or JSON config file")
+	cfg.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("parse flags: %v", err)
+	}
+
+	flagOverrides := captureSetFlags(fs)
+
+	if configPath := resolveConfigPath(*configPathFlag); configPath != "" {
+		if err := loadConfigFile(configPath, &cfg); err != nil {
+			log.Fatalf("load config %s: %v", configPath, err)
+		}
+		for name, value := range flagOverrides {
+			if name == "config" {
+				continue
+			}
+			if err := fs.Lookup(name).Value.Set(value); err != nil {
+				log.Fatalf("apply flag %s: %v", name, err)
+			}
+		}
+		log.Printf("configuration loaded from %s", configPath)
+	}
+	return cfg
+}
+
+// runMigrate implements "inconnect-agent migrate [-dry-run] [flags]": it
+// brings the database schema up to date without starting the agent, or with
+// -dry-run only lists what would be applied.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "List pending migrations without applying them")
+	cfg := loadConfig(fs, args)
+	ctx := context.Background()
+
+	if *dryRun {
+		current := 0
+		// a missing database file is reported as version 0 instead of being
+		// created
+		if _, err := os.Stat(cfg.DBPath); err == nil || cfg.databaseURL() != "" {
+			db, err := openDatabase(cfg, true)
+			if err != nil {
+				log.Fatalf("open database: %v", err)
+			}
+			current, err = schemaVersion(ctx, db)
+			db.Close()
+			if err != nil {
+				log.Fatalf("read schema version: %v", err)
+			}
+		}
+		pending, err := pendingMigrations(current)
+		if err != nil {
+			log.Fatalf("migrate database: %v", err)
+		}
+		fmt.Printf("schema version %d, latest %d\n", current, latestSchemaVersion())
+		for _, m := range pending {
+			fmt.Printf("pending %d: %s\n", m.Version, m.Description)
+		}
+		return
+	}
+
+	if err := ensureParentDir(cfg.DBPath); err != nil {
+		log.Fatalf("ensure db dir: %v", err)
+	}
+	db, err := openDatabase(cfg, false)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	applied, err := migrateSchema(ctx, db)
+	for _, m := range applied {
+		fmt.Printf("applied %d: %s\n", m.Version, m.Description)
+	}
+	if err != nil {
+		log.Fatalf("migrate database: %v", err)
+	}
+	fmt.Printf("schema version %d\n", latestSchemaVersion())
+}
+
+func waitForShutdown(server *http.Server, grpcServer *grpc.Server, cancel context.CancelFunc) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigCh
@@ -140,6 +311,18 @@ func waitForShutdown(server *http.Server, cancel context.CancelFunc) {
 	ctx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelShutdown()
 
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("graceful shutdown failed: %v", err)
 	}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	// maxMetadataSize caps the encoded metadata stored with a slot.
+	maxMetadataSize = 4096
+)
+
+var (
+	errInvalidMetadata    = errors.New("invalid_metadata")
+	errInvalidMetadataKey = errors.New("invalid_metadata_key")
+	metadataKeyPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// encodeMetadata returns the stored form of slot metadata, NULL when empty.
+func encodeMetadata(metadata map[string]any) (any, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	for key := range metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("%w: key %q", errInvalidMetadata, key)
+		}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidMetadata, err)
+	}
+	if len(data) > maxMetadataSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d", errInvalidMetadata, len(data), maxMetadataSize)
+	}
+	return string(data), nil
+}
+
+func decodeMetadata(v sql.NullString) map[string]any {
+	if !v.Valid || v.String == "" {
+		return nil
+	}
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(v.String), &metadata); err != nil {
+		return nil
+	}
+	return metadata
+}
+
+// metadataFilter collects "metadata[<key>]=<value>" query parameters.
+func metadataFilter(query map[string][]string) (map[string]string, error) {
+	var filter map[string]string
+	for name, values := range query {
+		key, ok := strings.CutPrefix(name, "metadata[")
+		if !ok || len(values) == 0 {
+			continue
+		}
+		key, ok = strings.CutSuffix(key, "]")
+		if !ok {
+			return nil, errInvalidMetadataKey
+		}
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, errInvalidMetadataKey
+		}
+		if filter == nil {
+			filter = make(map[string]string)
+		}
+		filter[key] = values[0]
+	}
+	return filter, nil
+}
+
+// metadataString renders a metadata value for filters and templates:
+// strings as is, other values as JSON.
+func metadataString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// emailData is what the client email template is executed against.
+type emailData struct {
+	SlotID   int
+	ShardID  int
+	UserID   string
+	Metadata map[string]any
+}
+
+// Meta returns a metadata value as a string, empty when it is missing.
+func (d emailData) Meta(key string) string {
+	return metadataString(d.Metadata[key])
+}
+
+// emailTemplate names the Xray client of a used slot. Xray keys its traffic
+// counters by this email, so history traffic is queried with it as well.
+type emailTemplate struct {
+	tmpl *template.Template
+}
+
+func parseEmailTemplate(text string) (emailTemplate, error) {
+	if strings.TrimSpace(text) == "" {
+		return emailTemplate{}, nil
+	}
+	tmpl, err := template.New("clientEmail").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return emailTemplate{}, err
+	}
+	t := emailTemplate{tmpl: tmpl}
+	if _, err := t.render(Slot{ID: 1, ShardID: 1}); err != nil {
+		return emailTemplate{}, err
+	}
+	return t, nil
+}
+
+func (t emailTemplate) render(slot Slot) (string, error) {
+	var buf bytes.Buffer
+	err := t.tmpl.Execute(&buf, emailData{
+		SlotID:   slot.ID,
+		ShardID:  slot.ShardID,
+		UserID:   slot.UserID.String,
+		Metadata: slot.Metadata,
+	})
+	return strings.TrimSpace(buf.String()), err
+}
+
+// emails returns the Xray client email of each of a shard's slots by slot
+// ID. Xray needs them unique within the inbound, and merges the traffic of
+// clients sharing one, so a slot whose email another slot also got falls
+// back to "slot-<id>".
+func (t emailTemplate) emails(slots []Slot) map[int]string {
+	emails := make(map[int]string, len(slots))
+	for _, slot := range slots {
+		emails[slot.ID] = t.email(slot)
+	}
+	for {
+		owners := make(map[string]int, len(emails))
+		for _, email := range emails {
+			owners[email]++
+		}
+		changed := false
+		for id, email := range emails {
+			if fallback := fmt.Sprintf("slot-%d", id); owners[email] > 1 && email != fallback {
+				emails[id] = fallback
+				changed = true
+			}
+		}
+		if !changed {
+			return emails
+		}
+	}
+}
+
+// email is the Xray client email of a slot. Without a template, or for slots
+// nobody holds, it is the user ID or "slot-<id>".
+func (t emailTemplate) email(slot Slot) string {
+	if t.tmpl != nil && slot.Status == slotStatusUsed {
+		if email, err := t.render(slot); err == nil && email != "" {
+			return email
+		}
+	}
+	if slot.UserID.Valid && slot.UserID.String != "" {
+		return slot.UserID.String
+	}
+	return fmt.Sprintf("slot-%d", slot.ID)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errInvalidClientKey = errors.New("invalid_client_key")
+
+// methodKeySizes are the key lengths in bytes of the Shadowsocks 2022
+// methods; server PSKs and client keys are base64 of that many bytes.
+var methodKeySizes = map[string]int{
+	"2022-blake3-aes-128-gcm":       16,
+	"2022-blake3-aes-256-gcm":       32,
+	"2022-blake3-chacha20-poly1305": 32,
+}
+
+// legacyMethods are the AEAD methods of Shadowsocks before 2022. They have
+// no server PSK and take any password.
+var legacyMethods = map[string]bool{
+	"aes-128-gcm":             true,
+	"aes-256-gcm":             true,
+	"chacha20-ietf-poly1305":  true,
+	"xchacha20-ietf-poly1305": true,
+}
+
+// validMethod reports whether method is a supported Shadowsocks method.
+func validMethod(method string) bool {
+	_, ok := methodKeySizes[method]
+	return ok || legacyMethods[method]
+}
+
+// generateKey returns a random base64 key of the length method requires,
+// usable as a server PSK or a client key.
+func generateKey(method string) (string, error) {
+	size, ok := methodKeySizes[method]
+	if !ok {
+		return "", fmt.Errorf("unsupported method %q", method)
+	}
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// keyFits reports whether key is base64 of the length method requires.
+func keyFits(method, key string) bool {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == methodKeySizes[method]
+}
+
+// validateMethodKey checks that key is a base64 client key of the length
+// a Shadowsocks 2022 method requires.
+func validateMethodKey(method, key string) error {
+	size := methodKeySizes[method]
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("%w: not base64", errInvalidClientKey)
+	}
+	if len(raw) != size {
+		return fmt.Errorf("%w: %s needs %d bytes, got %d", errInvalidClientKey, method, size, len(raw))
+	}
+	return nil
+}
+
+// checkClientKey checks that key fits the protocol and method of at least
+// one shard.
+func (a *Agent) checkClientKey(key string) error {
+	var err error
+	for _, shard := range a.allShards() {
+		if err = validateClientKey(shard, key); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// rekeySecrets replaces the server keys and slot passwords that do not fit
+// the protocol and method of their shard, as left by a change of either or
+// by older versions that always generated 32-byte keys. Xray rejects such
+// keys, so the users of rekeyed used slots must be handed their new
+// password; their slots are logged.
+func (s *SlotStore) rekeySecrets(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin rekey tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	type secret struct {
+		query  string
+		id     any
+		aad    string
+		shard  ShardDefinition
+		server bool
+		used   bool
+	}
+	var stale []secret
+	collect := func(query, update string, server bool, aad func(id any) string, shard func(id any, column int) int) error {
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				sec     secret
+				value   string
+				shardID int
+			)
+			if err := rows.Scan(&sec.id, &value, &sec.used, &shardID); err != nil {
+				return err
+			}
+			sec.query, sec.aad, sec.server = update, aad(sec.id), server
+			sec.shard = s.shardDef(shard(sec.id, shardID))
+			plain, err := s.secrets.open(value, sec.aad)
+			if err != nil {
+				return err
+			}
+			fits := validateClientKey(sec.shard, plain) == nil
+			if sec.server {
+				fits = serverKeyFits(sec.shard, plain)
+			}
+			if !fits {
+				stale = append(stale, sec)
+			}
+		}
+		return rows.Err()
+	}
+	if err := collect(`SELECT port, password, status = 'used', shard_id FROM slots`, `UPDATE slots SET password = ? WHERE port = ?`, false,
+		func(id any) string { return slotSecretAAD(int(id.(int64))) },
+		func(_ any, column int) int { return column }); err != nil {
+		return fmt.Errorf("read slot passwords: %w", err)
+	}
+	if err := collect(`SELECT key, value, false, 0 FROM metadata WHERE key LIKE 'server_psk%'`, `UPDATE metadata SET value = ? WHERE key = ?`, true,
+		func(id any) string { return metadataSecretAAD(id.(string)) },
+		func(id any, _ int) int {
+			// the legacy key holds the PSK of shard 1
+			shardID, err := strconv.Atoi(strings.TrimPrefix(id.(string), serverPSKPrefix))
+			if err != nil {
+				return 1
+			}
+			return shardID
+		}); err != nil {
+		return fmt.Errorf("read server psks: %w", err)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	var used []int
+	changed := make(map[int]bool)
+	for _, sec := range stale {
+		newKey := newClientKey
+		if sec.server {
+			newKey = newServerKey
+		}
+		key, err := newKey(sec.shard)
+		if err != nil {
+			return err
+		}
+		sealed, err := s.secrets.seal(key, sec.aad)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sec.query, sealed, sec.id); err != nil {
+			return fmt.Errorf("rekey %s: %w", sec.aad, err)
+		}
+		if sec.used {
+			used = append(used, int(sec.id.(int64)))
+		}
+		changed[sec.shard.ID] = true
+	}
+	for id := range changed {
+		if err := bumpShardVersions(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit rekey tx: %w", err)
+	}
+	log.Printf("regenerated %d keys that do not fit the protocol of their shard", len(stale))
+	if len(used) > 0 {
+		sort.Ints(used)
+		log.Printf("WARNING: used slots %v got new passwords; their users must fetch them again", used)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// handleMetrics exposes slot usage and capacity state in the Prometheus text
+// format.
+func (a *Agent) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	if !a.checkAccess(w, r, "stats", writeError) || !a.checkRate(w, r, "stats", writeError) {
+		return
+	}
+	shards, totals, err := a.ShardStats(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "stats_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricHeader(w, "inconnect_slots", "gauge", "Slots by shard and status.")
+	for _, sh := range shards {
+		fmt.Fprintf(w, "inconnect_slots{shard=\"%d\",status=\"free\"} %d\n", sh.ID, sh.Free)
+		fmt.Fprintf(w, "inconnect_slots{shard=\"%d\",status=\"used\"} %d\n", sh.ID, sh.Used)
+		fmt.Fprintf(w, "inconnect_slots{shard=\"%d\",status=\"reserved\"} %d\n", sh.ID, sh.Reserved)
+		fmt.Fprintf(w, "inconnect_slots{shard=\"%d\",status=\"cooldown\"} %d\n", sh.ID, sh.Cooldown)
+	}
+	metricHeader(w, "inconnect_free_slots", "gauge", "Free slots across all shards.")
+	fmt.Fprintf(w, "inconnect_free_slots %d\n", totals.Free)
+	metricHeader(w, "inconnect_capacity_low", "gauge", "1 when free slots are at or below the low watermark.")
+	fmt.Fprintf(w, "inconnect_capacity_low %d\n", boolMetric(a.capacityLow(0)))
+	for _, sh := range shards {
+		fmt.Fprintf(w, "inconnect_capacity_low{shard=\"%d\"} %d\n", sh.ID, boolMetric(a.capacityLow(sh.ID)))
+	}
+	metricHeader(w, "inconnect_shards", "gauge", "Number of shards.")
+	fmt.Fprintf(w, "inconnect_shards %d\n", len(shards))
+	metricHeader(w, "inconnect_shard_expansions_total", "counter", "Shards added by auto-expansion since start.")
+	fmt.Fprintf(w, "inconnect_shard_expansions_total %d\n", a.expansions.Load())
+	if report := a.lastSync.Load(); report != nil {
+		metricHeader(w, "inconnect_sync_drift", "gauge", "Users differing from the desired state at the last sync.")
+		fmt.Fprintf(w, "inconnect_sync_drift{kind=\"missing\"} %d\n", len(report.Missing))
+		fmt.Fprintf(w, "inconnect_sync_drift{kind=\"extra\"} %d\n", len(report.Extra))
+		fmt.Fprintf(w, "inconnect_sync_drift{kind=\"password\"} %d\n", len(report.PasswordMismatch))
+		metricHeader(w, "inconnect_sync_errors", "gauge", "Errors of the last sync.")
+		fmt.Fprintf(w, "inconnect_sync_errors %d\n", len(report.Errors))
+		metricHeader(w, "inconnect_sync_timestamp_seconds", "gauge", "When the last sync finished.")
+		fmt.Fprintf(w, "inconnect_sync_timestamp_seconds %d\n", report.FinishedAt.Unix())
+	}
+}
+
+func metricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolMetric(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const schemaVersionKey = "schema_version"
+
+var errSchemaTooNew = errors.New("schema_too_new")
+
+// migration moves the database schema from Version-1 to Version. Migrations
+// are append-only: once released, a migration is never edited, a new one is
+// added instead.
+type migration struct {
+	Version     int
+	Description string
+	up          func(ctx context.Context, tx *Tx) error
+}
+
+// migrations is the ordered schema history. Databases created before
+// versioning have no schema_version and start from 0, so migrations 1-8 also
+// have to apply cleanly to a database that already has some of their tables
+// or columns.
+var migrations = []migration{
+	{1, "create slots and metadata tables", execSQL(`
+CREATE TABLE IF NOT EXISTS slots (
+    port            INTEGER PRIMARY KEY,
+    password        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    user_id         TEXT,
+    created_at      DATETIME NOT NULL,
+    updated_at      DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS metadata (
+    key         TEXT PRIMARY KEY,
+    value       TEXT NOT NULL,
+    updated_at  DATETIME NOT NULL
+);`)},
+	{2, "add slots.shard_id", addColumn("slots", "shard_id", "INTEGER NOT NULL DEFAULT 1")},
+	{3, "create audit table", execSQL(`
+CREATE TABLE IF NOT EXISTS audit (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME NOT NULL,
+    actor       TEXT NOT NULL,
+    remote_addr TEXT NOT NULL DEFAULT '',
+    operation   TEXT NOT NULL,
+    slots       TEXT NOT NULL DEFAULT '',
+    shards      TEXT NOT NULL DEFAULT '',
+    result      TEXT NOT NULL,
+    detail      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_created_at ON audit (created_at);`)},
+	{4, "create webhook_outbox table", execSQL(`
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    url             TEXT NOT NULL,
+    event_type      TEXT NOT NULL,
+    payload         TEXT NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL,
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      DATETIME NOT NULL,
+    delivered_at    DATETIME,
+    failed_at       DATETIME
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_due ON webhook_outbox (delivered_at, failed_at, next_attempt_at);`)},
+	// shards holds only shards added at runtime by auto-expansion; the
+	// configured ones are rebuilt from the config on every start.
+	{5, "create shards table", execSQL(`
+CREATE TABLE IF NOT EXISTS shards (
+    id          INTEGER PRIMARY KEY,
+    port        INTEGER NOT NULL,
+    slot_count  INTEGER NOT NULL,
+    created_at  DATETIME NOT NULL
+);`)},
+	{6, "add slots.available_at", addColumn("slots", "available_at", "INTEGER NOT NULL DEFAULT 0")},
+	{7, "create slot_assignments table", execSQL(`
+CREATE TABLE IF NOT EXISTS slot_assignments (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    slot_id        INTEGER NOT NULL,
+    shard_id       INTEGER NOT NULL,
+    user_id        TEXT NOT NULL DEFAULT '',
+    allocated_at   TEXT NOT NULL,
+    released_at    TEXT,
+    rotated_at     TEXT,
+    uplink_bytes   INTEGER,
+    downlink_bytes INTEGER
+);
+CREATE INDEX IF NOT EXISTS slot_assignments_slot ON slot_assignments (slot_id, allocated_at);
+CREATE INDEX IF NOT EXISTS slot_assignments_shard ON slot_assignments (shard_id, allocated_at);
+CREATE INDEX IF NOT EXISTS slot_assignments_user ON slot_assignments (user_id);`)},
+	{8, "add slots.metadata", addColumn("slots", "metadata", "TEXT")},
+	// shard_versions tells agents sharing a database which shard configs
+	// another agent changed.
+	{9, "create shard_versions table", execSQL(`
+CREATE TABLE IF NOT EXISTS shard_versions (
+    shard_id    INTEGER PRIMARY KEY,
+    version     INTEGER NOT NULL
+);`)},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func execSQL(statements string) func(context.Context, *Tx) error {
+	return func(ctx context.Context, tx *Tx) error {
+		_, err := tx.ExecContext(ctx, tx.dialect.ddl(statements))
+		return err
+	}
+}
+
+// addColumn skips columns that already exist, which only happens in
+// databases from before versioning.
+func addColumn(table, column, definition string) func(context.Context, *Tx) error {
+	return func(ctx context.Context, tx *Tx) error {
+		var n int
+		if err := tx.QueryRowContext(ctx, tx.dialect.columnQuery(), table, column).Scan(&n); err != nil {
+			return fmt.Errorf("inspect %s: %w", table, err)
+		}
+		if n > 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+tx.dialect.ddl(definition))
+		return err
+	}
+}
+
+// schemaVersion reads the version recorded in metadata; a database without
+// one is version 0.
+func schemaVersion(ctx context.Context, db querier) (int, error) {
+	if ok, err := tableExists(ctx, db, "metadata"); err != nil || !ok {
+		return 0, err
+	}
+	var value string
+	err := db.QueryRowContext(ctx, `SELECT value FROM metadata WHERE key = ?`, schemaVersionKey).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q", value)
+	}
+	return version, nil
+}
+
+func tableExists(ctx context.Context, db querier, name string) (bool, error) {
+	var n int
+	if err := db.QueryRowContext(ctx, db.backend().tableQuery(), name).Scan(&n); err != nil {
+		return false, fmt.Errorf("inspect schema: %w", err)
+	}
+	return n > 0, nil
+}
+
+// pendingMigrations returns the migrations newer than current. A database
+// written by a newer agent is refused rather than guessed at.
+func pendingMigrations(current int) ([]migration, error) {
+	if latest := latestSchemaVersion(); current > latest {
+		return nil, fmt.Errorf("%w: database is at version %d, this agent knows up to %d", errSchemaTooNew, current, latest)
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateSchema applies pending migrations, each in its own transaction
+// together with the version bump, and returns the ones applied.
+func migrateSchema(ctx context.Context, db *DB) ([]migration, error) {
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(current)
+	if err != nil {
+		return nil, err
+	}
+	var applied []migration
+	for _, m := range pending {
+		ok, err := applyMigration(ctx, db, m)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration reports false when another agent sharing the database
+// applied m first.
+func applyMigration(ctx context.Context, db *DB, m migration) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin migration %d: %w", m.Version, err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.dialect.lockSchema(ctx, tx); err != nil {
+		return false, err
+	}
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if current >= m.Version {
+		return false, nil
+	}
+	if err := m.up(ctx, tx); err != nil {
+		return false, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO metadata (key, value, updated_at)
+VALUES (?, ?, ?)
+ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		schemaVersionKey, strconv.Itoa(m.Version), time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return false, fmt.Errorf("record schema version %d: %w", m.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit migration %d: %w", m.Version, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func openTestSQLite(t *testing.T) *DB {
+	t.Helper()
+	db, err := openSQLite(filepath.Join(t.TempDir(), "ports.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// migrateTo applies the migrations up to version, as an agent of that
+// schema version would have left the database.
+func migrateTo(ctx context.Context, db *DB, version int) error {
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if _, err := applyMigration(ctx, db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionsFrom(first int) []int {
+	var versions []int
+	for v := first; v <= latestSchemaVersion(); v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func TestMigrateSchema(t *testing.T) {
+	type testCase struct {
+		name    string
+		setup   func(ctx context.Context, db *DB) error
+		applied []int
+		wantErr error
+	}
+	var tests []testCase
+	for v := 0; v <= latestSchemaVersion(); v++ {
+		v := v
+		tests = append(tests, testCase{
+			name: fmt.Sprintf("from version %d", v),
+			setup: func(ctx context.Context, db *DB) error {
+				if err := migrateTo(ctx, db, v); err != nil {
+					return err
+				}
+				if v == 0 {
+					return nil
+				}
+				_, err := db.ExecContext(ctx, `
+INSERT INTO slots (port, password, status, created_at, updated_at)
+VALUES (50001, 'secret', 'used', '2024-01-01T00:00:00Z', '2024-01-01T00:00:00Z')`)
+				return err
+			},
+			applied: versionsFrom(v + 1),
+		})
+	}
+	tests = append(tests,
+		testCase{
+			// databases from before versioning have the tables of the time
+			// but no schema_version
+			name: "unversioned database",
+			setup: func(ctx context.Context, db *DB) error {
+				_, err := db.ExecContext(ctx, `
+CREATE TABLE slots (
+    port            INTEGER PRIMARY KEY,
+    password        TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    user_id         TEXT,
+    created_at      DATETIME NOT NULL,
+    updated_at      DATETIME NOT NULL,
+    shard_id        INTEGER NOT NULL DEFAULT 1,
+    available_at    INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE metadata (
+    key         TEXT PRIMARY KEY,
+    value       TEXT NOT NULL,
+    updated_at  DATETIME NOT NULL
+);
+INSERT INTO slots (port, password, status, created_at, updated_at)
+VALUES (50001, 'secret', 'used', '2024-01-01T00:00:00Z', '2024-01-01T00:00:00Z');`)
+				return err
+			},
+			applied: versionsFrom(1),
+		},
+		testCase{
+			name: "newer database",
+			setup: func(ctx context.Context, db *DB) error {
+				if err := migrateTo(ctx, db, latestSchemaVersion()); err != nil {
+					return err
+				}
+				_, err := db.ExecContext(ctx, `UPDATE metadata SET value = ? WHERE key = ?`,
+					strconv.Itoa(latestSchemaVersion()+1), schemaVersionKey)
+				return err
+			},
+			wantErr: errSchemaTooNew,
+		},
+	)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := openTestSQLite(t)
+			if err := tt.setup(ctx, db); err != nil {
+				t.Fatalf("setup: %v", err)
+			}
+			_, hadSlot := slotRow(ctx, db)
+
+			applied, err := migrateSchema(ctx, db)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("migrateSchema() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migrateSchema() = %v", err)
+			}
+			var versions []int
+			for _, m := range applied {
+				versions = append(versions, m.Version)
+			}
+			if !reflect.DeepEqual(versions, tt.applied) {
+				t.Fatalf("applied = %v, want %v", versions, tt.applied)
+			}
+			if v, err := schemaVersion(ctx, db); err != nil || v != latestSchemaVersion() {
+				t.Fatalf("schemaVersion() = %d, %v, want %d", v, err, latestSchemaVersion())
+			}
+			for _, table := range []string{"slots", "metadata", "audit", "webhook_outbox", "shards", "slot_assignments", "shard_versions"} {
+				if ok, err := tableExists(ctx, db, table); err != nil || !ok {
+					t.Errorf("table %s missing after migration (%v)", table, err)
+				}
+			}
+			slot, ok := slotRow(ctx, db)
+			if ok != hadSlot {
+				t.Fatalf("slot present = %v after migration, want %v", ok, hadSlot)
+			}
+			if ok && slot != (migratedSlot{password: "secret", shardID: 1}) {
+				t.Errorf("slot after migration = %+v", slot)
+			}
+
+			again, err := migrateSchema(ctx, db)
+			if err != nil || len(again) != 0 {
+				t.Fatalf("second migrateSchema() = %d migrations, %v, want none", len(again), err)
+			}
+		})
+	}
+}
+
+type migratedSlot struct {
+	password    string
+	shardID     int
+	availableAt int64
+	metadata    sql.NullString
+}
+
+// slotRow reads slot 50001 with the columns later migrations added, falling
+// back to the first schema's columns when those do not exist yet.
+func slotRow(ctx context.Context, db *DB) (migratedSlot, bool) {
+	var s migratedSlot
+	err := db.QueryRowContext(ctx, `SELECT password, shard_id, available_at, metadata FROM slots WHERE port = 50001`).
+		Scan(&s.password, &s.shardID, &s.availableAt, &s.metadata)
+	if err == nil {
+		return s, true
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM slots WHERE port = 50001`).Scan(&n); err != nil {
+		return s, false
+	}
+	return s, n > 0
+}
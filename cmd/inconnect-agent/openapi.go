@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildOpenAPI generates an OpenAPI 3 document from the /v1 route table,
+// deriving schemas from the request and response struct types.
+func buildOpenAPI(routes []apiRoute) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+
+	errorRef := schemaRef(reflect.TypeOf(ErrorResponse{}), schemas)
+	for _, route := range routes {
+		op := map[string]any{
+			"summary":     route.Summary,
+			"operationId": operationID(route),
+		}
+		if len(route.Params) > 0 {
+			var params []map[string]any
+			for _, p := range route.Params {
+				param := map[string]any{
+					"name":        p.Name,
+					"in":          p.In,
+					"required":    p.In == "path",
+					"description": p.Description,
+					"schema":      map[string]any{"type": p.Type},
+				}
+				if p.Type == "object" {
+					param["style"] = "deepObject"
+					param["explode"] = true
+					param["schema"] = map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}}
+				}
+				params = append(params, param)
+			}
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemaRef(reflect.TypeOf(route.Request), schemas)},
+				},
+			}
+		}
+		responses := map[string]any{
+			strconv.Itoa(route.Status): map[string]any{
+				"description": http.StatusText(route.Status),
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemaRef(reflect.TypeOf(route.Response), schemas)},
+				},
+			},
+		}
+		for _, status := range append([]int{http.StatusUnauthorized}, route.Errors...) {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status),
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": errorRef},
+				},
+			}
+		}
+		op["responses"] = responses
+		op["security"] = []map[string][]string{{"token": {}}, {"hmac": {}}, {}}
+
+		if paths[route.Path] == nil {
+			paths[route.Path] = map[string]any{}
+		}
+		paths[route.Path][strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "inconnect-agent API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"token": map[string]any{"type": "apiKey", "in": "header", "name": headerAuthToken},
+				"hmac":  map[string]any{"type": "apiKey", "in": "header", "name": headerSignature},
+			},
+		},
+	}
+}
+
+func operationID(route apiRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.Method))
+	for _, part := range strings.Split(strings.Trim(route.Path, "/"), "/") {
+		if part == "v1" {
+			continue
+		}
+		if part == "{id}" {
+			b.WriteString("ById")
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaRef returns a schema for t, registering named structs as components.
+func schemaRef(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // guards against recursion
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		return structSchema(t, schemas)
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaRef(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaRef(t.Elem(), schemas)}
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	props := map[string]any{}
+	var required []string
+	addFields(t, schemas, props, &required)
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func addFields(t reflect.Type, schemas map[string]any, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			addFields(f.Type, schemas, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaRef(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// trafficQueryTimeout bounds the Xray stats query made when a slot is released.
+const trafficQueryTimeout = 5 * time.Second
+
+var (
+	errUnknownShard = errors.New("unknown_shard")
+	errStatsFailed  = errors.New("stats_error")
+	errUnknownJob   = errors.New("unknown_job_type")
+)
+
+// Caller identifies who asked for an operation, for the audit log.
+type Caller struct {
+	Identity   string
+	RemoteAddr string
+}
+
+func (a *Agent) callerFromRequest(r *http.Request) Caller {
+	return Caller{Identity: a.callerIdentity(r), RemoteAddr: r.RemoteAddr}
+}
+
+func (c Caller) audit(operation string) AuditEntry {
+	return AuditEntry{Actor: c.Identity, RemoteAddr: c.RemoteAddr, Operation: operation}
+}
+
+// Allocation is a slot handed to a user with everything a client needs.
+type Allocation struct {
+	Slot       Slot
+	Shard      ShardDefinition
+	Connection *Connection
+	FreeSlots  int
+}
+
+// ShardStatus is a shard together with its slot counts.
+type ShardStatus struct {
+	ID        int    `json:"id"`
+	Port      int    `json:"port"`
+	SlotCount int    `json:"slotCount"`
+	Protocol  string `json:"protocol"`
+	Method    string `json:"method,omitempty"`
+	Network   string `json:"network"`
+	Egress    string `json:"egress,omitempty"`
+	SlotCounts
+}
+
+// AllocateSlot takes a free slot for userID and stores metadata with it.
+// Allocation does not need a reload because every slot is already present in
+// the shard config, unless clientKey is given: the slot then keeps the
+// caller's key, for example of a user moved from another node, on a shard
+// whose protocol takes the key, and its shard is reloaded. If that reload
+// fails the slot is released again.
+func (a *Agent) AllocateSlot(ctx context.Context, caller Caller, userID string, metadata map[string]any, clientKey string) (*Allocation, error) {
+	if clientKey != "" {
+		if err := a.checkClientKey(clientKey); err != nil {
+			return nil, err
+		}
+	}
+	alloc, err := a.allocate(ctx, caller, userID, metadata, clientKey)
+	if err != nil || clientKey == "" {
+		return alloc, err
+	}
+	if _, err := a.Reload(ctx, false, []int{alloc.Shard.ID}); err != nil {
+		log.Printf("apply client key of slot %d: %v", alloc.Slot.ID, err)
+		if releaseErr := a.ReserveSlots(ctx, caller, []int{alloc.Slot.ID}); releaseErr != nil {
+			log.Printf("release slot %d after failed reload: %v", alloc.Slot.ID, releaseErr)
+		}
+		return nil, fmt.Errorf("apply client key: %w", err)
+	}
+	return alloc, nil
+}
+
+// allocate allocates without reloading. With auto-expansion enabled an
+// exhausted pool gets a new shard and the allocation is retried once.
+func (a *Agent) allocate(ctx context.Context, caller Caller, userID string, metadata map[string]any, clientKey string) (*Allocation, error) {
+	alloc, err := a.allocateSlot(ctx, caller, userID, metadata, clientKey)
+	if !errors.Is(err, errNoFreePorts) || !a.cfg.AutoExpand {
+		return alloc, err
+	}
+	expanded, expandErr := a.expandPool(ctx, caller)
+	if expandErr != nil {
+		log.Printf("auto-expand failed: %v", expandErr)
+	}
+	if !expanded {
+		return nil, err
+	}
+	return a.allocateSlot(ctx, caller, userID, metadata, clientKey)
+}
+
+func (a *Agent) allocateSlot(ctx context.Context, caller Caller, userID string, metadata map[string]any, clientKey string) (*Allocation, error) {
+	a.opLock.RLock()
+	defer a.opLock.RUnlock()
+
+	entry := caller.audit("adduser")
+	entry.Detail = "user_id=" + userID
+	if clientKey != "" {
+		entry.Detail += " client_key=supplied"
+	}
+	slot, err := a.store.AllocateSlot(ctx, userID, metadata, clientKey)
+	if err != nil {
+		entry.Result = auditResult(err)
+		a.audit.Record(context.Background(), entry)
+		return nil, err
+	}
+	entry.Slots = []int{slot.ID}
+	entry.Shards = []int{slot.ShardID}
+	entry.Result = "ok"
+	a.audit.Record(context.Background(), entry)
+	a.events.Publish(Event{Type: eventSlotAllocated, SlotID: slot.ID, ShardID: slot.ShardID, UserID: userID})
+
+	shard, ok := a.shardByID(slot.ShardID)
+	if !ok {
+		return nil, errUnknownShard
+	}
+	statsByShard, totals, err := a.store.SlotStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errStatsFailed, err)
+	}
+	a.checkCapacity(statsByShard, totals)
+	return &Allocation{
+		Slot:       *slot,
+		Shard:      shard,
+		Connection: a.connection(shard, *slot),
+		FreeSlots:  totals.Free,
+	}, nil
+}
+
+// ReserveSlots marks used slots as reserved; they get a fresh password at
+// the next reload. It stops at the first slot that cannot be reserved.
+func (a *Agent) ReserveSlots(ctx context.Context, caller Caller, slotIDs []int) error {
+	a.opLock.RLock()
+	defer a.opLock.RUnlock()
+
+	entry := caller.audit("deleteuser")
+	for _, id := range slotIDs {
+		// read the slot first: reserving clears its user_id
+		held, _ := a.store.GetSlot(ctx, id)
+		var traffic *Traffic
+		if held != nil && held.Status == slotStatusUsed {
+			traffic = a.slotTraffic(ctx, *held)
+		}
+		if err := a.store.ReserveSlot(ctx, id, traffic); err != nil {
+			entry.Slots = append(entry.Slots, id)
+			entry.Result = auditResult(err)
+			a.audit.Record(context.Background(), entry)
+			return err
+		}
+		entry.Slots = append(entry.Slots, id)
+		ev := Event{Type: eventSlotReserved, SlotID: id}
+		if held != nil {
+			ev.ShardID = held.ShardID
+			ev.UserID = held.UserID.String
+		}
+		a.events.Publish(ev)
+	}
+	entry.Result = "ok"
+	a.audit.Record(context.Background(), entry)
+	return nil
+}
+
+// SubmitJob queues an asynchronous reload, restart, reset or server key
+// rotation over target (all shards when empty).
+func (a *Agent) SubmitJob(caller Caller, jobType string, target []int) (Job, error) {
+	if _, err := a.shardList(target); err != nil {
+		return Job{}, errUnknownShard
+	}
+	var run jobFunc
+	switch jobType {
+	case jobReload:
+		run = func() (map[int]int, error) { return a.Reload(context.Background(), true, target) }
+	case jobRestart:
+		run = func() (map[int]int, error) { return a.ReloadAndRestart(context.Background(), true, target) }
+	case jobRotate:
+		run = func() (map[int]int, error) { return a.RotateServerKeys(context.Background(), target) }
+	case jobReset:
+		if len(target) > 0 {
+			return Job{}, errUnknownShard
+		}
+		run = func() (map[int]int, error) { return nil, a.HardReset(context.Background()) }
+	default:
+		return Job{}, errUnknownJob
+	}
+
+	entry := caller.audit(jobType)
+	entry.Shards = a.shardIDs(target)
+	return a.jobs.Submit(jobType, entry.Shards, func() (map[int]int, error) {
+		processed, err := run()
+		entry.Result = auditResult(err)
+		entry.Detail = formatProcessed(processed)
+		a.audit.Record(context.Background(), entry)
+		if err != nil {
+			log.Printf("async %s failed: %v", jobType, err)
+			return processed, err
+		}
+		log.Printf("async %s finished: %+v", jobType, processed)
+		return processed, nil
+	})
+}
+
+// ShardStats reports slot counts for every shard and in total.
+func (a *Agent) ShardStats(ctx context.Context) ([]ShardStatus, SlotCounts, error) {
+	a.opLock.RLock()
+	defer a.opLock.RUnlock()
+
+	statsByShard, totals, err := a.store.SlotStats(ctx)
+	if err != nil {
+		return nil, SlotCounts{}, err
+	}
+	defs := a.allShards()
+	shards := make([]ShardStatus, 0, len(defs))
+	for _, shard := range defs {
+		shards = append(shards, ShardStatus{
+			ID:         shard.ID,
+			Port:       shard.Port,
+			SlotCount:  shard.SlotCount,
+			Protocol:   shard.Protocol,
+			Method:     shard.Method,
+			Network:    shard.Network,
+			Egress:     shard.Egress,
+			SlotCounts: statsByShard[shard.ID],
+		})
+	}
+	return shards, totals, nil
+}
+
+// slotTraffic returns the traffic of the user holding slot, or nil when the
+// shard has no stats API or the query fails.
+func (a *Agent) slotTraffic(ctx context.Context, slot Slot) *Traffic {
+	shard, ok := a.shardByID(slot.ShardID)
+	if !ok || shard.APIPort <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, trafficQueryTimeout)
+	defer cancel()
+	traffic, err := a.docker.UserTraffic(ctx, shard, a.clientEmail(slot))
+	if err != nil {
+		log.Printf("slot %d traffic not recorded: %v", slot.ID, err)
+		return nil
+	}
+	return traffic
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadOverlay reads a JSON object to merge into generated Xray configs.
+func loadOverlay(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read overlay: %w", err)
+	}
+	var overlay map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&overlay); err != nil {
+		return nil, fmt.Errorf("parse overlay %s: %w", path, err)
+	}
+	if overlay == nil {
+		return nil, fmt.Errorf("overlay %s is not a JSON object", path)
+	}
+	return overlay, nil
+}
+
+// shardOverlays reads the agent's overlay and then the shard's, in the order
+// they are merged. The files are read at every reload, so an edited overlay
+// takes effect with the next reload.
+func (a *Agent) shardOverlays(shard ShardDefinition) ([]map[string]any, error) {
+	var overlays []map[string]any
+	for _, path := range []string{a.cfg.XrayOverlay, shard.Overlay} {
+		if path == "" {
+			continue
+		}
+		overlay, err := loadOverlay(path)
+		if err != nil {
+			return nil, err
+		}
+		overlays = append(overlays, overlay)
+	}
+	return overlays, nil
+}
+
+// mergeOverlay merges overlay into base: objects key by key, arrays by
+// appending the overlay's elements, anything else by replacing. An array
+// element that is an object with the tag of an element already in base is
+// merged into that element instead, which is how an overlay changes the
+// generated inbound or outbounds. A null in the overlay removes the key.
+func mergeOverlay(base, overlay map[string]any) {
+	for key, value := range overlay {
+		if value == nil {
+			delete(base, key)
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			if existing, ok := base[key].(map[string]any); ok {
+				mergeOverlay(existing, v)
+				continue
+			}
+		case []any:
+			if existing, ok := base[key].([]any); ok {
+				base[key] = mergeOverlayArray(existing, v)
+				continue
+			}
+		}
+		base[key] = value
+	}
+}
+
+func mergeOverlayArray(base, overlay []any) []any {
+	for _, value := range overlay {
+		if element, ok := value.(map[string]any); ok {
+			if existing := elementByTag(base, element["tag"]); existing != nil {
+				mergeOverlay(existing, element)
+				continue
+			}
+		}
+		base = append(base, value)
+	}
+	return base
+}
+
+// elementByTag returns the object in elements tagged tag, if tag is a string.
+func elementByTag(elements []any, tag any) map[string]any {
+	name, ok := tag.(string)
+	if !ok || name == "" {
+		return nil
+	}
+	for _, e := range elements {
+		if obj, ok := e.(map[string]any); ok && obj["tag"] == name {
+			return obj
+		}
+	}
+	return nil
+}
+
+// applyOverlays merges overlays into a generated config and then appends
+// rules to its routing rules, after those of the overlays.
+func applyOverlays(config []byte, overlays []map[string]any, rules []routingRule) ([]byte, error) {
+	var merged map[string]any
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.UseNumber()
+	if err := dec.Decode(&merged); err != nil {
+		return nil, err
+	}
+	for _, overlay := range overlays {
+		mergeOverlay(merged, overlay)
+	}
+	if len(rules) > 0 {
+		routing, ok := merged["routing"].(map[string]any)
+		if !ok {
+			routing = make(map[string]any)
+			merged["routing"] = routing
+		}
+		existing, _ := routing["rules"].([]any)
+		for _, rule := range rules {
+			existing = append(existing, rule)
+		}
+		routing["rules"] = existing
+	}
+	return json.MarshalIndent(merged, "", "  ")
+}
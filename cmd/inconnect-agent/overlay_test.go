@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeJSON[T any](t *testing.T, s string) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("decode %s: %v", s, err)
+	}
+	return v
+}
+
+func TestMergeOverlay(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		want    string
+	}{
+		{
+			name:    "adds keys",
+			base:    `{"log":{"loglevel":"warning"}}`,
+			overlay: `{"dns":{"servers":["1.1.1.1"]}}`,
+			want:    `{"log":{"loglevel":"warning"},"dns":{"servers":["1.1.1.1"]}}`,
+		},
+		{
+			name:    "merges objects key by key",
+			base:    `{"log":{"loglevel":"warning","access":"none"}}`,
+			overlay: `{"log":{"loglevel":"debug"}}`,
+			want:    `{"log":{"loglevel":"debug","access":"none"}}`,
+		},
+		{
+			name:    "replaces scalars",
+			base:    `{"stats":{},"policy":{"levels":{"0":{"handshake":4}}}}`,
+			overlay: `{"policy":{"levels":{"0":{"handshake":8}}}}`,
+			want:    `{"stats":{},"policy":{"levels":{"0":{"handshake":8}}}}`,
+		},
+		{
+			name:    "null removes a key",
+			base:    `{"log":{"loglevel":"warning","access":"none"},"stats":{}}`,
+			overlay: `{"log":{"access":null},"stats":null}`,
+			want:    `{"log":{"loglevel":"warning"}}`,
+		},
+		{
+			name:    "object replaces a non-object",
+			base:    `{"log":"off"}`,
+			overlay: `{"log":{"loglevel":"debug"}}`,
+			want:    `{"log":{"loglevel":"debug"}}`,
+		},
+		{
+			name:    "array replaces a non-array",
+			base:    `{"dns":{"servers":"localhost"}}`,
+			overlay: `{"dns":{"servers":["1.1.1.1"]}}`,
+			want:    `{"dns":{"servers":["1.1.1.1"]}}`,
+		},
+		{
+			name:    "appends untagged array elements",
+			base:    `{"routing":{"rules":[{"outboundTag":"direct"}]}}`,
+			overlay: `{"routing":{"rules":[{"outboundTag":"block","protocol":["bittorrent"]}]}}`,
+			want:    `{"routing":{"rules":[{"outboundTag":"direct"},{"outboundTag":"block","protocol":["bittorrent"]}]}}`,
+		},
+		{
+			name:    "merges into the tagged element",
+			base:    `{"inbounds":[{"tag":"shard-1","port":50001,"protocol":"shadowsocks"}]}`,
+			overlay: `{"inbounds":[{"tag":"shard-1","sniffing":{"enabled":true}}]}`,
+			want:    `{"inbounds":[{"tag":"shard-1","port":50001,"protocol":"shadowsocks","sniffing":{"enabled":true}}]}`,
+		},
+		{
+			name:    "appends elements with a new tag",
+			base:    `{"outbounds":[{"tag":"direct","protocol":"freedom"}]}`,
+			overlay: `{"outbounds":[{"tag":"block","protocol":"blackhole"}]}`,
+			want:    `{"outbounds":[{"tag":"direct","protocol":"freedom"},{"tag":"block","protocol":"blackhole"}]}`,
+		},
+		{
+			name:    "merges tagged elements and appends the rest",
+			base:    `{"outbounds":[{"tag":"direct","protocol":"freedom"},{"tag":"block","protocol":"blackhole"}]}`,
+			overlay: `{"outbounds":[{"tag":"block","settings":{"response":{"type":"http"}}},{"tag":"warp","protocol":"wireguard"},"raw"]}`,
+			want:    `{"outbounds":[{"tag":"direct","protocol":"freedom"},{"tag":"block","protocol":"blackhole","settings":{"response":{"type":"http"}}},{"tag":"warp","protocol":"wireguard"},"raw"]}`,
+		},
+		{
+			name:    "null inside a tagged element removes its key",
+			base:    `{"inbounds":[{"tag":"shard-1","port":50001,"sniffing":{"enabled":true}}]}`,
+			overlay: `{"inbounds":[{"tag":"shard-1","sniffing":null}]}`,
+			want:    `{"inbounds":[{"tag":"shard-1","port":50001}]}`,
+		},
+		{
+			name:    "empty tags are not matched",
+			base:    `{"inbounds":[{"tag":"","port":1}]}`,
+			overlay: `{"inbounds":[{"tag":"","port":2}]}`,
+			want:    `{"inbounds":[{"tag":"","port":1},{"tag":"","port":2}]}`,
+		},
+		{
+			name:    "non-string tags are not matched",
+			base:    `{"inbounds":[{"tag":1,"port":1}]}`,
+			overlay: `{"inbounds":[{"tag":1,"port":2}]}`,
+			want:    `{"inbounds":[{"tag":1,"port":1},{"tag":1,"port":2}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := decodeJSON[map[string]any](t, tt.base)
+			mergeOverlay(base, decodeJSON[map[string]any](t, tt.overlay))
+			if want := decodeJSON[map[string]any](t, tt.want); !reflect.DeepEqual(base, want) {
+				got, _ := json.Marshal(base)
+				t.Fatalf("merged = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeOverlayArray(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		want    string
+	}{
+		{
+			name:    "empty overlay",
+			base:    `[{"tag":"a"}]`,
+			overlay: `[]`,
+			want:    `[{"tag":"a"}]`,
+		},
+		{
+			name:    "empty base",
+			base:    `[]`,
+			overlay: `[{"tag":"a"},1]`,
+			want:    `[{"tag":"a"},1]`,
+		},
+		{
+			name:    "scalars are appended",
+			base:    `["a"]`,
+			overlay: `["a","b"]`,
+			want:    `["a","a","b"]`,
+		},
+		{
+			name:    "same tag twice merges twice",
+			base:    `[{"tag":"a","x":1}]`,
+			overlay: `[{"tag":"a","y":2},{"tag":"a","x":3}]`,
+			want:    `[{"tag":"a","x":3,"y":2}]`,
+		},
+		{
+			name:    "untagged objects are appended",
+			base:    `[{"x":1}]`,
+			overlay: `[{"x":1}]`,
+			want:    `[{"x":1},{"x":1}]`,
+		},
+		{
+			name:    "later element merges into an appended one",
+			base:    `[]`,
+			overlay: `[{"tag":"a","x":1},{"tag":"a","y":2}]`,
+			want:    `[{"tag":"a","x":1,"y":2}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeOverlayArray(decodeJSON[[]any](t, tt.base), decodeJSON[[]any](t, tt.overlay))
+			if want := decodeJSON[[]any](t, tt.want); !reflect.DeepEqual(got, want) {
+				out, _ := json.Marshal(got)
+				t.Fatalf("merged = %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Inbound protocols a shard can serve. Every slot of a shard holds one
+// client credential: a Shadowsocks key or password, a UUID for VLESS and
+// VMess, a password for Trojan.
+const (
+	protocolShadowsocks = "shadowsocks"
+	protocolVLESS       = "vless"
+	protocolVMess       = "vmess"
+	protocolTrojan      = "trojan"
+)
+
+const (
+	// vlessFlow is the flow of VLESS clients, the one REALITY is meant for.
+	vlessFlow = "xtls-rprx-vision"
+	// realityFingerprint is the TLS fingerprint client URIs ask for.
+	realityFingerprint = "chrome"
+	// minClientPassword and maxClientPassword bound Trojan and legacy
+	// Shadowsocks passwords.
+	minClientPassword = 8
+	maxClientPassword = 128
+)
+
+var validProtocols = map[string]bool{
+	protocolShadowsocks: true,
+	protocolVLESS:       true,
+	protocolVMess:       true,
+	protocolTrojan:      true,
+}
+
+// usesReality reports whether the shard's inbound is secured with REALITY;
+// its server key is then the REALITY private key.
+func (sh ShardDefinition) usesReality() bool {
+	return sh.Protocol == protocolVLESS || sh.Protocol == protocolTrojan
+}
+
+// ss2022 reports whether the shard is Shadowsocks 2022, the only protocol
+// with a server PSK in the client password.
+func (sh ShardDefinition) ss2022() bool {
+	_, ok := methodKeySizes[sh.Method]
+	return sh.Protocol == protocolShadowsocks && ok
+}
+
+// newClientKey returns a fresh client credential for a slot of the shard.
+func newClientKey(sh ShardDefinition) (string, error) {
+	switch {
+	case sh.Protocol == protocolVLESS, sh.Protocol == protocolVMess:
+		return newUUID()
+	case sh.ss2022():
+		return generateKey(sh.Method)
+	default:
+		return randomPassword()
+	}
+}
+
+// validateClientKey checks that key is a credential the shard's protocol
+// accepts.
+func validateClientKey(sh ShardDefinition, key string) error {
+	switch {
+	case sh.Protocol == protocolVLESS, sh.Protocol == protocolVMess:
+		if !validUUID(key) {
+			return fmt.Errorf("%w: %s needs a UUID", errInvalidClientKey, sh.Protocol)
+		}
+		return nil
+	case sh.ss2022():
+		return validateMethodKey(sh.Method, key)
+	default:
+		if len(key) < minClientPassword || len(key) > maxClientPassword {
+			return fmt.Errorf("%w: password must have %d to %d characters", errInvalidClientKey, minClientPassword, maxClientPassword)
+		}
+		for _, c := range key {
+			if c <= ' ' || c > '~' {
+				return fmt.Errorf("%w: password must be printable ASCII without spaces", errInvalidClientKey)
+			}
+		}
+		return nil
+	}
+}
+
+// keyShards returns the shards a client key may be placed on. Passwords take
+// any key, so when the key is a UUID or a Shadowsocks 2022 key fitting some
+// shard only the shards of that kind are taken.
+func keyShards(defs map[int]ShardDefinition, key string) map[int]bool {
+	strict := make(map[int]bool)
+	loose := make(map[int]bool)
+	for id, sh := range defs {
+		if validateClientKey(sh, key) != nil {
+			continue
+		}
+		loose[id] = true
+		if sh.Protocol == protocolVLESS || sh.Protocol == protocolVMess || sh.ss2022() {
+			strict[id] = true
+		}
+	}
+	if len(strict) > 0 {
+		return strict
+	}
+	return loose
+}
+
+// newServerKey returns a fresh server key for the shard: the PSK for
+// Shadowsocks 2022, the REALITY private key for VLESS and Trojan. Other
+// protocols do not use it, but every shard keeps one.
+func newServerKey(sh ShardDefinition) (string, error) {
+	switch {
+	case sh.usesReality():
+		return newRealityKey()
+	case sh.ss2022():
+		return generateKey(sh.Method)
+	default:
+		return randomPassword()
+	}
+}
+
+func serverKeyFits(sh ShardDefinition, key string) bool {
+	switch {
+	case sh.usesReality():
+		raw, err := base64.RawURLEncoding.DecodeString(key)
+		return err == nil && len(raw) == 32
+	case sh.ss2022():
+		return keyFits(sh.Method, key)
+	default:
+		return key != ""
+	}
+}
+
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+func validUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// randomPassword returns 24 URL-safe characters.
+func randomPassword() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newRealityKey returns an X25519 private key clamped and encoded the way
+// "xray x25519" prints it.
+func newRealityKey() (string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("read random bytes: %w", err)
+	}
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return base64.RawURLEncoding.EncodeToString(key[:]), nil
+}
+
+// realityPublicKey derives the public key clients need from the private key.
+func realityPublicKey(privateKey string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// realityShortID derives the shard's short ID from its private key, so it
+// changes together with the key and needs no storage of its own.
+func realityShortID(privateKey string) string {
+	sum := sha256.Sum256([]byte(privateKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// realityDest is where REALITY forwards connections that do not
+// authenticate: Dest, or port 443 of the server name.
+func (sh ShardDefinition) realityDest() string {
+	if sh.Dest != "" {
+		return sh.Dest
+	}
+	return net.JoinHostPort(sh.ServerName, "443")
+}
+
+// clientPassword is the password a client of the slot configures: the
+// server PSK and the client key for Shadowsocks 2022, the credential alone
+// otherwise.
+func clientPassword(sh ShardDefinition, serverKey, clientKey string) string {
+	if sh.ss2022() {
+		return serverKey + ":" + clientKey
+	}
+	return clientKey
+}
+
+// clientURI is the share link of a slot in the form clients import: SIP002
+// for Shadowsocks, the Xray share links for VLESS and Trojan and the v2rayN
+// JSON link for VMess.
+func clientURI(sh ShardDefinition, ip, serverKey, clientKey, name string) (string, error) {
+	host := net.JoinHostPort(ip, strconv.Itoa(sh.Port))
+	fragment := "#" + url.PathEscape(name)
+	switch sh.Protocol {
+	case protocolVLESS, protocolTrojan:
+		publicKey, err := realityPublicKey(serverKey)
+		if err != nil {
+			return "", fmt.Errorf("reality public key: %w", err)
+		}
+		q := url.Values{}
+		q.Set("security", "reality")
+		q.Set("sni", sh.ServerName)
+		q.Set("fp", realityFingerprint)
+		q.Set("pbk", publicKey)
+		q.Set("sid", realityShortID(serverKey))
+		q.Set("type", "tcp")
+		if sh.Protocol == protocolVLESS {
+			q.Set("encryption", "none")
+			q.Set("flow", vlessFlow)
+		}
+		return sh.Protocol + "://" + url.QueryEscape(clientKey) + "@" + host + "?" + q.Encode() + fragment, nil
+	case protocolVMess:
+		link, err := json.Marshal(map[string]string{
+			"v":    "2",
+			"ps":   name,
+			"add":  ip,
+			"port": strconv.Itoa(sh.Port),
+			"id":   clientKey,
+			"aid":  "0",
+			"scy":  "auto",
+			"net":  "tcp",
+			"type": "none",
+		})
+		if err != nil {
+			return "", err
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(link), nil
+	default:
+		password := clientPassword(sh, serverKey, clientKey)
+		if sh.ss2022() {
+			// SIP002 leaves the user info of 2022 methods unencoded
+			return "ss://" + sh.Method + ":" + url.QueryEscape(password) + "@" + host + fragment, nil
+		}
+		userInfo := base64.RawURLEncoding.EncodeToString([]byte(sh.Method + ":" + password))
+		return "ss://" + userInfo + "@" + host + fragment, nil
+	}
+}
+
+// connection describes how a client reaches slot on shard.
+func (a *Agent) connection(shard ShardDefinition, slot Slot) *Connection {
+	serverKey := a.store.ServerPassword(shard.ID)
+	conn := &Connection{
+		IP:       a.cfg.PublicIP,
+		Port:     shard.Port,
+		Protocol: shard.Protocol,
+		Method:   shard.Method,
+		Password: clientPassword(shard, serverKey, slot.Password),
+	}
+	uri, err := clientURI(shard, a.cfg.PublicIP, serverKey, slot.Password, fmt.Sprintf("slot-%d", slot.ID))
+	if err != nil {
+		log.Printf("client uri of slot %d: %v", slot.ID, err)
+	}
+	conn.URI = uri
+	return conn
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: Rate tokens per second, up to Burst.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// EndpointLimits are the buckets applied to one endpoint, keyed by caller
+// credential (see rateKey) and by client IP.
+type EndpointLimits struct {
+	PerToken RateLimit `yaml:"perToken"`
+	PerIP    RateLimit `yaml:"perIP"`
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+func (l RateLimit) validate() error {
+	if l.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	if l.Rate > 0 && l.Burst <= 0 {
+		return errors.New("burst must be positive")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per key for a single RateLimit.
+type rateLimiter struct {
+	limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	lastGC  time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token for key. When none is available it returns false and
+// how long until one will be.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(l.limit.Burst)
+	if now.Sub(l.lastGC) > 10*time.Minute {
+		// buckets that have refilled completely carry no state worth keeping
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastGC = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+type endpointLimiter struct {
+	perToken *rateLimiter
+	perIP    *rateLimiter
+}
+
+func newEndpointLimiters(cfg map[string]EndpointLimits) map[string]endpointLimiter {
+	limiters := make(map[string]endpointLimiter, len(cfg))
+	for endpoint, limits := range cfg {
+		var el endpointLimiter
+		if limits.PerToken.enabled() {
+			el.perToken = newRateLimiter(limits.PerToken)
+		}
+		if limits.PerIP.enabled() {
+			el.perIP = newRateLimiter(limits.PerIP)
+		}
+		limiters[endpoint] = el
+	}
+	return limiters
+}
+
+// checkRate applies the endpoint's rate limits and answers 429 with
+// Retry-After when the caller is over budget.
+func (a *Agent) checkRate(w http.ResponseWriter, r *http.Request, endpoint string, writeErr errorWriter) bool {
+	if allowed, wait := a.allowRate(r, endpoint); !allowed {
+		writeRetryAfter(w, writeErr, "rate_limited", wait)
+		return false
+	}
+	return true
+}
+
+// allowRate takes a token from the endpoint's per-token and per-IP buckets.
+func (a *Agent) allowRate(r *http.Request, endpoint string) (bool, time.Duration) {
+	el, ok := a.limiters[endpoint]
+	if !ok {
+		return true, 0
+	}
+	if el.perToken != nil {
+		if allowed, wait := el.perToken.Allow(a.rateKey(r)); !allowed {
+			return false, wait
+		}
+	}
+	if el.perIP != nil {
+		if allowed, wait := el.perIP.Allow(remoteIP(r)); !allowed {
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// rateKey names the credential of a request for the per-token buckets: the
+// certificate CN, or a hash of the token or HMAC secret, so that no secret
+// is kept in the limiter. Unauthenticated requests are keyed by IP.
+func (a *Agent) rateKey(r *http.Request) string {
+	if cn, ok := clientCertName(r.TLS); ok {
+		return "cert:" + cn
+	}
+	if a.cfg.HMACSecret != "" && r.Header.Get(headerSignature) != "" {
+		return "hmac:" + credentialHash(a.cfg.HMACSecret)
+	}
+	if token := r.Header.Get(headerAuthToken); a.cfg.AuthToken != "" && token != "" {
+		return "token:" + credentialHash(token)
+	}
+	return "ip:" + remoteIP(r)
+}
+
+func credentialHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeRetryAfter(w http.ResponseWriter, writeErr errorWriter, code string, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeErr(w, http.StatusTooManyRequests, code)
+}
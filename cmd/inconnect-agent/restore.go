@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// stateExportFormat is bumped when the export layout changes incompatibly.
+const stateExportFormat = 1
+
+// StateExport is the portable form of the slots and server PSKs of a node.
+type StateExport struct {
+	Format        int             `json:"format"`
+	ExportedAt    time.Time       `json:"exportedAt"`
+	SchemaVersion int             `json:"schemaVersion"`
+	Shards        []ExportedShard `json:"shards"`
+	Slots         []ExportedSlot  `json:"slots"`
+}
+
+type ExportedShard struct {
+	ID        int    `json:"id"`
+	Port      int    `json:"port"`
+	SlotCount int    `json:"slotCount"`
+	ServerPSK string `json:"serverPsk"`
+	// Added marks shards created by auto-expansion rather than the config.
+	Added bool `json:"added,omitempty"`
+}
+
+type ExportedSlot struct {
+	ID          int            `json:"id"`
+	ShardID     int            `json:"shardId"`
+	Password    string         `json:"password"`
+	Status      string         `json:"status"`
+	UserID      string         `json:"userId,omitempty"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
+	AvailableAt *time.Time     `json:"availableAt,omitempty"`
+}
+
+// stateLayout loads the shards db was built for: the configured ones plus
+// those it added by auto-expansion.
+func stateLayout(ctx context.Context, db *DB, cfg Config) ([]ShardDefinition, error) {
+	configured, err := cfg.BuildShards()
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard configuration: %w", err)
+	}
+	if ok, err := tableExists(ctx, db, "shards"); err != nil || !ok {
+		return configured, err
+	}
+	return NewSlotStore(db, cfg.AllocStrategy, configured).LoadShards(ctx, cfg, configured)
+}
+
+// validateState checks that db is intact, not newer than this agent, and
+// holds exactly the slots and server PSKs of the shard layout. All problems
+// are reported together.
+func validateState(ctx context.Context, db *DB, shards []ShardDefinition) error {
+	var integrity string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("integrity check: %s", integrity)
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if _, err := pendingMigrations(version); err != nil {
+		return err
+	}
+
+	type shardSlots struct{ count, first, last int }
+	found := make(map[int]shardSlots)
+	rows, err := db.QueryContext(ctx, `SELECT shard_id, COUNT(*), MIN(port), MAX(port) FROM slots GROUP BY shard_id`)
+	if err != nil {
+		return fmt.Errorf("count slots: %w", err)
+	}
+	for rows.Next() {
+		var id int
+		var s shardSlots
+		if err := rows.Scan(&id, &s.count, &s.first, &s.last); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan slot counts: %w", err)
+		}
+		found[id] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate slot counts: %w", err)
+	}
+
+	var problems []string
+	offset := 0
+	for _, sh := range shards {
+		want := shardSlots{count: sh.SlotCount, first: offset + 1, last: offset + sh.SlotCount}
+		offset += sh.SlotCount
+		if got := found[sh.ID]; got != want {
+			problems = append(problems, fmt.Sprintf("shard %d: want slots %d-%d, found %d slots (%d-%d)",
+				sh.ID, want.first, want.last, got.count, got.first, got.last))
+		}
+		delete(found, sh.ID)
+		if psk, err := readServerPSK(ctx, db, sh.ID); err != nil {
+			return err
+		} else if psk == "" {
+			problems = append(problems, fmt.Sprintf("shard %d: server PSK missing", sh.ID))
+		}
+	}
+	for id, got := range found {
+		problems = append(problems, fmt.Sprintf("%d slots belong to unknown shard %d", got.count, id))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("state does not match the shard layout:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func readServerPSK(ctx context.Context, db *DB, shardID int) (string, error) {
+	keys := []any{fmt.Sprintf("%s%d", serverPSKPrefix, shardID)}
+	if shardID == 1 {
+		keys = append(keys, legacyServerPSKKey)
+	}
+	for _, key := range keys {
+		var value string
+		err := db.QueryRowContext(ctx, `SELECT value FROM metadata WHERE key = ?`, key).Scan(&value)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("read server psk: %w", err)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// runRestore implements "inconnect-agent restore -from <backup> [flags]".
+// The agent must be stopped. The backup is validated against the shard
+// layout of the current config before the database file is replaced; the
+// replaced database is kept next to it. Only SQLite databases are restored
+// this way; PostgreSQL has its own tools.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := fs.String("from", "", "Backup file to restore")
+	cfg := loadConfig(fs, args)
+	if *from == "" {
+		log.Fatalf("restore: -from is required")
+	}
+	if cfg.databaseURL() != "" {
+		log.Fatalf("restore: the agent uses PostgreSQL; restore it with pg_restore")
+	}
+	ctx := context.Background()
+
+	backup, err := openSQLite(*from, true)
+	if err != nil {
+		log.Fatalf("open backup: %v", err)
+	}
+	shards, err := stateLayout(ctx, backup, cfg)
+	if err == nil {
+		err = validateState(ctx, backup, shards)
+	}
+	backup.Close()
+	if err != nil {
+		log.Fatalf("backup %s rejected: %v", *from, err)
+	}
+
+	if _, err := os.Stat(cfg.DBPath); err == nil {
+		saved := fmt.Sprintf("%s.pre-restore-%s", cfg.DBPath, time.Now().UTC().Format(backupTimeFormat))
+		if err := snapshotDB(ctx, cfg.DBPath, saved); err != nil {
+			log.Fatalf("save current database: %v", err)
+		}
+		fmt.Printf("current database saved to %s\n", saved)
+	}
+	tmp := cfg.DBPath + ".restore"
+	if err := copyFile(*from, tmp); err != nil {
+		log.Fatalf("copy backup: %v", err)
+	}
+	// stale WAL files would be replayed over the restored database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(cfg.DBPath + suffix); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("remove %s: %v", cfg.DBPath+suffix, err)
+		}
+	}
+	if err := os.Rename(tmp, cfg.DBPath); err != nil {
+		log.Fatalf("replace database: %v", err)
+	}
+	fmt.Printf("restored %s from %s (%d shards)\n", cfg.DBPath, *from, len(shards))
+}
+
+// snapshotDB copies the database at path to dst, through SQLite when the
+// database is readable and as plain files when it is not.
+func snapshotDB(ctx context.Context, path, dst string) error {
+	db, err := openSQLite(path, false)
+	if err == nil {
+		_, err = db.ExecContext(ctx, `VACUUM INTO ?`, dst)
+		db.Close()
+	}
+	if err == nil {
+		return nil
+	}
+	log.Printf("vacuum into %s failed (%v), copying files", dst, err)
+	for _, suffix := range []string{"", "-wal"} {
+		if err := copyFile(path+suffix, dst+suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// runExport implements "inconnect-agent export [-out file] [flags]". It only
+// reads the database and may run while the agent is serving.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "", "Output file (default stdout)")
+	cfg := loadConfig(fs, args)
+	ctx := context.Background()
+
+	db, err := openDatabase(cfg, true)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	secrets, err := loadSecretBox(cfg)
+	if err != nil {
+		log.Fatalf("load secret key: %v", err)
+	}
+	export, err := exportState(ctx, &SlotStore{db: db, secrets: secrets}, cfg)
+	if err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		log.Fatalf("encode export: %v", err)
+	}
+	data = append(data, '\n')
+	if *out == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*out, data, 0o600); err != nil {
+		log.Fatalf("write export: %v", err)
+	}
+	log.Printf("exported %d shards and %d slots to %s", len(export.Shards), len(export.Slots), *out)
+}
+
+// exportState reads the state through store so that encrypted passwords and
+// PSKs are exported in plaintext.
+func exportState(ctx context.Context, store *SlotStore, cfg Config) (*StateExport, error) {
+	configured, err := cfg.BuildShards()
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard configuration: %w", err)
+	}
+	// read everything in one transaction so the export is consistent
+	tx, err := store.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin export tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	export := &StateExport{Format: stateExportFormat, ExportedAt: time.Now().UTC()}
+	var version string
+	if err := tx.QueryRowContext(ctx, `SELECT value FROM metadata WHERE key = ?`, schemaVersionKey).Scan(&version); err == nil {
+		fmt.Sscan(version, &export.SchemaVersion)
+	}
+
+	psks := make(map[string]string)
+	rows, err := tx.QueryContext(ctx, `SELECT key, value FROM metadata WHERE key LIKE 'server_psk%'`)
+	if err != nil {
+		return nil, fmt.Errorf("read server psks: %w", err)
+	}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan server psk: %w", err)
+		}
+		if psks[key], err = store.secrets.open(value, metadataSecretAAD(key)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+
+	shardPSK := func(id int) string {
+		if psk := psks[fmt.Sprintf("%s%d", serverPSKPrefix, id)]; psk != "" || id != 1 {
+			return psk
+		}
+		return psks[legacyServerPSKKey]
+	}
+	for _, sh := range configured {
+		export.Shards = append(export.Shards, ExportedShard{ID: sh.ID, Port: sh.Port, SlotCount: sh.SlotCount, ServerPSK: shardPSK(sh.ID)})
+	}
+	rows, err = tx.QueryContext(ctx, `SELECT id, port, slot_count FROM shards ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select shards: %w", err)
+	}
+	for rows.Next() {
+		sh := ExportedShard{Added: true}
+		if err := rows.Scan(&sh.ID, &sh.Port, &sh.SlotCount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan shard: %w", err)
+		}
+		sh.ServerPSK = shardPSK(sh.ID)
+		export.Shards = append(export.Shards, sh)
+	}
+	rows.Close()
+
+	rows, err = tx.QueryContext(ctx, `SELECT `+slotColumns+` FROM slots ORDER BY port`)
+	if err != nil {
+		return nil, fmt.Errorf("select slots: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		slot, err := store.scanSlot(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("scan slot: %w", err)
+		}
+		es := ExportedSlot{
+			ID:       slot.ID,
+			ShardID:  slot.ShardID,
+			Password: slot.Password,
+			Status:   slot.Status,
+			UserID:   slot.UserID.String,
+			Metadata: slot.Metadata,
+		}
+		if !slot.AvailableAt.IsZero() {
+			availableAt := slot.AvailableAt
+			es.AvailableAt = &availableAt
+		}
+		export.Slots = append(export.Slots, es)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate slots: %w", err)
+	}
+	return export, nil
+}
+
+// runImport implements "inconnect-agent import -in file [-force] [flags]".
+// The agent must be stopped. The export must describe the same shards as
+// the config (IDs, ports and slot counts), so clients keep working on the
+// new host. A database that already has used slots is only overwritten with
+// -force; either way a SQLite database is copied first (back up PostgreSQL
+// with pg_dump).
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "", "Export file to import")
+	force := fs.Bool("force", false, "Overwrite a database that has used slots")
+	cfg := loadConfig(fs, args)
+	if *in == "" {
+		log.Fatalf("import: -in is required")
+	}
+	ctx := context.Background()
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatalf("read export: %v", err)
+	}
+	var export StateExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		log.Fatalf("decode export: %v", err)
+	}
+	configured, err := cfg.BuildShards()
+	if err != nil {
+		log.Fatalf("invalid shard configuration: %v", err)
+	}
+	if err := export.validate(configured); err != nil {
+		log.Fatalf("export %s rejected: %v", *in, err)
+	}
+
+	if err := ensureParentDir(cfg.DBPath); err != nil {
+		log.Fatalf("ensure db dir: %v", err)
+	}
+	_, statErr := os.Stat(cfg.DBPath)
+	existed := statErr == nil
+	db, err := openDatabase(cfg, false)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	secrets, err := loadSecretBox(cfg)
+	if err != nil {
+		log.Fatalf("load secret key: %v", err)
+	}
+	if _, err := migrateSchema(ctx, db); err != nil {
+		log.Fatalf("migrate database: %v", err)
+	}
+	if !*force {
+		var used int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM slots WHERE status != ?`, slotStatusFree).Scan(&used); err != nil {
+			log.Fatalf("inspect database: %v", err)
+		}
+		if used > 0 {
+			log.Fatalf("database has %d slots that are not free; use -force to overwrite it", used)
+		}
+	}
+	if existed && db.isSQLite() {
+		saved := fmt.Sprintf("%s.pre-import-%s", cfg.DBPath, time.Now().UTC().Format(backupTimeFormat))
+		if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, saved); err != nil {
+			log.Fatalf("save current database: %v", err)
+		}
+		fmt.Printf("current database saved to %s\n", saved)
+	}
+	if err := importState(ctx, db, secrets, &export); err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	fmt.Printf("imported %d shards and %d slots into %s\n", len(export.Shards), len(export.Slots), cfg.DBPath)
+}
+
+// validate checks that the export matches the configured shards and that
+// its added shards and slots are consistent with each other.
+func (e *StateExport) validate(configured []ShardDefinition) error {
+	if e.Format != stateExportFormat {
+		return fmt.Errorf("unsupported export format %d", e.Format)
+	}
+	var problems []string
+	var exported []ExportedShard
+	layout := append([]ShardDefinition(nil), configured...)
+	for i, sh := range e.Shards {
+		if !sh.Added {
+			exported = append(exported, sh)
+			if i > len(exported)-1 {
+				problems = append(problems, fmt.Sprintf("shard %d: configured shards must precede added ones", sh.ID))
+			}
+		} else {
+			def := ShardDefinition{ID: sh.ID, Port: sh.Port, SlotCount: sh.SlotCount}
+			if shardConflict(layout, def) {
+				problems = append(problems, fmt.Sprintf("added shard %d (port %d) conflicts with configured shards", sh.ID, sh.Port))
+			}
+			layout = append(layout, def)
+		}
+		if sh.ServerPSK == "" {
+			problems = append(problems, fmt.Sprintf("shard %d: server PSK missing", sh.ID))
+		}
+	}
+	if len(exported) != len(configured) {
+		problems = append(problems, fmt.Sprintf("export has %d configured shards, config has %d", len(exported), len(configured)))
+	} else {
+		for i, sh := range configured {
+			if got := exported[i]; got.ID != sh.ID || got.Port != sh.Port || got.SlotCount != sh.SlotCount {
+				problems = append(problems, fmt.Sprintf("shard %d: export has port %d with %d slots, config has shard %d on port %d with %d slots",
+					got.ID, got.Port, got.SlotCount, sh.ID, sh.Port, sh.SlotCount))
+			}
+		}
+	}
+
+	offset := 0
+	slots := make(map[int]ExportedSlot, len(e.Slots))
+	for _, s := range e.Slots {
+		slots[s.ID] = s
+	}
+	for _, sh := range e.Shards {
+		for id := offset + 1; id <= offset+sh.SlotCount; id++ {
+			s, ok := slots[id]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("slot %d missing", id))
+			case s.ShardID != sh.ID:
+				problems = append(problems, fmt.Sprintf("slot %d: belongs to shard %d, want %d", id, s.ShardID, sh.ID))
+			case s.Password == "":
+				problems = append(problems, fmt.Sprintf("slot %d: password missing", id))
+			}
+			switch s.Status {
+			case slotStatusFree, slotStatusUsed, slotStatusReserved, slotStatusCooldown:
+			default:
+				if ok {
+					problems = append(problems, fmt.Sprintf("slot %d: unknown status %q", id, s.Status))
+				}
+			}
+			delete(slots, id)
+		}
+		offset += sh.SlotCount
+	}
+	for id := range slots {
+		problems = append(problems, fmt.Sprintf("slot %d is outside every shard", id))
+	}
+	if len(problems) > 0 {
+		if len(problems) > 20 {
+			problems = append(problems[:20], fmt.Sprintf("... and %d more", len(problems)-20))
+		}
+		return fmt.Errorf("export does not match the shard layout:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// importState replaces slots, server PSKs and added shards in one
+// transaction. Open history entries are closed and imported used slots
+// start new ones. Passwords and PSKs are sealed with secrets.
+func importState(ctx context.Context, db *DB, secrets *secretBox, e *StateExport) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin import tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	ts := now.Format(time.RFC3339Nano)
+	if err := closeAssignments(ctx, tx, now); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`DELETE FROM slots`,
+		`DELETE FROM shards`,
+		`DELETE FROM metadata WHERE key LIKE 'server_psk_shard_%' OR key = 'server_psk'`,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("clear state: %w", err)
+		}
+	}
+	for _, sh := range e.Shards {
+		if sh.Added {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO shards (id, port, slot_count, created_at) VALUES (?, ?, ?, ?)`,
+				sh.ID, sh.Port, sh.SlotCount, ts); err != nil {
+				return fmt.Errorf("insert shard %d: %w", sh.ID, err)
+			}
+		}
+		key := fmt.Sprintf("%s%d", serverPSKPrefix, sh.ID)
+		psk, err := secrets.seal(sh.ServerPSK, metadataSecretAAD(key))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO metadata (key, value, updated_at) VALUES (?, ?, ?)`,
+			key, psk, ts); err != nil {
+			return fmt.Errorf("insert server psk of shard %d: %w", sh.ID, err)
+		}
+		if err := bumpShardVersions(ctx, tx, sh.ID); err != nil {
+			return err
+		}
+	}
+	for _, s := range e.Slots {
+		metadata, err := encodeMetadata(s.Metadata)
+		if err != nil {
+			return fmt.Errorf("slot %d: %w", s.ID, err)
+		}
+		var userID any
+		if s.UserID != "" {
+			userID = s.UserID
+		}
+		var availableAt int64
+		if s.AvailableAt != nil {
+			availableAt = s.AvailableAt.Unix()
+		}
+		password, err := secrets.seal(s.Password, slotSecretAAD(s.ID))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO slots (port, password, status, user_id, created_at, updated_at, shard_id, available_at, metadata)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			s.ID, password, s.Status, userID, ts, ts, s.ShardID, availableAt, metadata); err != nil {
+			return fmt.Errorf("insert slot %d: %w", s.ID, err)
+		}
+		if s.Status == slotStatusUsed {
+			slot := &Slot{ID: s.ID, ShardID: s.ShardID, UserID: sql.NullString{String: s.UserID, Valid: s.UserID != ""}}
+			if err := recordAllocation(ctx, tx, slot, now); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit import tx: %w", err)
+	}
+	return nil
+}
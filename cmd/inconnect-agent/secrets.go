@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// sealedPrefix marks an encrypted value: enc:v1:<key id>:<base64 nonce+ciphertext>.
+	sealedPrefix  = "enc:v1:"
+	secretKeyEnv  = "INCONNECT_SECRET_KEY"
+	secretKeySize = 32
+)
+
+var (
+	errSecretKeyMissing = errors.New("database holds encrypted secrets but no secret key is configured")
+	errUnknownSecretKey = errors.New("secret encrypted with an unknown key")
+)
+
+// secretBox encrypts the passwords and PSKs kept in the database with
+// AES-256-GCM. The first key seals new values; the others only open values
+// sealed before a rotation. Each value is bound to where it is stored, so a
+// ciphertext copied to another row does not decrypt.
+type secretBox struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// loadSecretBox reads the key ring from the configured file or, failing
+// that, from INCONNECT_SECRET_KEY. It returns nil when neither is set and
+// secrets are stored in plaintext.
+func loadSecretBox(cfg Config) (*secretBox, error) {
+	var data []byte
+	switch {
+	case cfg.SecretKeyFile != "":
+		st, err := os.Stat(cfg.SecretKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("secret key file: %w", err)
+		}
+		if st.Mode().Perm()&0o077 != 0 {
+			return nil, fmt.Errorf("secret key file %s must not be accessible by group or others (mode %v)", cfg.SecretKeyFile, st.Mode().Perm())
+		}
+		if data, err = os.ReadFile(cfg.SecretKeyFile); err != nil {
+			return nil, fmt.Errorf("secret key file: %w", err)
+		}
+	case os.Getenv(secretKeyEnv) != "":
+		data = []byte(strings.ReplaceAll(os.Getenv(secretKeyEnv), ",", "\n"))
+	default:
+		return nil, nil
+	}
+	return parseSecretKeys(data)
+}
+
+// parseSecretKeys reads one key per line as "<id>:<base64 key>", or a single
+// bare base64 key whose ID is "default". Blank lines and lines starting with
+// # are ignored.
+func parseSecretKeys(data []byte) (*secretBox, error) {
+	box := &secretBox{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok {
+			id, encoded = "default", line
+		}
+		id = strings.TrimSpace(id)
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid secret key id %q", id)
+		}
+		if _, dup := box.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate secret key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != secretKeySize {
+			return nil, fmt.Errorf("secret key %q must be %d bytes of base64", id, secretKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if box.primary == "" {
+			box.primary = id
+		}
+		box.keys[id] = aead
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if box.primary == "" {
+		return nil, errors.New("no secret keys found")
+	}
+	return box, nil
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// sealedKey returns the ID of the key value was sealed with, empty for
+// plaintext.
+func sealedKey(value string) string {
+	if !isSealed(value) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, sealedPrefix), ":")
+	return id
+}
+
+// seal encrypts value for the location named by aad. Without a box values
+// are stored as is.
+func (b *secretBox) seal(value, aad string) (string, error) {
+	if b == nil {
+		return value, nil
+	}
+	aead := b.keys[b.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("read nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(aad))
+	return sealedPrefix + b.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a stored value. Plaintext passes through, so databases
+// written before encryption was enabled stay readable until re-sealed.
+func (b *secretBox) open(stored, aad string) (string, error) {
+	if !isSealed(stored) {
+		return stored, nil
+	}
+	if b == nil {
+		return "", errSecretKeyMissing
+	}
+	id, encoded, _ := strings.Cut(strings.TrimPrefix(stored, sealedPrefix), ":")
+	aead, ok := b.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w %q", errUnknownSecretKey, id)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed secret for %s", aad)
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret for %s: %w", aad, err)
+	}
+	return string(plain), nil
+}
+
+// current reports whether stored is already sealed with the primary key, or
+// is plaintext with encryption disabled.
+func (b *secretBox) current(stored string) bool {
+	if b == nil {
+		return !isSealed(stored)
+	}
+	return sealedKey(stored) == b.primary
+}
+
+// resealSecrets encrypts plaintext secrets and re-encrypts those sealed with
+// an older key, so after a rotation the old key can be dropped from the key
+// file once the agent has started with the new one. It fails when secrets
+// are encrypted but no key is configured.
+func (s *SlotStore) resealSecrets(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin reseal tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	type secret struct {
+		query string
+		id    any
+		aad   string
+		value string
+	}
+	var stale []secret
+	collect := func(query, update string, aad func(id any) string) error {
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var sec secret
+			if err := rows.Scan(&sec.id, &sec.value); err != nil {
+				return err
+			}
+			if s.secrets.current(sec.value) {
+				continue
+			}
+			sec.query, sec.aad = update, aad(sec.id)
+			stale = append(stale, sec)
+		}
+		return rows.Err()
+	}
+	if err := collect(`SELECT port, password FROM slots`, `UPDATE slots SET password = ? WHERE port = ?`,
+		func(id any) string { return slotSecretAAD(int(id.(int64))) }); err != nil {
+		return 0, fmt.Errorf("read slot passwords: %w", err)
+	}
+	if err := collect(`SELECT key, value FROM metadata WHERE key LIKE 'server_psk%'`, `UPDATE metadata SET value = ? WHERE key = ?`,
+		func(id any) string { return metadataSecretAAD(id.(string)) }); err != nil {
+		return 0, fmt.Errorf("read server psks: %w", err)
+	}
+
+	for _, sec := range stale {
+		plain, err := s.secrets.open(sec.value, sec.aad)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := s.secrets.seal(plain, sec.aad)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, sec.query, sealed, sec.id); err != nil {
+			return 0, fmt.Errorf("reseal %s: %w", sec.aad, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit reseal tx: %w", err)
+	}
+	return len(stale), nil
+}
+
+func slotSecretAAD(slotID int) string {
+	return fmt.Sprintf("slots/%d", slotID)
+}
+
+func metadataSecretAAD(key string) string {
+	return "metadata/" + key
+}
+
+// generateSecretKey returns a new key line for a key file.
+func generateSecretKey(id string) (string, error) {
+	key := make([]byte, secretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// runGenKey implements "inconnect-agent genkey [-id name]": it prints a key
+// line to put at the top of the secret key file.
+func runGenKey(args []string) {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	id := fs.String("id", "", "Key ID (default: k<current date>)")
+	fs.Parse(args)
+	if *id == "" {
+		*id = "k" + time.Now().UTC().Format("20060102")
+	}
+	if strings.Contains(*id, ":") {
+		log.Fatalf("genkey: invalid key id %q", *id)
+	}
+	line, err := generateSecretKey(*id)
+	if err != nil {
+		log.Fatalf("genkey: %v", err)
+	}
+	fmt.Println(line)
+}
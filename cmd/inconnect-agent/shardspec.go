@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Transports a shard's inbound accepts.
+const (
+	networkTCP  = "tcp"
+	networkUDP  = "udp"
+	networkBoth = "both"
+)
+
+// ShardSpec is a shard as written in the config. Empty settings take
+// Shadowsocks with the agent-wide method, dockerImage, both networks and all
+// host addresses.
+type ShardSpec struct {
+	Port       int    `yaml:"port"`
+	Slots      int    `yaml:"slots"`
+	Protocol   string `yaml:"protocol"`
+	Method     string `yaml:"method"`
+	Network    string `yaml:"network"`
+	ServerName string `yaml:"sni"`
+	Dest       string `yaml:"dest"`
+	Listen     string `yaml:"listen"`
+	Image      string `yaml:"image"`
+	Overlay    string `yaml:"overlay"`
+	Egress     string `yaml:"egress"`
+}
+
+func (sp ShardSpec) validate() error {
+	if sp.Port <= 0 || sp.Port > 65535 {
+		return fmt.Errorf("invalid port %d", sp.Port)
+	}
+	if sp.Slots <= 0 {
+		return fmt.Errorf("shard slots must be positive for port %d", sp.Port)
+	}
+	if sp.Protocol != "" && !validProtocols[sp.Protocol] {
+		return fmt.Errorf("unsupported protocol %q, expected shadowsocks, vless, vmess or trojan", sp.Protocol)
+	}
+	shadowsocks := sp.Protocol == "" || sp.Protocol == protocolShadowsocks
+	if sp.Method != "" && !shadowsocks {
+		return fmt.Errorf("method is only set for shadowsocks, not %s", sp.Protocol)
+	}
+	if sp.Method != "" && !validMethod(sp.Method) {
+		return fmt.Errorf("unsupported method %q", sp.Method)
+	}
+	switch sp.Network {
+	case "", networkTCP:
+	case networkUDP, networkBoth:
+		if !shadowsocks {
+			return fmt.Errorf("%s only runs over tcp", sp.Protocol)
+		}
+	default:
+		return fmt.Errorf("invalid network %q, expected tcp, udp or both", sp.Network)
+	}
+	reality := sp.Protocol == protocolVLESS || sp.Protocol == protocolTrojan
+	if reality && sp.ServerName == "" {
+		return fmt.Errorf("%s needs sni, the server name REALITY borrows", sp.Protocol)
+	}
+	if !reality && (sp.ServerName != "" || sp.Dest != "") {
+		return errors.New("sni and dest are only set for vless and trojan")
+	}
+	if sp.Dest != "" {
+		if _, _, err := net.SplitHostPort(sp.Dest); err != nil {
+			return fmt.Errorf("invalid dest %q: %w", sp.Dest, err)
+		}
+	}
+	if sp.Listen != "" && net.ParseIP(sp.Listen) == nil {
+		return fmt.Errorf("invalid listen address %q", sp.Listen)
+	}
+	if sp.Overlay != "" {
+		if _, err := loadOverlay(sp.Overlay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardSpecs is the shards setting. The -shards flag and a YAML string use
+// the form port:slots[;key=value...],... with the keys of ShardSpec; YAML
+// also takes a list of ShardSpec.
+type shardSpecs []ShardSpec
+
+func (s *shardSpecs) String() string {
+	if s == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*s))
+	for _, sp := range *s {
+		part := fmt.Sprintf("%d:%d", sp.Port, sp.Slots)
+		for _, kv := range [][2]string{
+			{"protocol", sp.Protocol}, {"method", sp.Method}, {"network", sp.Network},
+			{"sni", sp.ServerName}, {"dest", sp.Dest}, {"listen", sp.Listen}, {"image", sp.Image}, {"overlay", sp.Overlay}, {"egress", sp.Egress},
+		} {
+			if kv[1] != "" {
+				part += ";" + kv[0] + "=" + kv[1]
+			}
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *shardSpecs) Set(raw string) error {
+	if strings.TrimSpace(raw) == "" {
+		*s = nil
+		return nil
+	}
+	var specs shardSpecs
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ";")
+		sub := strings.Split(fields[0], ":")
+		if len(sub) != 2 {
+			return fmt.Errorf("invalid shard format %q, expected port:slots", part)
+		}
+		var (
+			sp  ShardSpec
+			err error
+		)
+		if sp.Port, err = strconv.Atoi(sub[0]); err != nil {
+			return fmt.Errorf("invalid shard port %q: %w", sub[0], err)
+		}
+		if sp.Slots, err = strconv.Atoi(sub[1]); err != nil {
+			return fmt.Errorf("invalid shard slot count %q: %w", sub[1], err)
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok {
+				return fmt.Errorf("invalid shard setting %q in %q, expected key=value", field, part)
+			}
+			switch key {
+			case "protocol":
+				sp.Protocol = value
+			case "method":
+				sp.Method = value
+			case "network":
+				sp.Network = value
+			case "sni":
+				sp.ServerName = value
+			case "dest":
+				sp.Dest = value
+			case "listen":
+				sp.Listen = value
+			case "image":
+				sp.Image = value
+			case "overlay":
+				sp.Overlay = value
+			case "egress":
+				sp.Egress = value
+			default:
+				return fmt.Errorf("unknown shard setting %q in %q", key, part)
+			}
+		}
+		specs = append(specs, sp)
+	}
+	if len(specs) == 0 {
+		return errors.New("no valid shard definitions provided")
+	}
+	*s = specs
+	return nil
+}
+
+// UnmarshalYAML accepts both the string form and a list.
+func (s *shardSpecs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return s.Set(node.Value)
+	}
+	var specs []ShardSpec
+	if err := node.Decode(&specs); err != nil {
+		return err
+	}
+	*s = specs
+	return nil
+}
+
+// xrayNetwork is the inbound network setting for a shard network.
+func xrayNetwork(network string) string {
+	switch network {
+	case networkTCP, networkUDP:
+		return network
+	default:
+		return "tcp,udp"
+	}
+}
+
+// publishedProtocols are the protocols Docker publishes for a shard network;
+// only Shadowsocks shards use UDP.
+func publishedProtocols(network string) []string {
+	switch network {
+	case networkTCP, networkUDP:
+		return []string{network}
+	default:
+		return []string{networkTCP, networkUDP}
+	}
+}
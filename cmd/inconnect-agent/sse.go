@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseKeepAlive is how often an idle stream gets a comment line, so proxies
+// do not time out the connection.
+const sseKeepAlive = 15 * time.Second
+
+// handleEvents streams agent events as Server-Sent Events. The optional
+// types query parameter is a comma-separated list of event types to send.
+func (a *Agent) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	if !a.checkAccess(w, r, "stats", writeError) || !a.checkRate(w, r, "stats", writeError) {
+		return
+	}
+	wanted := map[string]bool{}
+	if raw := r.URL.Query().Get("types"); raw != "" {
+		for _, t := range strings.Split(raw, ",") {
+			t = strings.TrimSpace(t)
+			if !knownEventType(t) {
+				writeError(w, http.StatusBadRequest, "unknown_event_type")
+				return
+			}
+			wanted[t] = true
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	// the stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeError(w, http.StatusInternalServerError, "streaming_unsupported")
+		return
+	}
+
+	events, unsubscribe := a.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if len(wanted) > 0 && !wanted[ev.Type] {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
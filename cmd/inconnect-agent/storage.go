@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+	databaseURLEnv  = "INCONNECT_DATABASE_URL"
+	// postgresMaxConns bounds the pool of one agent; allocation holds a
+	// connection only for the length of its transaction.
+	postgresMaxConns = 10
+	// migrationLockID is the advisory lock taken by PostgreSQL migrations so
+	// that agents starting together apply each migration once.
+	migrationLockID = 7303145
+)
+
+var errBackupUnsupported = errors.New("backup_unsupported")
+
+// DB is the agent database. Queries throughout the agent are written for
+// SQLite with "?" placeholders; DB and Tx rewrite them for the backend in
+// use, and the statements that cannot be shared come from the dialect.
+type DB struct {
+	*sql.DB
+	dialect dialect
+}
+
+// Tx is a transaction on a DB.
+type Tx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+// querier is implemented by both *DB and *Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	backend() dialect
+}
+
+// dialect is what differs between the supported databases.
+type dialect interface {
+	// name is "sqlite" or "postgres".
+	name() string
+	// rebind rewrites "?" placeholders into the backend's syntax.
+	rebind(query string) string
+	// ddl adapts schema statements written for SQLite.
+	ddl(statements string) string
+	// tableQuery counts tables named by its argument; columnQuery counts
+	// columns named by its second argument in the table named by the first.
+	tableQuery() string
+	columnQuery() string
+	// jsonText returns an expression reading key of a JSON object column as
+	// text, and the argument to bind to its placeholder.
+	jsonText(column, key string) (string, any)
+	// lockTxOptions are the options of transactions that pick rows to
+	// update, and skipLocked the clause appended to the SELECT that picks
+	// them. SQLite runs such transactions serializably on its single
+	// connection; PostgreSQL locks the chosen rows and lets concurrent
+	// agents skip past them.
+	lockTxOptions() *sql.TxOptions
+	skipLocked() string
+	// lockSchema serializes migrations between agents sharing a database.
+	lockSchema(ctx context.Context, tx *Tx) error
+}
+
+// openDatabase opens the PostgreSQL database when a database URL is
+// configured and the SQLite file at DBPath otherwise.
+func openDatabase(cfg Config, readOnly bool) (*DB, error) {
+	url := cfg.databaseURL()
+	if url == "" {
+		return openSQLite(cfg.DBPath, readOnly)
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(postgresMaxConns)
+	db.SetMaxIdleConns(postgresMaxConns)
+	return &DB{DB: db, dialect: postgresDialect{}}, nil
+}
+
+// openSQLite opens a SQLite database file. The agent uses a single
+// connection, so a transaction must not be interleaved with other queries.
+func openSQLite(path string, readOnly bool) (*DB, error) {
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=1", path)
+	if readOnly {
+		dsn = fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", path)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	return &DB{DB: db, dialect: sqliteDialect{}}, nil
+}
+
+func (c Config) databaseURL() string {
+	if c.DatabaseURL != "" {
+		return c.DatabaseURL
+	}
+	return os.Getenv(databaseURLEnv)
+}
+
+func (db *DB) backend() dialect { return db.dialect }
+
+func (db *DB) isSQLite() bool { return db.dialect.name() == backendSQLite }
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.dialect}, nil
+}
+
+func (tx *Tx) backend() dialect { return tx.dialect }
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string                 { return backendSQLite }
+func (sqliteDialect) rebind(query string) string   { return query }
+func (sqliteDialect) ddl(statements string) string { return statements }
+
+func (sqliteDialect) tableQuery() string {
+	return `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+}
+
+func (sqliteDialect) columnQuery() string {
+	return `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+}
+
+func (sqliteDialect) jsonText(column, key string) (string, any) {
+	return `CAST(json_extract(` + column + `, ?) AS TEXT)`, `$."` + key + `"`
+}
+
+func (sqliteDialect) lockTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: sql.LevelSerializable}
+}
+
+func (sqliteDialect) skipLocked() string { return "" }
+
+func (sqliteDialect) lockSchema(context.Context, *Tx) error { return nil }
+
+type postgresDialect struct{}
+
+func (postgresDialect) name() string { return backendPostgres }
+
+// rebind numbers the placeholders as $1, $2, ... leaving quoted text alone.
+func (postgresDialect) rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// postgresTypes maps the SQLite column types used by the migrations. Times
+// stay text so that they compare the same way on both backends, and integers
+// are widened since SQLite integers are 64-bit.
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"DATETIME", "TEXT",
+	"INTEGER", "BIGINT",
+)
+
+func (postgresDialect) ddl(statements string) string {
+	return postgresTypes.Replace(statements)
+}
+
+func (postgresDialect) tableQuery() string {
+	return `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`
+}
+
+func (postgresDialect) columnQuery() string {
+	return `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`
+}
+
+func (postgresDialect) jsonText(column, key string) (string, any) {
+	return `(CAST(` + column + ` AS JSONB) ->> CAST(? AS TEXT))`, key
+}
+
+func (postgresDialect) lockTxOptions() *sql.TxOptions { return nil }
+
+func (postgresDialect) skipLocked() string { return " FOR UPDATE SKIP LOCKED" }
+
+func (postgresDialect) lockSchema(ctx context.Context, tx *Tx) error {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(`+strconv.Itoa(migrationLockID)+`)`); err != nil {
+		return fmt.Errorf("lock schema: %w", err)
+	}
+	return nil
+}
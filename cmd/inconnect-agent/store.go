@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 )
 
@@ -14,6 +14,7 @@ const (
 	slotStatusFree     = "free"
 	slotStatusUsed     = "used"
 	slotStatusReserved = "reserved"
+	slotStatusCooldown = "cooldown"
 	serverPSKPrefix    = "server_psk_shard_"
 	legacyServerPSKKey = "server_psk"
 )
@@ -24,48 +25,66 @@ var (
 	errSlotNotInUse = errors.New("slot_not_used")
 	errSlotReserved = errors.New("slot_reserved")
 	errSlotFree     = errors.New("slot_free")
-	schemaStatement = `
-CREATE TABLE IF NOT EXISTS slots (
-    port            INTEGER PRIMARY KEY,
-    password        TEXT NOT NULL,
-    status          TEXT NOT NULL,
-    user_id         TEXT,
-    created_at      DATETIME NOT NULL,
-    updated_at      DATETIME NOT NULL,
-    shard_id        INTEGER NOT NULL DEFAULT 1
-);`
-	metadataSchema = `
-CREATE TABLE IF NOT EXISTS metadata (
-    key         TEXT PRIMARY KEY,
-    value       TEXT NOT NULL,
-    updated_at  DATETIME NOT NULL
-);`
 )
 
 // Slot represents a single allocation entry.
 type Slot struct {
-	ID       int
-	ShardID  int
-	Password string
-	Status   string
-	UserID   sql.NullString
+	ID        int
+	ShardID   int
+	Password  string
+	Status    string
+	UserID    sql.NullString
+	UpdatedAt time.Time
+	// AvailableAt is when a slot in cooldown may be allocated again.
+	AvailableAt time.Time
+	// Metadata is the free-form object supplied with the allocation.
+	Metadata map[string]any
+}
+
+// SlotFilter narrows ListSlots; zero values match everything.
+type SlotFilter struct {
+	Status  string
+	ShardID int
+	UserID  string
+	// Metadata matches top-level metadata keys against string or number
+	// values.
+	Metadata map[string]string
+	Limit    int
+	Offset   int
 }
 
 type SlotCounts struct {
 	Free     int `json:"free"`
 	Used     int `json:"used"`
 	Reserved int `json:"reserved"`
+	Cooldown int `json:"cooldown"`
 }
 
 type SlotStore struct {
-	db              *sql.DB
+	db *DB
+	// serverPasswords caches the server key of each shard; another agent of
+	// a shared database may replace a key, so reloads refresh it.
+	pskMu           sync.RWMutex
 	serverPasswords map[int]string
 	allocStrategy   string
-	lastShardIndex  int
-	shardOrder      []int
+	// orderMu guards the shard layout and the round-robin position, which
+	// concurrent allocations on PostgreSQL read and advance in parallel.
+	orderMu        sync.Mutex
+	lastShardIndex int
+	shardOrder     []int
+	// cooldown keeps a released slot out of allocation for this long after
+	// its reservation.
+	cooldown time.Duration
+	// secrets encrypts slot passwords and server PSKs; nil stores them in
+	// plaintext.
+	secrets *secretBox
+	// method is the agent-wide Shadowsocks method and defs the shards by
+	// ID; keys are generated for the protocol and method of their shard.
+	method string
+	defs   map[int]ShardDefinition
 }
 
-func NewSlotStore(db *sql.DB, strategy string, shards []ShardDefinition) *SlotStore {
+func NewSlotStore(db *DB, strategy string, shards []ShardDefinition) *SlotStore {
 	order := make([]int, len(shards))
 	for i, sh := range shards {
 		order[i] = sh.ID
@@ -75,17 +94,24 @@ func NewSlotStore(db *sql.DB, strategy string, shards []ShardDefinition) *SlotSt
 		serverPasswords: make(map[int]string),
 		allocStrategy:   strategy,
 		shardOrder:      order,
+		defs:            shardDefs(shards),
 	}
 }
 
+// Init fills in missing slots and server PSKs. The schema must already be
+// migrated.
 func (s *SlotStore) Init(ctx context.Context, cfg Config, shards []ShardDefinition) error {
-	if _, err := s.db.ExecContext(ctx, schemaStatement); err != nil {
-		return fmt.Errorf("create schema: %w", err)
+	s.cooldown = time.Duration(cfg.ReservedCooldownHours) * time.Hour
+	s.method = cfg.Method
+	s.setShardOrder(shards)
+	resealed, err := s.resealSecrets(ctx)
+	if err != nil {
+		return err
 	}
-	if _, err := s.db.ExecContext(ctx, metadataSchema); err != nil {
-		return fmt.Errorf("create metadata schema: %w", err)
+	if resealed > 0 {
+		log.Printf("re-encrypted %d stored secrets", resealed)
 	}
-	if err := s.ensureShardColumn(ctx); err != nil {
+	if err := s.rekeySecrets(ctx); err != nil {
 		return err
 	}
 	if err := s.ensureSlots(ctx, shards); err != nil {
@@ -94,78 +120,187 @@ func (s *SlotStore) Init(ctx context.Context, cfg Config, shards []ShardDefiniti
 	return s.ensureServerPasswords(ctx, shards)
 }
 
-func (s *SlotStore) ensureShardColumn(ctx context.Context) error {
-	rows, err := s.db.QueryContext(ctx, `PRAGMA table_info(slots)`)
+// LoadShards appends the shards added by auto-expansion to the configured
+// ones. Added shards whose ID or port is now taken by the config are skipped.
+func (s *SlotStore) LoadShards(ctx context.Context, cfg Config, configured []ShardDefinition) ([]ShardDefinition, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, port, slot_count FROM shards ORDER BY id`)
 	if err != nil {
-		return fmt.Errorf("table info: %w", err)
+		return nil, fmt.Errorf("select shards: %w", err)
 	}
 	defer rows.Close()
+
+	shards := append([]ShardDefinition(nil), configured...)
+	// added shards copy the last configured one, as when they were added
+	model := cfg.newShard(0, 0, 0)
+	if len(configured) > 0 {
+		model = configured[len(configured)-1]
+	}
 	for rows.Next() {
-		var cid int
-		var name, ctype string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
-			return fmt.Errorf("scan table info: %w", err)
+		var id, port, slots int
+		if err := rows.Scan(&id, &port, &slots); err != nil {
+			return nil, fmt.Errorf("scan shard: %w", err)
 		}
-		if name == "shard_id" {
-			return nil
+		sh := cfg.expandedShard(model, id, port, slots)
+		if shardConflict(shards, sh) {
+			log.Printf("skipping added shard %d (port %d): conflicts with configured shards", sh.ID, sh.Port)
+			continue
 		}
+		shards = append(shards, sh)
 	}
-	if _, err := s.db.ExecContext(ctx, `ALTER TABLE slots ADD COLUMN shard_id INTEGER NOT NULL DEFAULT 1`); err != nil {
-		return fmt.Errorf("add shard_id column: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate shards: %w", err)
 	}
+	s.setShardOrder(shards)
+	return shards, nil
+}
+
+// AddShard records a new shard and seeds its slots and server PSK. shards
+// must be the complete list with the new shard last.
+func (s *SlotStore) AddShard(ctx context.Context, shards []ShardDefinition) error {
+	added := shards[len(shards)-1]
+	if _, err := s.db.ExecContext(ctx, `
+INSERT INTO shards (id, port, slot_count, created_at)
+VALUES (?, ?, ?, ?)`,
+		added.ID, added.Port, added.SlotCount, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return fmt.Errorf("store shard %d: %w", added.ID, err)
+	}
+	if err := s.ensureSlots(ctx, shards); err != nil {
+		return err
+	}
+	if err := s.ensureServerPasswords(ctx, shards[len(shards)-1:]); err != nil {
+		return err
+	}
+	s.setShardOrder(shards)
 	return nil
 }
 
-func (s *SlotStore) ensureSlots(ctx context.Context, shards []ShardDefinition) error {
-	total := 0
+func (s *SlotStore) setShardOrder(shards []ShardDefinition) {
+	order := make([]int, len(shards))
+	for i, sh := range shards {
+		order[i] = sh.ID
+	}
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	s.shardOrder = order
+	s.defs = shardDefs(shards)
+}
+
+// layout returns the shards in the order their slot IDs are numbered.
+func (s *SlotStore) layout() []ShardDefinition {
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	shards := make([]ShardDefinition, 0, len(s.shardOrder))
+	for _, id := range s.shardOrder {
+		shards = append(shards, s.defs[id])
+	}
+	return shards
+}
+
+func shardDefs(shards []ShardDefinition) map[int]ShardDefinition {
+	defs := make(map[int]ShardDefinition, len(shards))
+	for _, sh := range shards {
+		defs[sh.ID] = sh
+	}
+	return defs
+}
+
+// shardDef is a shard by ID, or a Shadowsocks shard with the agent-wide
+// method for one no longer configured.
+func (s *SlotStore) shardDef(shardID int) ShardDefinition {
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+	if sh, ok := s.defs[shardID]; ok {
+		return sh
+	}
+	return ShardDefinition{ID: shardID, Protocol: protocolShadowsocks, Method: s.method}
+}
+
+// shardConflict reports whether candidate has the ID of one of shards or
+// a port, client or API, that one of them already uses.
+func shardConflict(shards []ShardDefinition, candidate ShardDefinition) bool {
 	for _, sh := range shards {
-		total += sh.SlotCount
+		if sh.ID == candidate.ID {
+			return true
+		}
+		for _, p := range shardPorts(sh) {
+			for _, q := range shardPorts(candidate) {
+				if p == q {
+					return true
+				}
+			}
+		}
 	}
+	return false
+}
+
+// shardPorts returns the host ports a shard publishes.
+func shardPorts(sh ShardDefinition) []int {
+	var ports []int
+	for _, p := range []int{sh.Port, sh.APIPort} {
+		if p > 0 {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+func (s *SlotStore) ensureSlots(ctx context.Context, shards []ShardDefinition) error {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin seed tx: %w", err)
 	}
 	defer tx.Rollback()
 
+	if err := s.seedSlots(ctx, tx, shards, nil); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit seed tx: %w", err)
+	}
+	return nil
+}
+
+// seedSlots inserts the missing slots of the shards in only (all shards
+// when nil) and assigns them to their shard. Slot IDs are numbered through
+// the whole layout, so the slots of shards outside only keep their IDs.
+func (s *SlotStore) seedSlots(ctx context.Context, tx *Tx, layout []ShardDefinition, only map[int]bool) error {
 	now := time.Now().UTC().Format(time.RFC3339Nano)
-	for slotID := 1; slotID <= total; slotID++ {
-		pwd, err := generatePassword()
-		if err != nil {
-			return fmt.Errorf("generate password: %w", err)
+	offset := 0
+	for _, sh := range layout {
+		start := offset + 1
+		offset += sh.SlotCount
+		if only != nil && !only[sh.ID] {
+			continue
 		}
-		if _, err := tx.ExecContext(
-			ctx,
-			`INSERT INTO slots (port, password, status, created_at, updated_at, shard_id)
+		for slotID := start; slotID <= offset; slotID++ {
+			pwd, err := newClientKey(sh)
+			if err != nil {
+				return fmt.Errorf("generate password: %w", err)
+			}
+			if pwd, err = s.secrets.seal(pwd, slotSecretAAD(slotID)); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(
+				ctx,
+				`INSERT INTO slots (port, password, status, created_at, updated_at, shard_id)
              VALUES (?, ?, ?, ?, ?, 1)
              ON CONFLICT(port) DO NOTHING`,
-			slotID,
-			pwd,
-			slotStatusFree,
-			now,
-			now,
-		); err != nil {
-			return fmt.Errorf("seed slot %d: %w", slotID, err)
+				slotID,
+				pwd,
+				slotStatusFree,
+				now,
+				now,
+			); err != nil {
+				return fmt.Errorf("seed slot %d: %w", slotID, err)
+			}
 		}
-	}
-
-	offset := 0
-	for _, sh := range shards {
-		start := offset + 1
-		end := offset + sh.SlotCount
 		if _, err := tx.ExecContext(ctx, `
 UPDATE slots
 SET shard_id = ?
 WHERE port BETWEEN ? AND ?`,
-			sh.ID, start, end); err != nil {
+			sh.ID, start, offset); err != nil {
 			return fmt.Errorf("assign shard %d: %w", sh.ID, err)
 		}
-		offset = end
-	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit seed tx: %w", err)
 	}
 	return nil
 }
@@ -177,27 +312,47 @@ func (s *SlotStore) ensureServerPasswords(ctx context.Context, shards []ShardDef
 		if sh.ID == 1 {
 			fallback = legacyServerPSKKey
 		}
-		psk, err := s.ensureServerPassword(ctx, key, fallback)
+		psk, err := s.ensureServerPassword(ctx, key, fallback, sh)
 		if err != nil {
 			return err
 		}
+		s.pskMu.Lock()
 		s.serverPasswords[sh.ID] = psk
+		s.pskMu.Unlock()
 	}
 	return nil
 }
 
-func (s *SlotStore) AllocateSlot(ctx context.Context, userID string) (*Slot, error) {
-	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+// AllocateSlot takes a free slot for userID. A non-empty clientKey replaces
+// the slot's generated password, so only shards whose protocol takes the key
+// are considered (see keyShards); the shard must then be reloaded.
+func (s *SlotStore) AllocateSlot(ctx context.Context, userID string, metadata map[string]any, clientKey string) (*Slot, error) {
+	metadataValue, err := encodeMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, s.db.dialect.lockTxOptions())
 	if err != nil {
 		return nil, fmt.Errorf("begin allocate tx: %w", err)
 	}
 	defer tx.Rollback()
 
+	if _, err := releaseCooldown(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	var eligible map[int]bool
+	if clientKey != "" {
+		s.orderMu.Lock()
+		eligible = keyShards(s.defs, clientKey)
+		s.orderMu.Unlock()
+	}
+
 	slot := &Slot{}
 	var row *sql.Row
-	switch s.allocStrategy {
-	case "roundrobin", "leastfree":
-		shardID, err := s.selectShardForAllocation(ctx)
+	switch {
+	case s.allocStrategy == "roundrobin", s.allocStrategy == "leastfree", eligible != nil:
+		shardID, err := s.selectShardForAllocation(ctx, tx, eligible)
 		if err != nil {
 			return nil, err
 		}
@@ -205,13 +360,13 @@ func (s *SlotStore) AllocateSlot(ctx context.Context, userID string) (*Slot, err
 SELECT port, password, shard_id FROM slots
 WHERE status = ? AND shard_id = ?
 ORDER BY port
-LIMIT 1`, slotStatusFree, shardID)
+LIMIT 1`+s.db.dialect.skipLocked(), slotStatusFree, shardID)
 	default: // sequential fallback
 		row = tx.QueryRowContext(ctx, `
 SELECT port, password, shard_id FROM slots
 WHERE status = ?
 ORDER BY port
-LIMIT 1`, slotStatusFree)
+LIMIT 1`+s.db.dialect.skipLocked(), slotStatusFree)
 	}
 	if err := row.Scan(&slot.ID, &slot.Password, &slot.ShardID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -219,18 +374,23 @@ LIMIT 1`, slotStatusFree)
 		}
 		return nil, fmt.Errorf("select free slot: %w", err)
 	}
+	if slot.Password, err = s.secrets.open(slot.Password, slotSecretAAD(slot.ID)); err != nil {
+		return nil, err
+	}
 
-	now := time.Now().UTC().Format(time.RFC3339Nano)
+	allocatedAt := time.Now().UTC()
+	now := allocatedAt.Format(time.RFC3339Nano)
 	var userValue interface{}
 	if userID != "" {
 		userValue = userID
 	}
 	res, err := tx.ExecContext(ctx, `
 UPDATE slots
-SET status = ?, user_id = ?, updated_at = ?
+SET status = ?, user_id = ?, metadata = ?, updated_at = ?
 WHERE port = ? AND status = ?`,
 		slotStatusUsed,
 		userValue,
+		metadataValue,
 		now,
 		slot.ID,
 		slotStatusFree,
@@ -242,21 +402,52 @@ WHERE port = ? AND status = ?`,
 	if affected == 0 {
 		return nil, errors.New("slot allocation conflict")
 	}
+	if clientKey != "" {
+		sealed, err := s.secrets.seal(clientKey, slotSecretAAD(slot.ID))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE slots SET password = ? WHERE port = ?`, sealed, slot.ID); err != nil {
+			return nil, fmt.Errorf("set password of slot %d: %w", slot.ID, err)
+		}
+		if err := bumpShardVersions(ctx, tx, slot.ShardID); err != nil {
+			return nil, err
+		}
+		slot.Password = clientKey
+	}
+	slot.Status = slotStatusUsed
+	slot.UserID = sql.NullString{String: userID, Valid: userID != ""}
+	if metadataValue != nil {
+		slot.Metadata = metadata
+	}
+	slot.UpdatedAt = allocatedAt
+	if err := recordAllocation(ctx, tx, slot, allocatedAt); err != nil {
+		return nil, err
+	}
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("commit allocate tx: %w", err)
 	}
-	slot.Status = slotStatusUsed
 	return slot, nil
 }
 
-func (s *SlotStore) ReserveSlot(ctx context.Context, slotID int) error {
-	now := time.Now().UTC().Format(time.RFC3339Nano)
-	res, err := s.db.ExecContext(ctx, `
+// ReserveSlot releases a used slot. It is rotated at the next reload and,
+// with a cooldown configured, stays unallocatable until the cooldown since
+// this call has passed. traffic, when known, is stored in the slot history.
+func (s *SlotStore) ReserveSlot(ctx context.Context, slotID int, traffic *Traffic) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin reserve tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := tx.ExecContext(ctx, `
 UPDATE slots
-SET status = ?, user_id = NULL, updated_at = ?
+SET status = ?, user_id = NULL, metadata = NULL, updated_at = ?, available_at = ?
 WHERE port = ? AND status = ?`,
 		slotStatusReserved,
-		now,
+		now.Format(time.RFC3339Nano),
+		now.Add(s.cooldown).Unix(),
 		slotID,
 		slotStatusUsed,
 	)
@@ -265,8 +456,15 @@ WHERE port = ? AND status = ?`,
 	}
 	rows, _ := res.RowsAffected()
 	if rows == 1 {
+		if err := recordRelease(ctx, tx, slotID, now, traffic); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("commit reserve tx: %w", err)
+		}
 		return nil
 	}
+	tx.Rollback()
 
 	status, err := s.slotStatus(ctx, slotID)
 	if err != nil {
@@ -284,6 +482,35 @@ WHERE port = ? AND status = ?`,
 	}
 }
 
+// SetPassword replaces the client password of a used slot. It takes effect
+// at the next reload of the shard; the slot gets a generated password again
+// when it is rotated after release.
+func (s *SlotStore) SetPassword(ctx context.Context, slotID int, password string) error {
+	sealed, err := s.secrets.seal(password, slotSecretAAD(slotID))
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `
+UPDATE slots SET password = ?, updated_at = ?
+WHERE port = ? AND status = ?`,
+		sealed,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		slotID,
+		slotStatusUsed,
+	)
+	if err != nil {
+		return fmt.Errorf("set password of slot %d: %w", slotID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errSlotNotInUse
+	}
+	var shardID int
+	if err := s.db.QueryRowContext(ctx, `SELECT shard_id FROM slots WHERE port = ?`, slotID).Scan(&shardID); err != nil {
+		return fmt.Errorf("fetch shard of slot %d: %w", slotID, err)
+	}
+	return bumpShardVersions(ctx, s.db, shardID)
+}
+
 func (s *SlotStore) slotStatus(ctx context.Context, slotID int) (string, error) {
 	var status string
 	err := s.db.QueryRowContext(ctx, `SELECT status FROM slots WHERE port = ?`, slotID).Scan(&status)
@@ -296,28 +523,53 @@ func (s *SlotStore) slotStatus(ctx context.Context, slotID int) (string, error)
 	return status, nil
 }
 
-func (s *SlotStore) RotateReserved(ctx context.Context, shardID int) (int, error) {
-	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+// RotateReserved gives every reserved slot of a shard a fresh password and
+// frees it, or moves it to cooldown until its available_at. It returns the
+// IDs of the rotated slots.
+func (s *SlotStore) RotateReserved(ctx context.Context, shardID int) ([]int, error) {
+	tx, err := s.db.BeginTx(ctx, s.db.dialect.lockTxOptions())
 	if err != nil {
-		return 0, fmt.Errorf("begin rotate tx: %w", err)
+		return nil, fmt.Errorf("begin rotate tx: %w", err)
 	}
 	defer tx.Rollback()
 
-	rows, err := tx.QueryContext(ctx, `SELECT port FROM slots WHERE status = ? AND shard_id = ? ORDER BY port`, slotStatusReserved, shardID)
+	rows, err := tx.QueryContext(ctx, `SELECT port, available_at FROM slots WHERE status = ? AND shard_id = ? ORDER BY port`+s.db.dialect.skipLocked(), slotStatusReserved, shardID)
 	if err != nil {
-		return 0, fmt.Errorf("select reserved slots: %w", err)
+		return nil, fmt.Errorf("select reserved slots: %w", err)
 	}
-	defer rows.Close()
-
-	count := 0
+	type reservedSlot struct {
+		id          int
+		availableAt int64
+	}
+	// read all rows before updating: PostgreSQL cannot run a statement on
+	// the connection while a result set is still open
+	var reserved []reservedSlot
 	for rows.Next() {
-		var slotID int
-		if err := rows.Scan(&slotID); err != nil {
-			return 0, fmt.Errorf("scan reserved slot: %w", err)
+		var r reservedSlot
+		if err := rows.Scan(&r.id, &r.availableAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan reserved slot: %w", err)
+		}
+		reserved = append(reserved, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate reserved slots: %w", err)
+	}
+
+	var rotated []int
+	for _, r := range reserved {
+		slotID := r.id
+		status := slotStatusFree
+		if r.availableAt > time.Now().Unix() {
+			status = slotStatusCooldown
 		}
-		pwd, err := generatePassword()
+		pwd, err := newClientKey(s.shardDef(shardID))
 		if err != nil {
-			return 0, fmt.Errorf("generate password for %d: %w", slotID, err)
+			return nil, fmt.Errorf("generate password for %d: %w", slotID, err)
+		}
+		if pwd, err = s.secrets.seal(pwd, slotSecretAAD(slotID)); err != nil {
+			return nil, err
 		}
 		now := time.Now().UTC().Format(time.RFC3339Nano)
 		if _, err := tx.ExecContext(ctx, `
@@ -325,27 +577,32 @@ UPDATE slots
 SET password = ?, status = ?, updated_at = ?
 WHERE port = ?`,
 			pwd,
-			slotStatusFree,
+			status,
 			now,
 			slotID,
 		); err != nil {
-			return 0, fmt.Errorf("update reserved slot %d: %w", slotID, err)
+			return nil, fmt.Errorf("update reserved slot %d: %w", slotID, err)
 		}
-		count++
+		if err := recordRotation(ctx, tx, slotID, time.Now()); err != nil {
+			return nil, err
+		}
+		rotated = append(rotated, slotID)
 	}
-	if err := rows.Err(); err != nil {
-		return 0, fmt.Errorf("iterate reserved slots: %w", err)
+	if len(rotated) > 0 {
+		if err := bumpShardVersions(ctx, tx, shardID); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("commit rotate tx: %w", err)
+		return nil, fmt.Errorf("commit rotate tx: %w", err)
 	}
-	return count, nil
+	return rotated, nil
 }
 
 func (s *SlotStore) SlotsByShard(ctx context.Context, shardID int, expected int) ([]Slot, error) {
 	rows, err := s.db.QueryContext(ctx, `
-SELECT port, password, status, user_id, shard_id
+SELECT port, password, status, user_id, shard_id, metadata
 FROM slots
 WHERE shard_id = ?
 ORDER BY port
@@ -358,9 +615,14 @@ LIMIT ?`, shardID, expected)
 	var slots []Slot
 	for rows.Next() {
 		var slot Slot
-		if err := rows.Scan(&slot.ID, &slot.Password, &slot.Status, &slot.UserID, &slot.ShardID); err != nil {
+		var metadata sql.NullString
+		if err := rows.Scan(&slot.ID, &slot.Password, &slot.Status, &slot.UserID, &slot.ShardID, &metadata); err != nil {
 			return nil, fmt.Errorf("scan slot: %w", err)
 		}
+		if slot.Password, err = s.secrets.open(slot.Password, slotSecretAAD(slot.ID)); err != nil {
+			return nil, err
+		}
+		slot.Metadata = decodeMetadata(metadata)
 		slots = append(slots, slot)
 	}
 	if err := rows.Err(); err != nil {
@@ -372,22 +634,126 @@ LIMIT ?`, shardID, expected)
 	return slots, nil
 }
 
-func generatePassword() (string, error) {
-	buf := make([]byte, 32)
-	if _, err := rand.Read(buf); err != nil {
-		return "", fmt.Errorf("read random bytes: %w", err)
+const slotColumns = `port, password, status, user_id, shard_id, updated_at, available_at, metadata`
+
+func (s *SlotStore) scanSlot(scan func(...any) error) (Slot, error) {
+	var slot Slot
+	var updated string
+	var availableAt int64
+	var metadata sql.NullString
+	if err := scan(&slot.ID, &slot.Password, &slot.Status, &slot.UserID, &slot.ShardID, &updated, &availableAt, &metadata); err != nil {
+		return Slot{}, err
+	}
+	password, err := s.secrets.open(slot.Password, slotSecretAAD(slot.ID))
+	if err != nil {
+		return Slot{}, err
+	}
+	slot.Password = password
+	slot.Metadata = decodeMetadata(metadata)
+	slot.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updated)
+	if availableAt > 0 {
+		slot.AvailableAt = time.Unix(availableAt, 0).UTC()
+	}
+	return slot, nil
+}
+
+// ReleaseCooldown frees slots whose cooldown has passed and returns how many.
+func (s *SlotStore) ReleaseCooldown(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin cooldown tx: %w", err)
+	}
+	defer tx.Rollback()
+	n, err := releaseCooldown(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit cooldown tx: %w", err)
+	}
+	return n, nil
+}
+
+func releaseCooldown(ctx context.Context, tx *Tx) (int, error) {
+	res, err := tx.ExecContext(ctx, `
+UPDATE slots
+SET status = ?, updated_at = ?
+WHERE status = ? AND available_at <= ?`,
+		slotStatusFree,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		slotStatusCooldown,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("release cooldown slots: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (s *SlotStore) GetSlot(ctx context.Context, slotID int) (*Slot, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+slotColumns+` FROM slots WHERE port = ?`, slotID)
+	slot, err := s.scanSlot(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSlotNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch slot %d: %w", slotID, err)
+	}
+	return &slot, nil
+}
+
+func (s *SlotStore) ListSlots(ctx context.Context, f SlotFilter) ([]Slot, error) {
+	query := `SELECT ` + slotColumns + ` FROM slots WHERE 1 = 1`
+	var args []any
+	if f.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, f.Status)
+	}
+	if f.ShardID > 0 {
+		query += ` AND shard_id = ?`
+		args = append(args, f.ShardID)
+	}
+	if f.UserID != "" {
+		query += ` AND user_id = ?`
+		args = append(args, f.UserID)
+	}
+	for key, value := range f.Metadata {
+		expr, arg := s.db.dialect.jsonText("metadata", key)
+		query += ` AND ` + expr + ` = ?`
+		args = append(args, arg, value)
 	}
-	return base64.StdEncoding.EncodeToString(buf), nil
+	query += ` ORDER BY port LIMIT ? OFFSET ?`
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list slots: %w", err)
+	}
+	defer rows.Close()
+
+	slots := []Slot{}
+	for rows.Next() {
+		slot, err := s.scanSlot(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("scan slot: %w", err)
+		}
+		slots = append(slots, slot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate slots: %w", err)
+	}
+	return slots, nil
 }
 
-func (s *SlotStore) ensureServerPassword(ctx context.Context, key, legacy string) (string, error) {
+func (s *SlotStore) ensureServerPassword(ctx context.Context, key, legacy string, shard ShardDefinition) (string, error) {
 	load := func(k string) (string, error) {
 		var value string
 		err := s.db.QueryRowContext(ctx, `SELECT value FROM metadata WHERE key = ?`, k).Scan(&value)
 		if err != nil {
 			return "", err
 		}
-		return value, nil
+		return s.secrets.open(value, metadataSecretAAD(k))
 	}
 
 	value, err := load(key)
@@ -398,33 +764,83 @@ func (s *SlotStore) ensureServerPassword(ctx context.Context, key, legacy string
 		return "", fmt.Errorf("load server password for %s: %w", key, err)
 	}
 
+	psk := ""
 	if legacy != "" {
 		if legacyValue, legacyErr := load(legacy); legacyErr == nil {
-			if err := s.upsertServerPassword(ctx, key, legacyValue); err != nil {
-				return "", err
-			}
-			return legacyValue, nil
+			psk = legacyValue
 		} else if legacyErr != nil && !errors.Is(legacyErr, sql.ErrNoRows) {
 			return "", fmt.Errorf("load legacy server password %s: %w", legacy, legacyErr)
 		}
 	}
+	if psk == "" {
+		if psk, err = newServerKey(shard); err != nil {
+			return "", fmt.Errorf("generate server password: %w", err)
+		}
+	}
+	if err := s.insertServerPassword(ctx, s.db, key, psk); err != nil {
+		return "", err
+	}
+	// another agent sharing the database may have stored its PSK first
+	value, err = load(key)
+	if err != nil {
+		return "", fmt.Errorf("load server password for %s: %w", key, err)
+	}
+	return value, nil
+}
 
-	psk, err := generatePassword()
+// RotateServerKeys replaces the server keys of shards in one transaction.
+// Agents sharing the shards reload them once they see the bumped versions.
+func (s *SlotStore) RotateServerKeys(ctx context.Context, shards []ShardDefinition) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return "", fmt.Errorf("generate server password: %w", err)
+		return fmt.Errorf("begin rotate tx: %w", err)
 	}
-	if err := s.upsertServerPassword(ctx, key, psk); err != nil {
-		return "", err
+	defer tx.Rollback()
+
+	psks := make(map[int]string, len(shards))
+	for _, sh := range shards {
+		key := fmt.Sprintf("%s%d", serverPSKPrefix, sh.ID)
+		keys := []any{key, ""}
+		if sh.ID == 1 {
+			keys[1] = legacyServerPSKKey
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM metadata WHERE key IN (?, ?)`, keys...); err != nil {
+			return fmt.Errorf("delete server key of shard %d: %w", sh.ID, err)
+		}
+		psk, err := newServerKey(sh)
+		if err != nil {
+			return fmt.Errorf("generate server password: %w", err)
+		}
+		if err := s.insertServerPassword(ctx, tx, key, psk); err != nil {
+			return err
+		}
+		psks[sh.ID] = psk
+		if err := bumpShardVersions(ctx, tx, sh.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit rotate tx: %w", err)
+	}
+	s.pskMu.Lock()
+	for id, psk := range psks {
+		s.serverPasswords[id] = psk
 	}
-	return psk, nil
+	s.pskMu.Unlock()
+	return nil
 }
 
-func (s *SlotStore) upsertServerPassword(ctx context.Context, key, value string) error {
+// insertServerPassword stores value unless key already has one.
+func (s *SlotStore) insertServerPassword(ctx context.Context, q querier, key, value string) error {
+	value, err := s.secrets.seal(value, metadataSecretAAD(key))
+	if err != nil {
+		return err
+	}
 	now := time.Now().UTC().Format(time.RFC3339Nano)
-	if _, err := s.db.ExecContext(ctx, `
+	if _, err := q.ExecContext(ctx, `
 INSERT INTO metadata (key, value, updated_at)
 VALUES (?, ?, ?)
-ON CONFLICT(key) DO UPDATE SET value=excluded.value, updated_at=excluded.updated_at`,
+ON CONFLICT(key) DO NOTHING`,
 		key, value, now); err != nil {
 		return fmt.Errorf("store server password for %s: %w", key, err)
 	}
@@ -432,6 +848,8 @@ ON CONFLICT(key) DO UPDATE SET value=excluded.value, updated_at=excluded.updated
 }
 
 func (s *SlotStore) ServerPassword(shardID int) string {
+	s.pskMu.RLock()
+	defer s.pskMu.RUnlock()
 	return s.serverPasswords[shardID]
 }
 
@@ -465,6 +883,9 @@ GROUP BY shard_id, status`)
 		case slotStatusReserved:
 			c.Reserved += count
 			totals.Reserved += count
+		case slotStatusCooldown:
+			c.Cooldown += count
+			totals.Cooldown += count
 		}
 		counts[shardID] = c
 	}
@@ -474,47 +895,131 @@ GROUP BY shard_id, status`)
 	return counts, totals, nil
 }
 
-func (s *SlotStore) selectShardForAllocation(ctx context.Context) (int, error) {
+// selectShardForAllocation picks the shard for the next allocation within
+// tx: round-robin skips shards without free slots, leastfree takes the shard
+// with the most free slots and sequential the first with free slots. Only
+// eligible shards are considered when eligible is not nil.
+func (s *SlotStore) selectShardForAllocation(ctx context.Context, tx *Tx, eligible map[int]bool) (int, error) {
+	rows, err := tx.QueryContext(ctx, `
+SELECT shard_id, COUNT(*)
+FROM slots
+WHERE status = ?
+GROUP BY shard_id`, slotStatusFree)
+	if err != nil {
+		return 0, fmt.Errorf("select free slots by shard: %w", err)
+	}
+	free := make(map[int]int)
+	for rows.Next() {
+		var shardID, count int
+		if err := rows.Scan(&shardID, &count); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan free slots: %w", err)
+		}
+		if eligible == nil || eligible[shardID] {
+			free[shardID] = count
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterate free slots: %w", err)
+	}
+
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
 	switch s.allocStrategy {
 	case "sequential":
-		return 0, nil
+		for _, shardID := range s.shardOrder {
+			if free[shardID] > 0 {
+				return shardID, nil
+			}
+		}
+		return 0, errNoFreePorts
 	case "roundrobin":
-		idx := s.lastShardIndex % len(s.shardOrder)
-		shardID := s.shardOrder[idx]
-		s.lastShardIndex = (idx + 1) % len(s.shardOrder)
-		return shardID, nil
-	case "leastfree":
-		stats, _, err := s.SlotStats(ctx)
-		if err != nil {
-			return 0, err
+		for i := range s.shardOrder {
+			idx := (s.lastShardIndex + i) % len(s.shardOrder)
+			if shardID := s.shardOrder[idx]; free[shardID] > 0 {
+				s.lastShardIndex = (idx + 1) % len(s.shardOrder)
+				return shardID, nil
+			}
 		}
+		return 0, errNoFreePorts
+	case "leastfree":
 		bestShard := 0
-		bestFree := -1
+		bestFree := 0
 		for _, id := range s.shardOrder {
-			free := stats[id].Free
-			if free > bestFree {
-				bestFree = free
+			if free[id] > bestFree {
+				bestFree = free[id]
 				bestShard = id
 			}
 		}
+		if bestShard == 0 {
+			return 0, errNoFreePorts
+		}
 		return bestShard, nil
 	default:
 		return 0, errors.New("unknown allocation strategy")
 	}
 }
 
+// Reset regenerates the slots and server keys of shards in one transaction,
+// leaving any other shard of a shared database alone. Agents sharing the
+// shards reload them once they see the bumped versions.
 func (s *SlotStore) Reset(ctx context.Context, shards []ShardDefinition) error {
-	s.lastShardIndex = 0
-	if _, err := s.db.ExecContext(ctx, `DELETE FROM slots`); err != nil {
-		return fmt.Errorf("truncate slots: %w", err)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin reset tx: %w", err)
 	}
-	if _, err := s.db.ExecContext(ctx, `
-DELETE FROM metadata 
-WHERE key LIKE 'server_psk_shard_%' OR key = 'server_psk'`); err != nil {
-		return fmt.Errorf("truncate metadata: %w", err)
+	defer tx.Rollback()
+
+	now := formatHistoryTime(time.Now())
+	reset := make(map[int]bool, len(shards))
+	psks := make(map[int]string, len(shards))
+	for _, sh := range shards {
+		reset[sh.ID] = true
+		if _, err := tx.ExecContext(ctx, `
+UPDATE slot_assignments
+SET released_at = COALESCE(released_at, ?), rotated_at = ?
+WHERE rotated_at IS NULL AND shard_id = ?`, now, now, sh.ID); err != nil {
+			return fmt.Errorf("close assignments of shard %d: %w", sh.ID, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM slots WHERE shard_id = ?`, sh.ID); err != nil {
+			return fmt.Errorf("delete slots of shard %d: %w", sh.ID, err)
+		}
+		keys := []any{fmt.Sprintf("%s%d", serverPSKPrefix, sh.ID), ""}
+		if sh.ID == 1 {
+			keys[1] = legacyServerPSKKey
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM metadata WHERE key IN (?, ?)`, keys...); err != nil {
+			return fmt.Errorf("delete server key of shard %d: %w", sh.ID, err)
+		}
+		psk, err := newServerKey(sh)
+		if err != nil {
+			return fmt.Errorf("generate server password: %w", err)
+		}
+		if err := s.insertServerPassword(ctx, tx, fmt.Sprintf("%s%d", serverPSKPrefix, sh.ID), psk); err != nil {
+			return err
+		}
+		psks[sh.ID] = psk
+		if err := bumpShardVersions(ctx, tx, sh.ID); err != nil {
+			return err
+		}
 	}
-	if err := s.ensureSlots(ctx, shards); err != nil {
+	// slot IDs follow the whole layout, which may hold more shards than
+	// are reset
+	if err := s.seedSlots(ctx, tx, s.layout(), reset); err != nil {
 		return err
 	}
-	return s.ensureServerPasswords(ctx, shards)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit reset tx: %w", err)
+	}
+
+	s.orderMu.Lock()
+	s.lastShardIndex = 0
+	s.orderMu.Unlock()
+	s.pskMu.Lock()
+	for id, psk := range psks {
+		s.serverPasswords[id] = psk
+	}
+	s.pskMu.Unlock()
+	return nil
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	syncFetchTimeout = 30 * time.Second
+	maxSyncSource    = 16 << 20
+)
+
+var (
+	errSyncDisabled = errors.New("sync_disabled")
+	errSyncSource   = errors.New("sync_source_failed")
+)
+
+// DesiredUser is one entry of the desired state. ClientKey, when set, is the
+// key the user must have, as accepted by /adduser; ExpiresAt removes the
+// user once passed. Password is the older name of ClientKey, still read from
+// documents written for it.
+type DesiredUser struct {
+	UserID    string         `yaml:"user_id" json:"user_id"`
+	ClientKey string         `yaml:"client_key" json:"client_key,omitempty"`
+	Password  string         `yaml:"password" json:"-"`
+	ExpiresAt *time.Time     `yaml:"expiresAt" json:"expiresAt,omitempty"`
+	Metadata  map[string]any `yaml:"metadata" json:"metadata,omitempty"`
+}
+
+// DesiredState is the document read from SyncSource, in YAML or JSON.
+type DesiredState struct {
+	Users []DesiredUser `yaml:"users" json:"users"`
+}
+
+// validate checks the document; checkKey validates client keys.
+func (d DesiredState) validate(checkKey func(key string) error) error {
+	seen := make(map[string]bool, len(d.Users))
+	for i, u := range d.Users {
+		if u.UserID == "" {
+			return fmt.Errorf("user %d: user_id is required", i+1)
+		}
+		if seen[u.UserID] {
+			return fmt.Errorf("duplicate user_id %q", u.UserID)
+		}
+		seen[u.UserID] = true
+		if u.ClientKey != "" {
+			if err := checkKey(u.ClientKey); err != nil {
+				return fmt.Errorf("user %q: %w", u.UserID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SyncReport describes one reconciliation. Missing users had no slot,
+// Extra users held slots without being desired (Expired lists those whose
+// expiry passed), and PasswordMismatch users held a slot with another
+// client key than the desired one. Unless DryRun is set, missing users were
+// given slots, extra users' slots were released and keys were replaced;
+// Errors lists each slot or user for which that failed.
+type SyncReport struct {
+	StartedAt        time.Time `json:"startedAt"`
+	FinishedAt       time.Time `json:"finishedAt"`
+	Source           string    `json:"source"`
+	DryRun           bool      `json:"dryRun"`
+	Desired          int       `json:"desired"`
+	Held             int       `json:"held"`
+	Unmanaged        int       `json:"unmanaged"`
+	Missing          []string  `json:"missing,omitempty"`
+	Extra            []string  `json:"extra,omitempty"`
+	Expired          []string  `json:"expired,omitempty"`
+	PasswordMismatch []string  `json:"passwordMismatch,omitempty"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+func (r SyncReport) summary() string {
+	return fmt.Sprintf("missing=%d extra=%d password=%d errors=%d",
+		len(r.Missing), len(r.Extra), len(r.PasswordMismatch), len(r.Errors))
+}
+
+// loadDesiredState reads the desired state from an http(s) URL, sending
+// SyncToken as a bearer token, or from a local file.
+func loadDesiredState(ctx context.Context, cfg Config, checkKey func(key string) error) (DesiredState, error) {
+	var data []byte
+	if strings.HasPrefix(cfg.SyncSource, "http://") || strings.HasPrefix(cfg.SyncSource, "https://") {
+		ctx, cancel := context.WithTimeout(ctx, syncFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.SyncSource, nil)
+		if err != nil {
+			return DesiredState{}, err
+		}
+		if cfg.SyncToken != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.SyncToken)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return DesiredState{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return DesiredState{}, fmt.Errorf("source returned %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxSyncSource+1)); err != nil {
+			return DesiredState{}, err
+		}
+		if len(data) > maxSyncSource {
+			return DesiredState{}, errors.New("source exceeds 16 MiB")
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(cfg.SyncSource); err != nil {
+			return DesiredState{}, err
+		}
+	}
+	var state DesiredState
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		return DesiredState{}, fmt.Errorf("parse source: %w", err)
+	}
+	for i := range state.Users {
+		u := &state.Users[i]
+		switch {
+		case u.Password == "":
+		case u.ClientKey == "":
+			u.ClientKey = u.Password
+		case u.ClientKey != u.Password:
+			return DesiredState{}, fmt.Errorf("user %q: password and client_key differ", u.UserID)
+		}
+		u.Password = ""
+	}
+	if err := state.validate(checkKey); err != nil {
+		return DesiredState{}, err
+	}
+	return state, nil
+}
+
+// StartSync reconciles against the desired state right away and then every
+// interval.
+func (a *Agent) StartSync(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := a.Sync(ctx, Caller{Identity: actorSync}, a.cfg.SyncDryRun); err != nil && ctx.Err() == nil {
+				log.Printf("sync failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Sync reads the desired state and reconciles the used slots against it.
+// Only slots held by a user ID are managed; slots allocated without one are
+// counted as unmanaged and left alone. A source that cannot be read or
+// parsed changes nothing and fails with errSyncSource.
+func (a *Agent) Sync(ctx context.Context, caller Caller, dryRun bool) (SyncReport, error) {
+	if a.cfg.SyncSource == "" {
+		return SyncReport{}, errSyncDisabled
+	}
+	a.syncM.Lock()
+	defer a.syncM.Unlock()
+
+	report := SyncReport{StartedAt: time.Now().UTC(), Source: a.cfg.SyncSource, DryRun: dryRun}
+	state, err := loadDesiredState(ctx, a.cfg, a.checkClientKey)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errSyncSource, err)
+		report.Errors = append(report.Errors, err.Error())
+	} else if err = a.reconcile(ctx, caller, state, &report); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.FinishedAt = time.Now().UTC()
+	a.lastSync.Store(&report)
+	a.events.Publish(Event{Type: eventSyncCompleted, Detail: report.summary()})
+	if len(report.Missing)+len(report.Extra)+len(report.PasswordMismatch) > 0 {
+		log.Printf("sync drift: %s (dry run %v)", report.summary(), dryRun)
+	}
+	return report, err
+}
+
+func (a *Agent) reconcile(ctx context.Context, caller Caller, state DesiredState, report *SyncReport) error {
+	used, err := a.store.ListSlots(ctx, SlotFilter{Status: slotStatusUsed, Limit: math.MaxInt32})
+	if err != nil {
+		return err
+	}
+	held := make(map[string][]Slot)
+	for _, slot := range used {
+		if !slot.UserID.Valid {
+			report.Unmanaged++
+			continue
+		}
+		held[slot.UserID.String] = append(held[slot.UserID.String], slot)
+	}
+	report.Held = len(held)
+
+	now := time.Now()
+	desired := make(map[string]DesiredUser, len(state.Users))
+	expired := make(map[string]bool)
+	var desiredUsers []string
+	for _, u := range state.Users {
+		if u.ExpiresAt != nil && !now.Before(*u.ExpiresAt) {
+			expired[u.UserID] = true
+			continue
+		}
+		desired[u.UserID] = u
+		desiredUsers = append(desiredUsers, u.UserID)
+	}
+	sort.Strings(desiredUsers)
+	report.Desired = len(desired)
+
+	var release []Slot
+	heldUsers := make([]string, 0, len(held))
+	for userID := range held {
+		heldUsers = append(heldUsers, userID)
+	}
+	sort.Strings(heldUsers)
+	for _, userID := range heldUsers {
+		if _, ok := desired[userID]; ok {
+			continue
+		}
+		report.Extra = append(report.Extra, userID)
+		if expired[userID] {
+			report.Expired = append(report.Expired, userID)
+		}
+		for _, slot := range held[userID] {
+			release = append(release, slot)
+		}
+	}
+	if max := a.cfg.SyncMaxRemovals; max > 0 && len(release) > max {
+		report.Errors = append(report.Errors, fmt.Sprintf("%d slots to release exceed syncMaxRemovals %d, none released", len(release), max))
+		release = nil
+	}
+
+	reload := make(map[int]bool)
+	var allocate []DesiredUser
+	for _, userID := range desiredUsers {
+		u := desired[userID]
+		slots, ok := held[userID]
+		if !ok {
+			report.Missing = append(report.Missing, userID)
+			allocate = append(allocate, u)
+			continue
+		}
+		if u.ClientKey == "" {
+			continue
+		}
+		mismatch := false
+		for _, slot := range slots {
+			if slot.Password == u.ClientKey {
+				continue
+			}
+			mismatch = true
+			if report.DryRun {
+				continue
+			}
+			if err := a.setClientKey(ctx, caller, slot, u.ClientKey); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("set client key of %s: %v", userID, err))
+				continue
+			}
+			reload[slot.ShardID] = true
+		}
+		if mismatch {
+			report.PasswordMismatch = append(report.PasswordMismatch, userID)
+		}
+	}
+	if report.DryRun {
+		return nil
+	}
+
+	// one slot failing must not keep the others held
+	for _, slot := range release {
+		if err := a.ReserveSlots(ctx, caller, []int{slot.ID}); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("release slot %d of %s: %v", slot.ID, slot.UserID.String, err))
+		}
+	}
+	for i, u := range allocate {
+		alloc, err := a.allocate(ctx, caller, u.UserID, u.Metadata, u.ClientKey)
+		if errors.Is(err, errNoFreePorts) {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v: %d users left without a slot", err, len(allocate)-i))
+			break
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("allocate %s: %v", u.UserID, err))
+			continue
+		}
+		if u.ClientKey != "" {
+			reload[alloc.Slot.ShardID] = true
+		}
+	}
+
+	if len(reload) > 0 {
+		shards := make([]int, 0, len(reload))
+		for id := range reload {
+			shards = append(shards, id)
+		}
+		sort.Ints(shards)
+		if _, err := a.Reload(ctx, false, shards); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("reload shards %v: %v", shards, err))
+		}
+	}
+	return nil
+}
+
+// setClientKey gives a used slot the key the user must keep. The shard has
+// to be reloaded afterwards.
+func (a *Agent) setClientKey(ctx context.Context, caller Caller, slot Slot, key string) error {
+	shard, _ := a.shardByID(slot.ShardID)
+	if err := validateClientKey(shard, key); err != nil {
+		return err
+	}
+	entry := caller.audit("setpassword")
+	entry.Slots = []int{slot.ID}
+	entry.Shards = []int{slot.ShardID}
+	entry.Detail = "user_id=" + slot.UserID.String
+	err := a.store.SetPassword(ctx, slot.ID, key)
+	entry.Result = auditResult(err)
+	a.audit.Record(context.Background(), entry)
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkTestKey accepts any client key except "bad".
+func checkTestKey(key string) error {
+	if key == "bad" {
+		return errors.New("invalid key")
+	}
+	return nil
+}
+
+func TestLoadDesiredState(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		want    map[string]string // user_id -> client key
+		wantErr string
+	}{
+		{
+			name:   "yaml",
+			source: "users:\n  - user_id: u1\n  - user_id: u2\n    client_key: k2\n",
+			want:   map[string]string{"u1": "", "u2": "k2"},
+		},
+		{
+			name:   "json",
+			source: `{"users":[{"user_id":"u1","client_key":"k1"}]}`,
+			want:   map[string]string{"u1": "k1"},
+		},
+		{
+			name:   "empty",
+			source: `{"users":[]}`,
+			want:   map[string]string{},
+		},
+		{
+			name:   "password alias",
+			source: `{"users":[{"user_id":"u1","password":"k1"}]}`,
+			want:   map[string]string{"u1": "k1"},
+		},
+		{
+			name:   "password alias in yaml",
+			source: "users:\n  - user_id: u1\n    password: k1\n",
+			want:   map[string]string{"u1": "k1"},
+		},
+		{
+			name:   "password and client_key agree",
+			source: `{"users":[{"user_id":"u1","password":"k1","client_key":"k1"}]}`,
+			want:   map[string]string{"u1": "k1"},
+		},
+		{
+			name:    "password and client_key differ",
+			source:  `{"users":[{"user_id":"u1","password":"k1","client_key":"k2"}]}`,
+			wantErr: `user "u1": password and client_key differ`,
+		},
+		{
+			name:    "password alias is validated",
+			source:  `{"users":[{"user_id":"u1","password":"bad"}]}`,
+			wantErr: `user "u1": invalid key`,
+		},
+		{
+			name:    "client_key is validated",
+			source:  `{"users":[{"user_id":"u1","client_key":"bad"}]}`,
+			wantErr: `user "u1": invalid key`,
+		},
+		{
+			name:    "missing user_id",
+			source:  `{"users":[{"client_key":"k1"}]}`,
+			wantErr: "user 1: user_id is required",
+		},
+		{
+			name:    "duplicate user_id",
+			source:  `{"users":[{"user_id":"u1"},{"user_id":"u1"}]}`,
+			wantErr: `duplicate user_id "u1"`,
+		},
+		{
+			name:    "malformed",
+			source:  `{"users":`,
+			wantErr: "parse source",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.yaml")
+			if err := os.WriteFile(path, []byte(tt.source), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			state, err := loadDesiredState(context.Background(), Config{SyncSource: path}, checkTestKey)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadDesiredState() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadDesiredState() = %v", err)
+			}
+			got := make(map[string]string, len(state.Users))
+			for _, u := range state.Users {
+				if u.Password != "" {
+					t.Errorf("user %q: password %q left set", u.UserID, u.Password)
+				}
+				got[u.UserID] = u.ClientKey
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("users = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sync-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"users":[{"user_id":"u1","password":"k1"}]}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr string
+	}{
+		{name: "token sent", token: "sync-token", want: "k1"},
+		{name: "wrong token", token: "other", wantErr: "source returned 401"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := loadDesiredState(context.Background(), Config{SyncSource: srv.URL, SyncToken: tt.token}, checkTestKey)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadDesiredState() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadDesiredState() = %v", err)
+			}
+			if len(state.Users) != 1 || state.Users[0].ClientKey != tt.want {
+				t.Fatalf("users = %+v, want one with client key %q", state.Users, tt.want)
+			}
+		})
+	}
+}
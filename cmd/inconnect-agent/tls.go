@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the API certificate and client CA pool and can swap
+// both at runtime (on SIGHUP) without restarting the listener.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	caPath   string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+func newCertReloader(certPath, keyPath, caPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath, caPath: caPath}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	var pool *x509.CertPool
+	if c.caPath != "" {
+		bundle, err := os.ReadFile(c.caPath)
+		if err != nil {
+			return fmt.Errorf("read client CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("no certificates found in %s", c.caPath)
+		}
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.pool = pool
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) Fingerprint() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil || len(c.cert.Certificate) == 0 {
+		return ""
+	}
+	return certFingerprint(c.cert.Certificate[0])
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// TLSConfig returns a server config that always picks up the latest
+// certificate and, if a client CA bundle is configured, requires a client
+// certificate signed by it.
+func (c *certReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+	if c.caPath == "" {
+		return base
+	}
+	base.ClientAuth = tls.RequireAndVerifyClientCert
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		pool := c.pool
+		c.mu.RUnlock()
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: c.getCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      pool,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}, nil
+	}
+	return base
+}
+
+// watchCertReload reloads TLS material on SIGHUP until ctx is cancelled.
+func watchCertReload(ctx context.Context, c *certReloader) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-sigCh:
+				if err := c.Reload(); err != nil {
+					log.Printf("tls reload failed, keeping previous certificate: %v", err)
+					continue
+				}
+				log.Printf("tls certificate reloaded, fingerprint sha256 %s", c.Fingerprint())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// ensureSelfSignedCert generates an ECDSA certificate for hosts unless both
+// certPath and keyPath already exist.
+func ensureSelfSignedCert(certPath, keyPath string, hosts []string) error {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("generate serial: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "inconnect-agent"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal key: %w", err)
+	}
+
+	if err := ensureParentDir(certPath); err != nil {
+		return err
+	}
+	if err := ensureParentDir(keyPath); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+	return nil
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// clientCertName returns the CN of a verified client certificate, if any.
+func clientCertName(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// tlsHosts lists the names a self-signed certificate should cover.
+func tlsHosts(cfg Config) []string {
+	hosts := []string{"localhost", "127.0.0.1"}
+	if cfg.PublicIP != "" {
+		hosts = append(hosts, cfg.PublicIP)
+	}
+	if host, _, err := net.SplitHostPort(cfg.ListenAddr); err == nil && host != "" && host != "0.0.0.0" && host != "::" {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Agents sharing a PostgreSQL pool each render every shard into their own
+// Xray config. A shard's version in shard_versions goes up whenever a change
+// in the database alters its config (a rotation, a caller-supplied key, a
+// reset, a rekey), and each agent reloads the shards whose version moved past
+// the one it last rendered, whichever agent made the change.
+
+// bumpShardVersions marks the configs of shards as changed.
+func bumpShardVersions(ctx context.Context, q querier, shardIDs ...int) error {
+	for _, id := range shardIDs {
+		if _, err := q.ExecContext(ctx, `
+INSERT INTO shard_versions (shard_id, version) VALUES (?, 1)
+ON CONFLICT (shard_id) DO UPDATE SET version = shard_versions.version + 1`, id); err != nil {
+			return fmt.Errorf("bump version of shard %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// ShardVersions returns the config version of every shard that has one;
+// shards never changed are at version 0.
+func (s *SlotStore) ShardVersions(ctx context.Context) (map[int]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT shard_id, version FROM shard_versions`)
+	if err != nil {
+		return nil, fmt.Errorf("select shard versions: %w", err)
+	}
+	defer rows.Close()
+	versions := make(map[int]int64)
+	for rows.Next() {
+		var id int
+		var version int64
+		if err := rows.Scan(&id, &version); err != nil {
+			return nil, fmt.Errorf("scan shard version: %w", err)
+		}
+		versions[id] = version
+	}
+	return versions, rows.Err()
+}
+
+// ShardVersion returns the config version of one shard.
+func (s *SlotStore) ShardVersion(ctx context.Context, shardID int) (int64, error) {
+	var version int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM shard_versions WHERE shard_id = ?`, shardID).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("select version of shard %d: %w", shardID, err)
+	}
+	return version, nil
+}
+
+// setRendered records the version a shard's active config was built from
+// and the client emails in it.
+func (a *Agent) setRendered(shardID int, version int64, emails map[int]string) {
+	a.versionsMu.Lock()
+	defer a.versionsMu.Unlock()
+	a.clientEmails[shardID] = emails
+	if version > a.rendered[shardID] {
+		a.rendered[shardID] = version
+	}
+}
+
+// clientEmail returns the email of slot in its shard's active config, which
+// Xray keys the slot's traffic counters by.
+func (a *Agent) clientEmail(slot Slot) string {
+	a.versionsMu.Lock()
+	defer a.versionsMu.Unlock()
+	if email, ok := a.clientEmails[slot.ShardID][slot.ID]; ok {
+		return email
+	}
+	return a.emails.email(slot)
+}
+
+// staleShards returns the shards whose version moved past the rendered one.
+func (a *Agent) staleShards(versions map[int]int64) []int {
+	a.versionsMu.Lock()
+	defer a.versionsMu.Unlock()
+	var stale []int
+	for _, shard := range a.allShards() {
+		if versions[shard.ID] > a.rendered[shard.ID] {
+			stale = append(stale, shard.ID)
+		}
+	}
+	sort.Ints(stale)
+	return stale
+}
+
+// StartSharedReload reloads, every interval, the shards another agent of the
+// shared pool changed since this agent last rendered them.
+func (a *Agent) StartSharedReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				versions, err := a.store.ShardVersions(ctx)
+				if err != nil {
+					log.Printf("shared reload check failed: %v", err)
+					continue
+				}
+				stale := a.staleShards(versions)
+				if len(stale) == 0 {
+					continue
+				}
+				log.Printf("shards %v changed in the shared database, reloading", stale)
+				if _, err := a.Reload(ctx, false, stale); err != nil {
+					log.Printf("shared reload failed: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	headerWebhookEvent = "X-Webhook-Event"
+
+	webhookTimeout     = 10 * time.Second
+	webhookPoll        = 5 * time.Second
+	webhookBatch       = 50
+	webhookBaseBackoff = 5 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookMaxAttempts = 12
+	// webhookRetention is how long delivered and abandoned rows stay in the
+	// outbox for inspection.
+	webhookRetention = 7 * 24 * time.Hour
+)
+
+// WebhookConfig is one receiver of agent events. Events limits which event
+// types are sent; empty or "*" means all of them.
+type WebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+func (w WebhookConfig) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", w.URL)
+	}
+	if w.Secret == "" {
+		return errors.New("secret is required")
+	}
+	for _, t := range w.Events {
+		if t != "*" && !knownEventType(t) {
+			return fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	return nil
+}
+
+func (w WebhookConfig) wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, t := range w.Events {
+		if t == "*" || t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDispatcher copies events from the bus into a persistent outbox and
+// delivers them with retries, so undelivered events survive a restart.
+type WebhookDispatcher struct {
+	db     *DB
+	hooks  map[string]WebhookConfig
+	client *http.Client
+	wake   chan struct{}
+
+	unsubscribe func()
+	done        chan struct{}
+}
+
+func NewWebhookDispatcher(db *DB, hooks []WebhookConfig) *WebhookDispatcher {
+	byURL := make(map[string]WebhookConfig, len(hooks))
+	for _, h := range hooks {
+		byURL[h.URL] = h
+	}
+	return &WebhookDispatcher{
+		db:     db,
+		hooks:  byURL,
+		client: &http.Client{Timeout: webhookTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Start subscribes to bus and begins delivering. It is a no-op when no
+// webhooks are configured.
+func (d *WebhookDispatcher) Start(ctx context.Context, bus *EventBus) {
+	if len(d.hooks) == 0 {
+		return
+	}
+	events, unsubscribe := bus.SubscribeAll()
+	d.unsubscribe = unsubscribe
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		for ev := range events {
+			d.enqueue(ev)
+		}
+	}()
+	go d.deliverLoop(ctx)
+}
+
+// Close stops taking new events and waits until those already published are
+// in the outbox.
+func (d *WebhookDispatcher) Close() {
+	if d.unsubscribe == nil {
+		return
+	}
+	d.unsubscribe()
+	<-d.done
+}
+
+func (d *WebhookDispatcher) enqueue(ev Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("webhook: encode %s event: %v", ev.Type, err)
+		return
+	}
+	now := time.Now().UTC()
+	queued := false
+	for _, hook := range d.hooks {
+		if !hook.wants(ev.Type) {
+			continue
+		}
+		if _, err := d.db.ExecContext(context.Background(), `
+INSERT INTO webhook_outbox (url, event_type, payload, next_attempt_at, created_at)
+VALUES (?, ?, ?, ?, ?)`,
+			hook.URL,
+			ev.Type,
+			string(payload),
+			now.Unix(),
+			now.Format(time.RFC3339Nano),
+		); err != nil {
+			log.Printf("webhook: queue %s for %s: %v", ev.Type, hook.URL, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliverLoop(ctx context.Context) {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		d.deliverDue(ctx)
+		if time.Since(lastPrune) > time.Hour {
+			d.prune(ctx)
+			lastPrune = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+type outboxRow struct {
+	id          int64
+	url         string
+	eventType   string
+	payload     string
+	attempts    int
+	nextAttempt int64
+}
+
+func (d *WebhookDispatcher) deliverDue(ctx context.Context) {
+	rows, err := d.db.QueryContext(ctx, `
+SELECT id, url, event_type, payload, attempts, next_attempt_at
+FROM webhook_outbox
+WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?
+ORDER BY id
+LIMIT ?`, time.Now().Unix(), webhookBatch)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("webhook: load outbox: %v", err)
+		}
+		return
+	}
+	var due []outboxRow
+	for rows.Next() {
+		var r outboxRow
+		if err := rows.Scan(&r.id, &r.url, &r.eventType, &r.payload, &r.attempts, &r.nextAttempt); err != nil {
+			log.Printf("webhook: scan outbox: %v", err)
+			rows.Close()
+			return
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+
+	for _, r := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if !d.claim(ctx, r) {
+			continue
+		}
+		hook, ok := d.hooks[r.url]
+		if !ok {
+			d.finish(ctx, r, errors.New("webhook no longer configured"), true)
+			continue
+		}
+		err := d.post(ctx, hook, r)
+		d.finish(ctx, r, err, r.attempts+1 >= webhookMaxAttempts)
+	}
+}
+
+// claim pushes the next attempt of r past the delivery timeout, so that
+// other agents sharing the database skip it while this one delivers. It
+// reports false when another agent claimed r first.
+func (d *WebhookDispatcher) claim(ctx context.Context, r outboxRow) bool {
+	res, err := d.db.ExecContext(ctx, `
+UPDATE webhook_outbox SET next_attempt_at = ?
+WHERE id = ? AND next_attempt_at = ? AND delivered_at IS NULL AND failed_at IS NULL`,
+		time.Now().Add(2*webhookTimeout).Unix(), r.id, r.nextAttempt)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("webhook: claim outbox %d: %v", r.id, err)
+		}
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// post sends one outbox row, signed like an incoming API request: the
+// outbox ID is the nonce and the path is the webhook URL path.
+func (d *WebhookDispatcher) post(ctx context.Context, hook WebhookConfig, r outboxRow) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader([]byte(r.payload)))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := strconv.FormatInt(r.id, 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookEvent, r.eventType)
+	req.Header.Set(headerTimestamp, ts)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, hex.EncodeToString(signRequest(hook.Secret, http.MethodPost, signedPath(req.URL), ts, nonce, []byte(r.payload))))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// finish records a delivery attempt: success, a retry with exponential
+// backoff, or giving up when final is set.
+func (d *WebhookDispatcher) finish(ctx context.Context, r outboxRow, deliveryErr error, final bool) {
+	now := time.Now().UTC()
+	var err error
+	switch {
+	case deliveryErr == nil:
+		_, err = d.db.ExecContext(ctx, `UPDATE webhook_outbox SET attempts = attempts + 1, last_error = '', delivered_at = ? WHERE id = ?`,
+			now.Format(time.RFC3339Nano), r.id)
+	case final:
+		log.Printf("webhook: giving up on %s event %d for %s: %v", r.eventType, r.id, r.url, deliveryErr)
+		_, err = d.db.ExecContext(ctx, `UPDATE webhook_outbox SET attempts = attempts + 1, last_error = ?, failed_at = ? WHERE id = ?`,
+			deliveryErr.Error(), now.Format(time.RFC3339Nano), r.id)
+	default:
+		backoff := webhookBaseBackoff << r.attempts
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+		_, err = d.db.ExecContext(ctx, `UPDATE webhook_outbox SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+			deliveryErr.Error(), now.Add(backoff).Unix(), r.id)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("webhook: update outbox %d: %v", r.id, err)
+	}
+}
+
+func (d *WebhookDispatcher) prune(ctx context.Context) {
+	cutoff := time.Now().UTC().Add(-webhookRetention).Format(time.RFC3339Nano)
+	if _, err := d.db.ExecContext(ctx, `
+DELETE FROM webhook_outbox
+WHERE (delivered_at IS NOT NULL AND delivered_at < ?) OR (failed_at IS NOT NULL AND failed_at < ?)`,
+		cutoff, cutoff); err != nil && ctx.Err() == nil {
+		log.Printf("webhook: prune outbox: %v", err)
+	}
+}
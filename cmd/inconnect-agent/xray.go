@@ -1,51 +1,112 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Agent ties together storage, config generation, docker orchestration, and HTTP handling.
 type Agent struct {
-	cfg      Config
-	store    *SlotStore
-	docker   *DockerManager
-	shards   []ShardDefinition
-	shardMap map[int]ShardDefinition
+	cfg    Config
+	store  *SlotStore
+	docker *DockerManager
+	audit  *AuditLog
+	// shardSet is replaced as a whole when the pool expands, so readers
+	// take it without opLock.
+	shardSet atomic.Pointer[shardSet]
+	nonces   *nonceCache
+	limiters map[string]endpointLimiter
+	jobs     *jobQueue
+	events   *EventBus
+	emails   emailTemplate
 	reloadM  sync.Mutex
 	opLock   sync.RWMutex
+
+	capacityMu  sync.Mutex
+	lowCapacity map[int]bool // by shard ID; 0 is the whole pool
+	expansions  atomic.Int64
+
+	syncM    sync.Mutex
+	lastSync atomic.Pointer[SyncReport]
+
+	// versionsMu guards rendered, the shard versions the active configs
+	// were built from, and clientEmails, the client emails by slot ID in
+	// them.
+	versionsMu   sync.Mutex
+	rendered     map[int]int64
+	clientEmails map[int]map[int]string
 }
 
-func NewAgent(cfg Config, shards []ShardDefinition, store *SlotStore, docker *DockerManager) *Agent {
-	shardMap := make(map[int]ShardDefinition, len(shards))
+// shardSet is the agent's shards in order and by ID.
+type shardSet struct {
+	list []ShardDefinition
+	byID map[int]ShardDefinition
+}
+
+func newShardSet(shards []ShardDefinition) *shardSet {
+	byID := make(map[int]ShardDefinition, len(shards))
 	for _, sh := range shards {
-		shardMap[sh.ID] = sh
+		byID[sh.ID] = sh
 	}
-	return &Agent{
+	return &shardSet{list: shards, byID: byID}
+}
+
+// allShards returns the current shards; callers must not modify the slice.
+func (a *Agent) allShards() []ShardDefinition {
+	return a.shardSet.Load().list
+}
+
+func (a *Agent) shardByID(id int) (ShardDefinition, bool) {
+	sh, ok := a.shardSet.Load().byID[id]
+	return sh, ok
+}
+
+func NewAgent(cfg Config, shards []ShardDefinition, store *SlotStore, docker *DockerManager, audit *AuditLog) *Agent {
+	// the template was checked by Config.validate
+	emails, _ := parseEmailTemplate(cfg.ClientEmailTemplate)
+	a := &Agent{
 		cfg:      cfg,
 		store:    store,
 		docker:   docker,
-		shards:   shards,
-		shardMap: shardMap,
+		audit:    audit,
+		nonces:   newNonceCache(),
+		limiters: newEndpointLimiters(cfg.RateLimits),
+		events:   NewEventBus(),
+		emails:   emails,
+
+		lowCapacity:  make(map[int]bool),
+		rendered:     make(map[int]int64),
+		clientEmails: make(map[int]map[int]string),
 	}
+	a.shardSet.Store(newShardSet(shards))
+	docker.Events = a.events
+	a.jobs = newJobQueue(cfg.MaxPendingJobs, func(eventType string, job Job) {
+		a.events.Publish(Event{Type: eventType, Job: &job})
+	})
+	return a
 }
 
 func (a *Agent) shardList(target []int) ([]ShardDefinition, error) {
 	if len(target) == 0 {
-		return a.shards, nil
+		return a.allShards(), nil
 	}
 	defs := make([]ShardDefinition, 0, len(target))
 	for _, id := range target {
-		sh, ok := a.shardMap[id]
+		sh, ok := a.shardByID(id)
 		if !ok {
 			return nil, fmt.Errorf("unknown shard_id %d", id)
 		}
@@ -66,6 +127,20 @@ func (a *Agent) ReloadAndRestart(ctx context.Context, rotateReserved bool, targe
 	return a.reloadWithLock(ctx, rotateReserved, target, true)
 }
 
+// shardIDs returns the IDs covered by target, expanding an empty target to
+// every shard.
+func (a *Agent) shardIDs(target []int) []int {
+	if len(target) > 0 {
+		return target
+	}
+	shards := a.allShards()
+	ids := make([]int, len(shards))
+	for i, sh := range shards {
+		ids[i] = sh.ID
+	}
+	return ids
+}
+
 func (a *Agent) reloadWithLock(ctx context.Context, rotateReserved bool, target []int, hardRestart bool) (map[int]int, error) {
 	a.reloadM.Lock()
 	defer a.reloadM.Unlock()
@@ -79,10 +154,14 @@ func (a *Agent) reloadWithLock(ctx context.Context, rotateReserved bool, target
 	for _, shard := range shards {
 		count, err := a.reloadShard(ctx, shard, rotateReserved, hardRestart)
 		if err != nil {
+			a.events.Publish(Event{Type: eventReloadFailed, ShardID: shard.ID, Detail: err.Error()})
 			return results, err
 		}
 		results[shard.ID] = count
 	}
+	if statsByShard, totals, err := a.store.SlotStats(ctx); err == nil {
+		a.checkCapacity(statsByShard, totals)
+	}
 	return results, nil
 }
 
@@ -92,29 +171,59 @@ func (a *Agent) Restart(ctx context.Context, target []int) error {
 }
 
 func (a *Agent) reloadShard(ctx context.Context, shard ShardDefinition, rotate bool, hardRestart bool) (int, error) {
+	mode := "reload"
+	if hardRestart {
+		mode = "restart"
+	}
+	a.events.Publish(Event{Type: eventShardReloading, ShardID: shard.ID, Detail: mode})
+
 	var processed int
 	if rotate {
-		count, err := a.store.RotateReserved(ctx, shard.ID)
+		rotated, err := a.store.RotateReserved(ctx, shard.ID)
 		if err != nil {
 			return 0, err
 		}
-		processed = count
+		processed = len(rotated)
+		for _, id := range rotated {
+			a.events.Publish(Event{Type: eventSlotRotated, SlotID: id, ShardID: shard.ID})
+		}
 	}
 
+	// read the version first: a change made while the config is built
+	// leaves the shard stale for the next shared reload check
+	version, err := a.store.ShardVersion(ctx, shard.ID)
+	if err != nil {
+		return processed, err
+	}
+	if err := a.store.ensureServerPasswords(ctx, []ShardDefinition{shard}); err != nil {
+		return processed, err
+	}
 	slots, err := a.store.SlotsByShard(ctx, shard.ID, shard.SlotCount)
 	if err != nil {
 		return processed, err
 	}
 
-	payload, err := buildXrayConfig(slots, shard, a.cfg, a.store.ServerPassword(shard.ID))
+	overlays, err := a.shardOverlays(shard)
+	if err != nil {
+		return processed, fmt.Errorf("shard %d: %w", shard.ID, err)
+	}
+	emails := a.emails.emails(slots)
+	payload, err := buildXrayConfig(slots, shard, a.cfg, emails, a.store.ServerPassword(shard.ID), overlays)
 	if err != nil {
 		return processed, fmt.Errorf("build config shard %d: %w", shard.ID, err)
 	}
 
+	// the config holds every client password and the server PSK, so only the
+	// owner may read it; WriteFile keeps the mode of a leftover file, hence
+	// the explicit chmod.
 	genPath := a.cfg.shardGeneratedPath(shard.ID)
-	if err := os.WriteFile(genPath, payload, 0o640); err != nil {
+	if err := os.WriteFile(genPath, payload, 0o600); err != nil {
 		return processed, fmt.Errorf("write config shard %d: %w", shard.ID, err)
 	}
+	if err := os.Chmod(genPath, 0o600); err != nil {
+		_ = os.Remove(genPath)
+		return processed, fmt.Errorf("chmod config shard %d: %w", shard.ID, err)
+	}
 
 	if err := a.docker.TestShard(ctx, a.cfg, shard); err != nil {
 		_ = os.Remove(genPath)
@@ -136,7 +245,17 @@ func (a *Agent) reloadShard(ctx context.Context, shard ShardDefinition, rotate b
 		}
 	}
 
+	a.setRendered(shard.ID, version, emails)
 	log.Printf("shard %d config updated", shard.ID)
+	eventType := eventShardReloaded
+	if hardRestart {
+		eventType = eventShardRestarted
+	}
+	a.events.Publish(Event{
+		Type:    eventType,
+		ShardID: shard.ID,
+		Detail:  fmt.Sprintf("rotated=%d", processed),
+	})
 	return processed, nil
 }
 
@@ -150,9 +269,12 @@ func (a *Agent) StartAutoRestart(ctx context.Context, interval time.Duration) {
 		for {
 			select {
 			case <-ticker.C:
-				if _, err := a.ReloadAndRestart(context.Background(), true, nil); err != nil {
+				a.schedulerTriggered("auto-restart", nil)
+				processed, err := a.ReloadAndRestart(context.Background(), true, nil)
+				if err != nil {
 					log.Printf("auto restart failed: %v", err)
 				}
+				a.auditScheduled("auto-restart", nil, processed, err)
 			case <-ctx.Done():
 				return
 			}
@@ -181,6 +303,33 @@ func (a *Agent) StartAutoRestartOnReserved(ctx context.Context, threshold int, c
 	}()
 }
 
+// StartCooldownRelease periodically frees slots whose cooldown has passed so
+// that stats reflect them without waiting for the next allocation.
+func (a *Agent) StartCooldownRelease(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := a.store.ReleaseCooldown(ctx)
+				if err != nil {
+					log.Printf("release cooldown slots failed: %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("%d slots finished cooldown", n)
+					if statsByShard, totals, err := a.store.SlotStats(ctx); err == nil {
+						a.checkCapacity(statsByShard, totals)
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 func (a *Agent) StartScheduledRestarts(ctx context.Context, times []string) {
 	if len(times) == 0 {
 		return
@@ -222,9 +371,12 @@ func (a *Agent) StartScheduledRestarts(ctx context.Context, times []string) {
 			select {
 			case <-time.After(wait):
 				log.Printf("scheduled restart trigger (UTC)")
-				if _, err := a.ReloadAndRestart(context.Background(), true, nil); err != nil {
+				a.schedulerTriggered("scheduled-restart", nil)
+				processed, err := a.ReloadAndRestart(context.Background(), true, nil)
+				if err != nil {
 					log.Printf("scheduled restart failed: %v", err)
 				}
+				a.auditScheduled("scheduled-restart", nil, processed, err)
 			case <-ctx.Done():
 				return
 			}
@@ -242,7 +394,7 @@ func (a *Agent) checkAndRestartOnReserved(ctx context.Context, threshold int) {
 	}
 
 	var targets []int
-	for _, shard := range a.shards {
+	for _, shard := range a.allShards() {
 		stats := statsByShard[shard.ID]
 		if stats.Reserved >= threshold {
 			targets = append(targets, shard.ID)
@@ -255,22 +407,69 @@ func (a *Agent) checkAndRestartOnReserved(ctx context.Context, threshold int) {
 
 	for _, shardID := range targets {
 		log.Printf("reserved slots in shard %d reached %d, triggering restart", shardID, threshold)
-		if _, err := a.ReloadAndRestart(context.Background(), true, []int{shardID}); err != nil {
+		a.schedulerTriggered("reserved-restart", []int{shardID})
+		processed, err := a.ReloadAndRestart(context.Background(), true, []int{shardID})
+		if err != nil {
 			log.Printf("auto restart on reserved shard %d failed: %v", shardID, err)
 		}
+		a.auditScheduled("reserved-restart", []int{shardID}, processed, err)
 	}
 }
 
+func (a *Agent) schedulerTriggered(operation string, target []int) {
+	ev := Event{Type: eventScheduler, Detail: operation}
+	if len(target) == 1 {
+		ev.ShardID = target[0]
+	}
+	a.events.Publish(ev)
+}
+
+func (a *Agent) auditScheduled(operation string, target []int, processed map[int]int, err error) {
+	a.audit.Record(context.Background(), AuditEntry{
+		Actor:     actorScheduler,
+		Operation: operation,
+		Shards:    a.shardIDs(target),
+		Result:    auditResult(err),
+		Detail:    formatProcessed(processed),
+	})
+}
+
+// RotateServerKeys gives shards new server keys and reloads them, rotating
+// their reserved slots as well. Slots and their users stay as they are.
+func (a *Agent) RotateServerKeys(ctx context.Context, target []int) (map[int]int, error) {
+	a.opLock.Lock()
+	defer a.opLock.Unlock()
+	shards, err := a.shardList(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.RotateServerKeys(ctx, shards); err != nil {
+		return nil, fmt.Errorf("rotate server keys: %w", err)
+	}
+	return a.reloadWithLock(ctx, true, target, false)
+}
+
 func (a *Agent) HardReset(ctx context.Context) error {
 	a.opLock.Lock()
 	defer a.opLock.Unlock()
 
-	cleanupContainers(ctx, a.docker, a.cfg, a.shards)
-	if err := a.store.Reset(ctx, a.shards); err != nil {
+	// a reset cannot be undone except from a backup, so it is not run
+	// without one; PostgreSQL is left to the operator's own backups
+	if _, err := a.backup(ctx, "pre-reset"); errors.Is(err, errBackupUnsupported) {
+		log.Printf("database not backed up before reset: back up PostgreSQL with pg_dump")
+	} else if err != nil {
+		return fmt.Errorf("backup before reset: %w", err)
+	}
+	shards := a.allShards()
+	cleanupContainers(ctx, a.docker, a.cfg, shards)
+	if err := a.store.Reset(ctx, shards); err != nil {
 		return fmt.Errorf("reset store: %w", err)
 	}
-	_, err := a.reloadWithLock(ctx, true, nil, true)
-	return err
+	if _, err := a.reloadWithLock(ctx, true, nil, true); err != nil {
+		return err
+	}
+	a.events.Publish(Event{Type: eventResetCompleted})
+	return nil
 }
 
 type xrayConfig struct {
@@ -292,7 +491,8 @@ type routingConfig struct {
 }
 
 type routingRule struct {
-	InboundTag  []string `json:"inboundTag"`
+	InboundTag  []string `json:"inboundTag,omitempty"`
+	User        []string `json:"user,omitempty"`
 	OutboundTag string   `json:"outboundTag"`
 	Type        string   `json:"type"`
 }
@@ -315,49 +515,39 @@ type policySystem struct {
 }
 
 type inbound struct {
-	Listen   string         `json:"listen,omitempty"`
-	Port     int            `json:"port"`
-	Protocol string         `json:"protocol"`
-	Settings map[string]any `json:"settings"`
-	Tag      string         `json:"tag,omitempty"`
+	Listen         string         `json:"listen,omitempty"`
+	Port           int            `json:"port"`
+	Protocol       string         `json:"protocol"`
+	Settings       map[string]any `json:"settings"`
+	StreamSettings map[string]any `json:"streamSettings,omitempty"`
+	Tag            string         `json:"tag,omitempty"`
 }
 
 type outbound struct {
-	Protocol string `json:"protocol"`
-	Tag      string `json:"tag,omitempty"`
+	Protocol string         `json:"protocol"`
+	Settings map[string]any `json:"settings,omitempty"`
+	Tag      string         `json:"tag,omitempty"`
 }
 
-type ssClient struct {
-	Password string `json:"password"`
+// xrayClient is a client of any inbound protocol; each protocol sets the
+// fields it uses.
+type xrayClient struct {
+	ID       string `json:"id,omitempty"`
+	Password string `json:"password,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Flow     string `json:"flow,omitempty"`
 	Email    string `json:"email,omitempty"`
 }
 
-func buildXrayConfig(slots []Slot, shard ShardDefinition, cfg Config, serverPassword string) ([]byte, error) {
-	clients := make([]ssClient, 0, len(slots))
+// buildXrayConfig generates a shard's config and merges overlays into it.
+// emails are the client emails by slot ID.
+func buildXrayConfig(slots []Slot, shard ShardDefinition, cfg Config, emails map[int]string, serverPassword string, overlays []map[string]any) ([]byte, error) {
+	inbounds := []inbound{shardInbound(slots, shard, emails, serverPassword)}
+	clientEmails := make([]string, 0, len(slots))
 	for _, slot := range slots {
-		email := fmt.Sprintf("slot-%d", slot.ID)
-		if slot.UserID.Valid && slot.UserID.String != "" {
-			email = slot.UserID.String
-		}
-		clients = append(clients, ssClient{
-			Password: slot.Password,
-			Email:    email,
-		})
-	}
-
-	inbounds := []inbound{
-		{
-			Listen:   "0.0.0.0",
-			Port:     shard.Port,
-			Protocol: "shadowsocks",
-			Settings: map[string]any{
-				"method":   cfg.Method,
-				"password": serverPassword,
-				"network":  "tcp,udp",
-				"clients":  clients,
-			},
-		},
+		clientEmails = append(clientEmails, emails[slot.ID])
 	}
+	egressOutbounds, userOutbounds, egressRules := shardEgress(cfg.Egress, shard, clientEmails)
 
 	if shard.APIPort > 0 {
 		inbounds = append(inbounds, inbound{
@@ -400,24 +590,106 @@ func buildXrayConfig(slots []Slot, shard ShardDefinition, cfg Config, serverPass
 			},
 		},
 		Inbounds: inbounds,
-		Outbounds: []outbound{
-			{Protocol: "freedom"},
-			{Protocol: "dns", Tag: "api"},
-		},
+		Outbounds: append(append(egressOutbounds,
+			outbound{Protocol: "freedom", Tag: "direct"},
+			outbound{Protocol: "dns", Tag: "api"},
+		), userOutbounds...),
 		Stats: map[string]any{},
 	}
 
+	// the egress user rules go after the overlays' rules, so that an
+	// operator's block rules also apply to the users sent through an egress
+	if len(overlays) == 0 {
+		cfgPayload.Routing.Rules = append(cfgPayload.Routing.Rules, egressRules...)
+	}
 	bytes, err := json.MarshalIndent(cfgPayload, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("marshal config: %w", err)
 	}
+	if len(overlays) == 0 {
+		return bytes, nil
+	}
+	if bytes, err = applyOverlays(bytes, overlays, egressRules); err != nil {
+		return nil, fmt.Errorf("apply overlay: %w", err)
+	}
 	return bytes, nil
 }
 
+// shardInboundTag tags the inbound serving the slots, so overlays can
+// refer to it.
+const shardInboundTag = "shard"
+
+// shardInbound is the inbound serving the shard's slots, one client per
+// slot. serverKey is the Shadowsocks 2022 PSK or the REALITY private key.
+func shardInbound(slots []Slot, shard ShardDefinition, emails map[int]string, serverKey string) inbound {
+	clients := make([]xrayClient, 0, len(slots))
+	for _, slot := range slots {
+		client := xrayClient{Email: emails[slot.ID]}
+		switch shard.Protocol {
+		case protocolVLESS:
+			client.ID, client.Flow = slot.Password, vlessFlow
+		case protocolVMess:
+			client.ID = slot.Password
+		case protocolShadowsocks:
+			client.Password = slot.Password
+			if !shard.ss2022() {
+				client.Method = shard.Method
+			}
+		default:
+			client.Password = slot.Password
+		}
+		clients = append(clients, client)
+	}
+
+	in := inbound{
+		Listen:   "0.0.0.0",
+		Port:     shard.Port,
+		Protocol: shard.Protocol,
+		Settings: map[string]any{"clients": clients},
+		Tag:      shardInboundTag,
+	}
+	switch {
+	case shard.Protocol == protocolShadowsocks:
+		in.Settings["network"] = xrayNetwork(shard.Network)
+		if shard.ss2022() {
+			in.Settings["method"] = shard.Method
+			in.Settings["password"] = serverKey
+		}
+	case shard.usesReality():
+		if shard.Protocol == protocolVLESS {
+			in.Settings["decryption"] = "none"
+		}
+		in.StreamSettings = map[string]any{
+			"network":  "tcp",
+			"security": "reality",
+			"realitySettings": map[string]any{
+				"dest":        shard.realityDest(),
+				"serverNames": []string{shard.ServerName},
+				"privateKey":  serverKey,
+				"shortIds":    []string{realityShortID(serverKey)},
+			},
+		}
+	default:
+		in.StreamSettings = map[string]any{"network": "tcp"}
+	}
+	return in
+}
+
 // DockerManager abstracts docker CLI interactions needed by the agent.
+// Fallbacks (a missing container, a failed reload signal) are published on
+// Events when it is set.
 type DockerManager struct {
 	Binary string
 	Image  string
+	Events *EventBus
+}
+
+// image is the shard's own image or the agent's.
+func (d *DockerManager) image(shard ShardDefinition) string {
+	if shard.Image != "" {
+		return shard.Image
+	}
+	return d.Image
 }
 
 func (d *DockerManager) TestShard(ctx context.Context, cfg Config, shard ShardDefinition) error {
@@ -426,7 +698,7 @@ func (d *DockerManager) TestShard(ctx context.Context, cfg Config, shard ShardDe
 		"--rm",
 		"-v",
 		fmt.Sprintf("%s:/etc/xray", cfg.ConfigDir),
-		d.Image,
+		d.image(shard),
 		"xray",
 		"-test",
 		"-config",
@@ -445,10 +717,12 @@ func (d *DockerManager) ApplyShard(ctx context.Context, cfg Config, shard ShardD
 	}
 	if !exists {
 		log.Printf("docker container %s not found, creating", shard.ContainerName)
+		d.Events.Publish(Event{Type: eventDockerFallback, ShardID: shard.ID, Detail: "container missing, creating"})
 		return d.createContainer(ctx, cfg, shard)
 	}
 	if err := d.sendSignal(ctx, shard.ContainerName, "SIGUSR1"); err != nil {
 		log.Printf("failed to signal container %s, falling back to restart: %v", shard.ContainerName, err)
+		d.Events.Publish(Event{Type: eventDockerFallback, ShardID: shard.ID, Detail: "signal failed, restarting: " + err.Error()})
 		if err := d.restartContainer(ctx, shard.ContainerName); err != nil {
 			return err
 		}
@@ -504,14 +778,19 @@ func (d *DockerManager) createContainer(ctx context.Context, cfg Config, shard S
 		"--name", shard.ContainerName,
 		"--restart=always",
 		"-v", fmt.Sprintf("%s:/etc/xray", cfg.ConfigDir),
-		"-p", fmt.Sprintf("%d:%d/tcp", shard.Port, shard.Port),
-		"-p", fmt.Sprintf("%d:%d/udp", shard.Port, shard.Port),
+	}
+	host := ""
+	if shard.Listen != "" {
+		host = net.JoinHostPort(shard.Listen, "")
+	}
+	for _, proto := range publishedProtocols(shard.Network) {
+		args = append(args, "-p", fmt.Sprintf("%s%d:%d/%s", host, shard.Port, shard.Port, proto))
 	}
 	if shard.APIPort > 0 {
 		args = append(args, "-p", fmt.Sprintf("%d:%d/tcp", shard.APIPort, shard.APIPort))
 	}
 	args = append(args,
-		d.Image,
+		d.image(shard),
 		"xray",
 		"-config",
 		filepath.ToSlash(filepath.Join("/etc/xray", filepath.Base(cfg.shardConfigPath(shard.ID)))),
@@ -522,6 +801,44 @@ func (d *DockerManager) createContainer(ctx context.Context, cfg Config, shard S
 	return nil
 }
 
+// UserTraffic reads the traffic counters of an Xray client through the
+// shard's API inbound. Counters start from zero when the container restarts.
+func (d *DockerManager) UserTraffic(ctx context.Context, shard ShardDefinition, email string) (*Traffic, error) {
+	if shard.APIPort <= 0 {
+		return nil, errors.New("shard has no api port")
+	}
+	output, err := runCommandOutput(ctx, d.Binary, []string{
+		"exec", shard.ContainerName,
+		"xray", "api", "statsquery",
+		fmt.Sprintf("--server=127.0.0.1:%d", shard.APIPort),
+		"-pattern", fmt.Sprintf("user>>>%s>>>traffic>>>", email),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query traffic for %s: %w", email, err)
+	}
+	var resp struct {
+		Stat []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"stat"`
+	}
+	if err := json.Unmarshal([]byte(output), &resp); err != nil {
+		return nil, fmt.Errorf("parse traffic for %s: %w", email, err)
+	}
+	traffic := &Traffic{}
+	for _, st := range resp.Stat {
+		// int64 values are printed as JSON strings
+		n, _ := strconv.ParseInt(strings.Trim(string(st.Value), `"`), 10, 64)
+		switch {
+		case strings.HasSuffix(st.Name, ">>>uplink"):
+			traffic.Uplink = n
+		case strings.HasSuffix(st.Name, ">>>downlink"):
+			traffic.Downlink = n
+		}
+	}
+	return traffic, nil
+}
+
 func (d *DockerManager) RemoveIfExists(ctx context.Context, name string) error {
 	exists, err := d.containerExists(ctx, name)
 	if err != nil {
@@ -550,19 +867,29 @@ func (e *commandError) Error() string {
 }
 
 func runCommand(ctx context.Context, bin string, args []string) error {
+	_, err := runCommandOutput(ctx, bin, args)
+	return err
+}
+
+// runCommandOutput runs a command and returns its stdout.
+func runCommandOutput(ctx context.Context, bin string, args []string) (string, error) {
 	cmd := exec.CommandContext(ctx, bin, args...)
-	output, err := cmd.CombinedOutput()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err == nil {
-		return nil
+		return stdout.String(), nil
 	}
+	output := stdout.String() + stderr.String()
 	exitCode := 0
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		exitCode = exitErr.ExitCode()
 	}
-	return &commandError{
+	return "", &commandError{
 		Cmd:      bin,
 		Args:     append([]string{}, args...),
-		Output:   string(output),
+		Output:   output,
 		ExitCode: exitCode,
 		err:      err,
 	}